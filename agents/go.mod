@@ -4,4 +4,6 @@ go 1.20
 
 replace ten_framework => ./ten_packages/system/ten_runtime_go/interface
 
+replace agent_pkg => ./pkg
+
 require ten_framework v0.0.0-00010101000000-000000000000
@@ -0,0 +1,188 @@
+/**
+ *
+ * Agora Real Time Engagement
+ * Copyright (c) 2024 Agora IO. All rights reserved.
+ *
+ */
+// Package metrics records the pipeline metrics of the extensions of an agent,
+// and serves them to the control server on the unix socket given by the
+// AGENT_METRICS_SOCKET environment, the control server aggregates them per
+// channel. Nothing is served if the environment is not set.
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metric is the value of a metric of an extension. Counters only have Value,
+// summaries have Count, Sum, Min, Max and Last.
+type Metric struct {
+	Name      string  `json:"name"`
+	Extension string  `json:"extension"`
+	Kind      string  `json:"kind"`
+	Help      string  `json:"help"`
+	Value     float64 `json:"value,omitempty"`
+	Count     uint64  `json:"count,omitempty"`
+	Sum       float64 `json:"sum,omitempty"`
+	Min       float64 `json:"min,omitempty"`
+	Max       float64 `json:"max,omitempty"`
+	Last      float64 `json:"last,omitempty"`
+}
+
+// Snapshot is the response of the metrics endpoint.
+type Snapshot struct {
+	Pid     int       `json:"pid"`
+	StartTs int64     `json:"start_ts"`
+	Ts      int64     `json:"ts"`
+	Metrics []*Metric `json:"metrics"`
+}
+
+type registry struct {
+	lock    sync.Mutex
+	metrics map[string]*Metric // by name and extension
+}
+
+const (
+	// Metric kinds
+	KindCounter = "counter"
+	KindSummary = "summary"
+
+	// LLM
+	LLMTimeToFirstToken    = "llm_time_to_first_token_seconds"
+	LLMTimeToFirstSentence = "llm_time_to_first_sentence_seconds"
+	LLMResponseTokens      = "llm_response_tokens"
+
+	// TTS
+	TTSFirstFrameLatency = "tts_first_frame_latency_seconds"
+	TTSAudioSeconds      = "tts_audio_seconds_total"
+
+	// Any extension
+	Flushes            = "flushes_total"
+	InterruptedStreams = "interrupted_streams_total"
+
+	envSocket = "AGENT_METRICS_SOCKET"
+)
+
+var (
+	logTag = slog.String("service", "AGENT_METRICS")
+
+	helps = map[string]string{
+		LLMTimeToFirstToken:    "Seconds from the request to the first token of the LLM response.",
+		LLMTimeToFirstSentence: "Seconds from the request to the first sentence of the LLM response.",
+		LLMResponseTokens:      "Tokens of the LLM responses, counted as stream chunks.",
+		TTSFirstFrameLatency:   "Seconds from the text to the first audio frame of the TTS.",
+		TTSAudioSeconds:        "Seconds of audio produced by the TTS.",
+		Flushes:                "Flush cmds received.",
+		InterruptedStreams:     "Streams interrupted by a flush before their end.",
+	}
+
+	metrics = &registry{metrics: make(map[string]*Metric)}
+	startTs = time.Now().Unix()
+)
+
+func init() {
+	if socket := os.Getenv(envSocket); socket != "" {
+		go serve(socket)
+	}
+}
+
+func (r *registry) metric(name string, extension string, kind string) *Metric {
+	key := name + "/" + extension
+	m, ok := r.metrics[key]
+	if !ok {
+		m = &Metric{Name: name, Extension: extension, Kind: kind, Help: helps[name]}
+		r.metrics[key] = m
+	}
+	return m
+}
+
+// Add adds the value to the counter of the extension.
+func Add(name string, extension string, value float64) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+
+	metrics.metric(name, extension, KindCounter).Value += value
+}
+
+// Inc adds one to the counter of the extension.
+func Inc(name string, extension string) {
+	Add(name, extension, 1)
+}
+
+// Observe records the value in the summary of the extension.
+func Observe(name string, extension string, value float64) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+
+	m := metrics.metric(name, extension, KindSummary)
+	if m.Count == 0 || value < m.Min {
+		m.Min = value
+	}
+	if m.Count == 0 || value > m.Max {
+		m.Max = value
+	}
+	m.Count++
+	m.Sum += value
+	m.Last = value
+}
+
+// ObserveDuration records the duration in seconds in the summary of the extension.
+func ObserveDuration(name string, extension string, d time.Duration) {
+	Observe(name, extension, d.Seconds())
+}
+
+// snapshot returns copies of the metrics, sorted by name and extension.
+func snapshot() *Snapshot {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+
+	s := &Snapshot{
+		Pid:     os.Getpid(),
+		StartTs: startTs,
+		Ts:      time.Now().Unix(),
+		Metrics: make([]*Metric, 0, len(metrics.metrics)),
+	}
+	for _, m := range metrics.metrics {
+		copied := *m
+		s.Metrics = append(s.Metrics, &copied)
+	}
+	sort.Slice(s.Metrics, func(i, j int) bool {
+		if s.Metrics[i].Name != s.Metrics[j].Name {
+			return s.Metrics[i].Name < s.Metrics[j].Name
+		}
+		return s.Metrics[i].Extension < s.Metrics[j].Extension
+	})
+
+	return s
+}
+
+// serve serves the snapshot on GET /metrics of the unix socket.
+func serve(socket string) {
+	// The socket is left behind by the previous process of a restarted worker
+	os.Remove(socket)
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		slog.Error(fmt.Sprintf("metrics listen on %s failed, err: %v", socket, err), logTag)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshot())
+	})
+
+	slog.Info(fmt.Sprintf("metrics served on %s", socket), logTag)
+	if err := http.Serve(listener, mux); err != nil {
+		slog.Error(fmt.Sprintf("metrics serve failed, err: %v", err), logTag)
+	}
+}
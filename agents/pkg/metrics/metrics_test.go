@@ -0,0 +1,37 @@
+/**
+ *
+ * Agora Real Time Engagement
+ * Copyright (c) 2024 Agora IO. All rights reserved.
+ *
+ */
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	Inc(Flushes, "test")
+	Add(Flushes, "test", 2)
+	ObserveDuration(LLMTimeToFirstToken, "test", 300*time.Millisecond)
+	ObserveDuration(LLMTimeToFirstToken, "test", 100*time.Millisecond)
+
+	s := snapshot()
+	if len(s.Metrics) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(s.Metrics))
+	}
+
+	flushes := s.Metrics[0]
+	if flushes.Name != Flushes || flushes.Kind != KindCounter || flushes.Value != 3 {
+		t.Errorf("unexpected counter %+v", flushes)
+	}
+
+	ttft := s.Metrics[1]
+	if ttft.Name != LLMTimeToFirstToken || ttft.Kind != KindSummary || ttft.Count != 2 {
+		t.Errorf("unexpected summary %+v", ttft)
+	}
+	if ttft.Min != 0.1 || ttft.Max != 0.3 || ttft.Last != 0.1 {
+		t.Errorf("unexpected summary values %+v", ttft)
+	}
+}
@@ -0,0 +1,164 @@
+/**
+ *
+ * Agora Real Time Engagement
+ * Copyright (c) 2024 Agora IO. All rights reserved.
+ *
+ */
+// Package tracing traces the turns of a conversation across the extensions of
+// an agent with OpenTelemetry.
+//
+// A turn starts when the LLM extension receives the final text of the user,
+// its id and W3C trace context are stamped as properties on the data and cmds
+// sent for the turn, so that the following extensions attach their spans to
+// the same trace.
+//
+// The spans are exported by OTLP when OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set, otherwise as JSON lines to the
+// file given by AGENT_TRACES_FILE. Without either the turn ids are still
+// generated for the logs, but nothing is exported.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// Properties stamped on the data and cmds of a turn
+	PropertyTurnId      = "turn_id"
+	PropertyTraceparent = "traceparent"
+
+	// Span attributes
+	AttributeTurnId      = "turn.id"
+	AttributeExtension   = "extension"
+	AttributeInterrupted = "interrupted"
+
+	serviceName = "astra_agent"
+
+	envOtlpEndpoint       = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	envOtlpTracesEndpoint = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	envTracesFile         = "AGENT_TRACES_FILE"
+
+	flushTimeout = 5 * time.Second
+)
+
+var (
+	logTag = slog.String("service", "AGENT_TRACING")
+
+	propagator = propagation.TraceContext{}
+	provider   *sdktrace.TracerProvider
+)
+
+func init() {
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(serviceName),
+			semconv.ProcessPID(os.Getpid()),
+		)),
+	}
+	if processor := newSpanProcessor(); processor != nil {
+		opts = append(opts, sdktrace.WithSpanProcessor(processor))
+	}
+
+	provider = sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+}
+
+// newSpanProcessor exports by OTLP if configured, falls back to the traces
+// file, nil if neither is available.
+func newSpanProcessor() sdktrace.SpanProcessor {
+	if os.Getenv(envOtlpEndpoint) != "" || os.Getenv(envOtlpTracesEndpoint) != "" {
+		exporter, err := otlptracehttp.New(context.Background())
+		if err == nil {
+			slog.Info("traces exported by otlp", logTag)
+			return sdktrace.NewBatchSpanProcessor(exporter)
+		}
+		slog.Error(fmt.Sprintf("otlp exporter create failed, fall back to the traces file, err: %v", err), logTag)
+	}
+
+	file := os.Getenv(envTracesFile)
+	if file == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		slog.Error(fmt.Sprintf("traces file %s open failed, err: %v", file, err), logTag)
+		return nil
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+	if err != nil {
+		slog.Error(fmt.Sprintf("file exporter create failed, err: %v", err), logTag)
+		f.Close()
+		return nil
+	}
+
+	slog.Info(fmt.Sprintf("traces exported to %s", file), logTag)
+	// Spans are written as they end, so that nothing is lost when the worker is killed
+	return sdktrace.NewSimpleSpanProcessor(exporter)
+}
+
+// Tracer returns the tracer of the extension.
+func Tracer(extension string) trace.Tracer {
+	return otel.Tracer(extension)
+}
+
+// Turn is the trace of a conversation turn.
+type Turn struct {
+	Id          string
+	Traceparent string
+}
+
+// StartTurn starts the root span of a new turn, its id is the trace id.
+func StartTurn(tracer trace.Tracer, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span, *Turn) {
+	ctx, span := tracer.Start(context.Background(), name, trace.WithNewRoot(), trace.WithAttributes(attrs...))
+	turn := &Turn{
+		Id:          span.SpanContext().TraceID().String(),
+		Traceparent: Traceparent(ctx),
+	}
+	span.SetAttributes(attribute.String(AttributeTurnId, turn.Id))
+
+	return ctx, span, turn
+}
+
+// Traceparent returns the W3C trace context of the span of the context.
+func Traceparent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get(PropertyTraceparent)
+}
+
+// ContextWithTraceparent returns a context continuing the W3C trace context,
+// a background context if it's empty or invalid.
+func ContextWithTraceparent(traceparent string) context.Context {
+	if traceparent == "" {
+		return context.Background()
+	}
+	return propagator.Extract(context.Background(), propagation.MapCarrier{PropertyTraceparent: traceparent})
+}
+
+// Flush exports the spans not exported yet. The provider is shared by the
+// extensions of the worker, so it's flushed rather than shut down when one of
+// them stops.
+func Flush() {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	if err := provider.ForceFlush(ctx); err != nil {
+		slog.Error(fmt.Sprintf("spans flush failed, err: %v", err), logTag)
+	}
+}
@@ -0,0 +1,42 @@
+/**
+ *
+ * Agora Real Time Engagement
+ * Copyright (c) 2024 Agora IO. All rights reserved.
+ *
+ */
+package tracing
+
+import (
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTurnPropagation(t *testing.T) {
+	tracer := Tracer("test")
+
+	_, span, turn := StartTurn(tracer, "turn")
+	defer span.End()
+
+	if len(turn.Id) != 32 {
+		t.Fatalf("turn id %q is not a trace id", turn.Id)
+	}
+	if turn.Traceparent == "" {
+		t.Fatal("traceparent is empty")
+	}
+
+	ctx := ContextWithTraceparent(turn.Traceparent)
+	_, child := tracer.Start(ctx, "child")
+	defer child.End()
+
+	if got := child.SpanContext().TraceID().String(); got != turn.Id {
+		t.Errorf("child trace id %s, want %s", got, turn.Id)
+	}
+	if got := trace.SpanContextFromContext(ctx).SpanID(); got != span.SpanContext().SpanID() {
+		t.Errorf("parent span id %s, want %s", got, span.SpanContext().SpanID())
+	}
+
+	if ContextWithTraceparent("") == nil || trace.SpanContextFromContext(ContextWithTraceparent("invalid")).IsValid() {
+		t.Error("invalid traceparent continued a trace")
+	}
+}
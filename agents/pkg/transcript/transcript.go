@@ -0,0 +1,86 @@
+/**
+ *
+ * Agora Real Time Engagement
+ * Copyright (c) 2024 Agora IO. All rights reserved.
+ *
+ */
+// Package transcript records the conversation of an agent, one JSON line per
+// message, in the file given by the AGENT_TRANSCRIPT_FILE environment. The
+// control server serves the file, and keeps it after the agent exits. Nothing
+// is recorded if the environment is not set.
+package transcript
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Record is a message of the conversation. The timestamps are unix
+// milliseconds, the latencies are from StartTs.
+type Record struct {
+	TurnId                 string `json:"turn_id,omitempty"`
+	Role                   string `json:"role"`
+	Text                   string `json:"text"`
+	StartTs                int64  `json:"start_ts"`
+	EndTs                  int64  `json:"end_ts"`
+	Interrupted            bool   `json:"interrupted,omitempty"` // by a flush
+	FirstTokenLatencyMs    int64  `json:"first_token_latency_ms,omitempty"`
+	FirstSentenceLatencyMs int64  `json:"first_sentence_latency_ms,omitempty"`
+	Tokens                 int    `json:"tokens,omitempty"`
+}
+
+type recorder struct {
+	lock sync.Mutex
+	file string
+	f    *os.File
+}
+
+const (
+	// Roles
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+
+	envFile = "AGENT_TRANSCRIPT_FILE"
+)
+
+var (
+	logTag = slog.String("service", "AGENT_TRANSCRIPT")
+
+	transcript = &recorder{file: os.Getenv(envFile)}
+)
+
+// Append appends the record to the transcript.
+func Append(r *Record) {
+	transcript.append(r)
+}
+
+func (t *recorder) append(r *Record) {
+	if t.file == "" {
+		return
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		slog.Error(fmt.Sprintf("transcript marshal failed, err: %v", err), logTag)
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Opened on the first record, so that agents without conversation leave no file
+	if t.f == nil {
+		if t.f, err = os.OpenFile(t.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+			slog.Error(fmt.Sprintf("transcript file %s open failed, err: %v", t.file, err), logTag)
+			t.f = nil
+			return
+		}
+	}
+
+	if _, err := t.f.Write(append(line, '\n')); err != nil {
+		slog.Error(fmt.Sprintf("transcript file %s write failed, err: %v", t.file, err), logTag)
+	}
+}
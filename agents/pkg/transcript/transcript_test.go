@@ -0,0 +1,55 @@
+/**
+ *
+ * Agora Real Time Engagement
+ * Copyright (c) 2024 Agora IO. All rights reserved.
+ *
+ */
+package transcript
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "transcript.jsonl")
+	recorder := &recorder{file: file}
+
+	recorder.append(&Record{TurnId: "t1", Role: RoleUser, Text: "hello", StartTs: 1, EndTs: 1})
+	recorder.append(&Record{TurnId: "t1", Role: RoleAssistant, Text: "hi", StartTs: 1, EndTs: 5, Interrupted: true, FirstTokenLatencyMs: 2})
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []*Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, &r)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	if records[0].Role != RoleUser || records[1].Role != RoleAssistant || !records[1].Interrupted || records[1].FirstTokenLatencyMs != 2 {
+		t.Errorf("unexpected records %+v %+v", records[0], records[1])
+	}
+}
+
+func TestAppendDisabled(t *testing.T) {
+	recorder := &recorder{}
+	recorder.append(&Record{Role: RoleUser, Text: "hello"})
+
+	if recorder.f != nil {
+		t.Error("file opened without a transcript file")
+	}
+}
@@ -18,7 +18,12 @@ import (
 	"sync/atomic"
 	"time"
 
+	"agent_pkg/metrics"
+	"agent_pkg/tracing"
 	"ten_framework/ten"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -39,10 +44,13 @@ const (
 
 const (
 	textChanMax = 1024
+
+	metricsExtension = "elevenlabs_tts"
 )
 
 var (
 	logTag = slog.String("extension", "ELEVENLABS_TTS_EXTENSION")
+	tracer = tracing.Tracer("elevenlabs_tts")
 
 	outdateTs atomic.Int64
 	textChan  chan *message
@@ -55,8 +63,10 @@ type elevenlabsTTSExtension struct {
 }
 
 type message struct {
-	text       string
-	receivedTs int64
+	text        string
+	receivedTs  int64
+	turnId      string // empty if the text is not sent for a turn, e.g. the greeting
+	traceparent string
 }
 
 func newElevenlabsTTSExtension(name string) ten.Extension {
@@ -160,6 +170,7 @@ func (e *elevenlabsTTSExtension) OnStart(ten ten.TenEnv) {
 	// create pcm instance
 	pcm := newPcm(defaultPcmConfig())
 	pcmFrameSize := pcm.getPcmFrameSize()
+	pcmBytesPerSecond := pcm.config.SampleRate * pcm.config.BytesPerSample * pcm.config.Channel
 
 	// init chan
 	textChan = make(chan *message, textChanMax)
@@ -175,10 +186,14 @@ func (e *elevenlabsTTSExtension) OnStart(ten ten.TenEnv) {
 			}
 
 			wg.Add(1)
-			slog.Info(fmt.Sprintf("textChan text: [%s]", msg.text), logTag)
+			slog.Info(fmt.Sprintf("textChan text: [%s], turnId: %s", msg.text, msg.turnId), logTag)
 
 			r, w := io.Pipe()
 			startTime := time.Now()
+			_, span := tracer.Start(tracing.ContextWithTraceparent(msg.traceparent), "tts.synthesis", trace.WithAttributes(
+				attribute.String(tracing.AttributeTurnId, msg.turnId),
+				attribute.Int("tts.text_length", len(msg.text)),
+			))
 
 			go func() {
 				defer wg.Done()
@@ -189,6 +204,7 @@ func (e *elevenlabsTTSExtension) OnStart(ten ten.TenEnv) {
 				err = e.elevenlabsTTS.textToSpeechStream(w, msg.text)
 				if err != nil {
 					slog.Error(fmt.Sprintf("textToSpeechStream failed, err: %v", err), logTag)
+					span.RecordError(err)
 					return
 				}
 			}()
@@ -201,6 +217,7 @@ func (e *elevenlabsTTSExtension) OnStart(ten ten.TenEnv) {
 				pcmFrameRead      int
 				readBytes         int
 				sentFrames        int
+				interrupted       bool
 			)
 			buf := pcm.newBuf()
 
@@ -209,6 +226,8 @@ func (e *elevenlabsTTSExtension) OnStart(ten ten.TenEnv) {
 				if msg.receivedTs < outdateTs.Load() { // Check whether to interrupt
 					slog.Info(fmt.Sprintf("read pcm stream interrupt and flushing for input text: [%s], receivedTs: %d, outdateTs: %d",
 						msg.text, msg.receivedTs, outdateTs.Load()), logTag)
+					metrics.Inc(metrics.InterruptedStreams, metricsExtension)
+					interrupted = true
 					break
 				}
 
@@ -239,6 +258,8 @@ func (e *elevenlabsTTSExtension) OnStart(ten ten.TenEnv) {
 
 				if firstFrameLatency == 0 {
 					firstFrameLatency = time.Since(startTime).Milliseconds()
+					metrics.ObserveDuration(metrics.TTSFirstFrameLatency, metricsExtension, time.Since(startTime))
+					span.AddEvent("first_frame")
 					slog.Info(fmt.Sprintf("first frame available for text: [%s], receivedTs: %d, firstFrameLatency: %dms", msg.text, msg.receivedTs, firstFrameLatency), logTag)
 				}
 
@@ -252,14 +273,32 @@ func (e *elevenlabsTTSExtension) OnStart(ten ten.TenEnv) {
 			}
 
 			r.Close()
-			slog.Info(fmt.Sprintf("send pcm data finished, text: [%s], receivedTs: %d, readBytes: %d, sentFrames: %d, firstFrameLatency: %dms, finishLatency: %dms",
-				msg.text, msg.receivedTs, readBytes, sentFrames, firstFrameLatency, time.Since(startTime).Milliseconds()), logTag)
+			audioSeconds := float64(readBytes) / float64(pcmBytesPerSecond)
+			metrics.Add(metrics.TTSAudioSeconds, metricsExtension, audioSeconds)
+			span.SetAttributes(
+				attribute.Int("tts.read_bytes", readBytes),
+				attribute.Int("tts.sent_frames", sentFrames),
+				attribute.Float64("tts.audio_seconds", audioSeconds),
+				attribute.Bool(tracing.AttributeInterrupted, interrupted),
+			)
+			span.End()
+			slog.Info(fmt.Sprintf("send pcm data finished, text: [%s], turnId: %s, receivedTs: %d, readBytes: %d, sentFrames: %d, firstFrameLatency: %dms, finishLatency: %dms",
+				msg.text, msg.turnId, msg.receivedTs, readBytes, sentFrames, firstFrameLatency, time.Since(startTime).Milliseconds()), logTag)
 		}
 	}()
 
 	ten.OnStartDone()
 }
 
+// OnStop exports the spans of the extension before the worker exits.
+func (e *elevenlabsTTSExtension) OnStop(ten ten.TenEnv) {
+	slog.Info("OnStop", logTag)
+
+	tracing.Flush()
+
+	ten.OnStopDone()
+}
+
 // OnCmd receives cmd from ten graph.
 // current supported cmd:
 //   - name: flush
@@ -282,6 +321,16 @@ func (e *elevenlabsTTSExtension) OnCmd(
 	switch cmdName {
 	case cmdInFlush:
 		outdateTs.Store(time.Now().UnixMicro())
+		metrics.Inc(metrics.Flushes, metricsExtension)
+
+		// the flush interrupts the turn it's stamped with
+		turnId, _ := cmd.GetPropertyString(tracing.PropertyTurnId)
+		traceparent, _ := cmd.GetPropertyString(tracing.PropertyTraceparent)
+		if turnId != "" {
+			_, span := tracer.Start(tracing.ContextWithTraceparent(traceparent), "tts.flush", trace.WithAttributes(attribute.String(tracing.AttributeTurnId, turnId)))
+			span.End()
+			slog.Info(fmt.Sprintf("OnCmd %s interrupts turn %s", cmdInFlush, turnId), logTag)
+		}
 
 		// send out
 		outCmd, err := ten.NewCmd(cmdOutFlush)
@@ -291,6 +340,10 @@ func (e *elevenlabsTTSExtension) OnCmd(
 			tenEnv.ReturnResult(cmdResult, cmd)
 			return
 		}
+		if turnId != "" {
+			outCmd.SetProperty(tracing.PropertyTurnId, turnId)
+			outCmd.SetProperty(tracing.PropertyTraceparent, traceparent)
+		}
 
 		if err := tenEnv.SendCmd(outCmd, nil); err != nil {
 			slog.Error(fmt.Sprintf("send cmd %s failed, err: %v", cmdOutFlush, err), logTag)
@@ -326,10 +379,14 @@ func (e *elevenlabsTTSExtension) OnData(
 		return
 	}
 
-	slog.Info(fmt.Sprintf("OnData input text: [%s]", text), logTag)
+	// the turn is optional, the text may not come from the llm
+	turnId, _ := data.GetPropertyString(tracing.PropertyTurnId)
+	traceparent, _ := data.GetPropertyString(tracing.PropertyTraceparent)
+
+	slog.Info(fmt.Sprintf("OnData input text: [%s], turnId: %s", text, turnId), logTag)
 
 	go func() {
-		textChan <- &message{text: text, receivedTs: time.Now().UnixMicro()}
+		textChan <- &message{text: text, receivedTs: time.Now().UnixMicro(), turnId: turnId, traceparent: traceparent}
 	}()
 }
 
@@ -16,13 +16,22 @@ from typing import List, Any
 from .log import logger
 import json
 from datetime import datetime
-import uuid, math
+import uuid, math, os
 import queue, threading
+import urllib.request
 
 CMD_FILE_CHUNK = "file_chunk"
 UPSERT_VECTOR_CMD = "upsert_vector"
 FILE_CHUNKED_CMD = "file_chunked"
 
+# states of the ingestion job reported to the server
+JOB_STATE_CHUNKING = "chunking"
+JOB_STATE_EMBEDDING = "embedding"
+JOB_STATE_READY = "ready"
+JOB_STATE_FAILED = "failed"
+JOB_CALLBACK_HEADER_TOKEN = "X-Callback-Token"
+JOB_CALLBACK_TIMEOUT_SECONDS = 5
+
 # TODO: configable
 CHUNK_SIZE = 200
 CHUNK_OVERLAP = 20
@@ -46,6 +55,8 @@ class FileChunkerExtension(Extension):
 
         self.counters = {}
         self.expected = {}
+        self.remove_on_chunked = set()  # paths removed once chunked
+        self.jobs = {}  # ingestion job callbacks by path
         self.new_collection_name = ""
         self.file_chunked_event = threading.Event()
 
@@ -53,6 +64,10 @@ class FileChunkerExtension(Extension):
         self.queue = queue.Queue()
         self.stop = False
 
+        # the reports are sent by their own thread, not to block the callbacks
+        self.report_thread = None
+        self.report_queue = queue.Queue()
+
     def generate_collection_name(self) -> str:
         """
         follow rules: ^[a-z]+[a-z0-9_]*
@@ -106,12 +121,14 @@ class FileChunkerExtension(Extension):
         cmd_out.set_property_from_json("inputs", json.dumps(texts))
         ten.send_cmd(
             cmd_out,
-            lambda ten, result: self.vector_store(
-                ten, path, texts, result
-            ),  # TODO: deal with error
+            lambda ten, result: self.vector_store(ten, path, texts, result),
         )
 
     def vector_store(self, ten: TenEnv, path: str, texts: List[str], result: CmdResult):
+        if result.get_status_code() != StatusCode.OK:
+            self.chunk_failed(path, "embedding failed")
+            return
+
         logger.info("vector store start for one splitting of the file {}".format(path))
         file_name = path.split("/")[-1]
         embed_output_json = result.get_property_string("embeddings")
@@ -125,9 +142,13 @@ class FileChunkerExtension(Extension):
             content.append({"text": text, "embedding": embedding})
         cmd_out.set_property_string("content", json.dumps(content))
         # logger.info(json.dumps(content))
-        ten.send_cmd(cmd_out, lambda ten, result: self.file_chunked(ten, path))
+        ten.send_cmd(cmd_out, lambda ten, result: self.file_chunked(ten, path, result))
+
+    def file_chunked(self, ten: TenEnv, path: str, result: CmdResult):
+        if result.get_status_code() != StatusCode.OK:
+            self.chunk_failed(path, "upsert vector failed")
+            return
 
-    def file_chunked(self, ten: TenEnv, path: str):
         if path in self.counters and path in self.expected:
             self.counters[path] += 1
             logger.info(
@@ -151,12 +172,76 @@ class FileChunkerExtension(Extension):
                 cmd_out.set_property_string("collection", self.new_collection_name)
                 ten.send_cmd(
                     cmd_out,
-                    lambda ten, result: logger.info("send_cmd done"),
+                    lambda ten, result: self.file_chunked_done(path),
                 )
+                self.report_job(path, JOB_STATE_READY)
                 self.file_chunked_event.set()
         else:
             logger.error("missing counter for the file path: %s", path)
 
+    def chunk_failed(self, path: str, error: str):
+        # the other batches of the file in flight are ignored
+        if self.counters.pop(path, None) is None:
+            return
+        self.expected.pop(path, None)
+
+        logger.error("failed to chunk the file: {}, {}".format(path, error))
+        self.report_job(path, JOB_STATE_FAILED, error=error)
+        self.file_chunked_event.set()
+
+    def report_job(self, path: str, state: str, error: str = "", chunks: int = 0):
+        # nothing is reported once the job is finished
+        if state in (JOB_STATE_READY, JOB_STATE_FAILED):
+            job = self.jobs.pop(path, None)
+        else:
+            job = self.jobs.get(path)
+        if job is None:
+            return
+
+        callback_url, callback_token = job
+        body = json.dumps({"state": state, "error": error, "chunks": chunks})
+        self.report_queue.put((path, state, callback_url, callback_token, body))
+
+    def report_handler(self) -> None:
+        # the reports are sent in order, the pending ones before stopping
+        while True:
+            value = self.report_queue.get()
+            if value is None:
+                break
+            path, state, callback_url, callback_token, body = value
+
+            req = urllib.request.Request(
+                callback_url,
+                data=body.encode("utf-8"),
+                headers={
+                    "Content-Type": "application/json",
+                    JOB_CALLBACK_HEADER_TOKEN: callback_token,
+                },
+                method="POST",
+            )
+            try:
+                with urllib.request.urlopen(req, timeout=JOB_CALLBACK_TIMEOUT_SECONDS):
+                    pass
+                logger.info("job of the file {} reported {}".format(path, state))
+            except Exception as e:
+                logger.warning("failed to report job of the file {}, {}".format(path, e))
+
+    def file_chunked_done(self, path: str):
+        logger.info("send_cmd done")
+
+        # the uploaded file is no longer needed once it is in the vector store
+        self.remove_file(path)
+
+    def remove_file(self, path: str):
+        # removes the file if the server asked for it, once done with, chunked or failed
+        if path in self.remove_on_chunked:
+            self.remove_on_chunked.discard(path)
+            try:
+                os.remove(path)
+                logger.info("file {} removed".format(path))
+            except OSError as e:
+                logger.warning("failed to remove file {}, {}".format(path, e))
+
     def on_cmd(self, ten: TenEnv, cmd: Cmd) -> None:
         cmd_name = cmd.get_name()
         if cmd_name == CMD_FILE_CHUNK:
@@ -168,6 +253,20 @@ class FileChunkerExtension(Extension):
             except Exception as e:
                 logger.warning("missing collection property in cmd {}".format(cmd_name))
 
+            try:
+                if cmd.get_property_bool("remove_on_chunked"):
+                    self.remove_on_chunked.add(path)
+            except Exception:
+                pass  # kept unless the server asks for the removal
+
+            try:
+                callback_url = cmd.get_property_string("callback_url")
+                callback_token = cmd.get_property_string("callback_token")
+                if callback_url:
+                    self.jobs[path] = (callback_url, callback_token)
+            except Exception:
+                pass  # no job to report, e.g. not uploaded through the server
+
             self.queue.put((path, collection))  # make sure files are processed in order
         else:
             logger.info("unknown cmd {}".format(cmd_name))
@@ -195,7 +294,19 @@ class FileChunkerExtension(Extension):
             logger.info("collection {} created".format(collection))
 
             # split
-            nodes = self.split(path)
+            self.report_job(path, JOB_STATE_CHUNKING)
+            try:
+                nodes = self.split(path)
+            except Exception as e:
+                logger.error("failed to split the file: {}, {}".format(path, e))
+                self.report_job(path, JOB_STATE_FAILED, error="split failed")
+                self.remove_file(path)
+                continue
+            if not nodes:
+                logger.error("no text in the file: {}".format(path))
+                self.report_job(path, JOB_STATE_FAILED, error="no text in the file")
+                self.remove_file(path)
+                continue
 
             # reset counters and events
             self.new_collection_name = collection
@@ -204,6 +315,7 @@ class FileChunkerExtension(Extension):
             self.file_chunked_event.clear()
 
             # trigger embedding and vector storing in parallel
+            self.report_job(path, JOB_STATE_EMBEDDING, chunks=len(nodes))
             for texts in list(batch(nodes, BATCH_SIZE)):
                 self.embedding(ten, path, texts)
 
@@ -224,6 +336,8 @@ class FileChunkerExtension(Extension):
         self.stop = False
         self.thread = threading.Thread(target=self.async_handler, args=[ten])
         self.thread.start()
+        self.report_thread = threading.Thread(target=self.report_handler)
+        self.report_thread.start()
 
         ten.on_start_done()
 
@@ -237,5 +351,9 @@ class FileChunkerExtension(Extension):
             self.queue.put(None)
             self.thread.join()
             self.thread = None
+        if self.report_thread is not None:
+            self.report_queue.put(None)
+            self.report_thread.join()
+            self.report_thread = None
 
         ten.on_stop_done()
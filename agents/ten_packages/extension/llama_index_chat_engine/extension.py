@@ -19,6 +19,7 @@ from datetime import datetime
 
 PROPERTY_CHAT_MEMORY_TOKEN_LIMIT = "chat_memory_token_limit"
 PROPERTY_GREETING = "greeting"
+PROPERTY_COLLECTION = "collection"
 
 TASK_TYPE_CHAT_REQUEST = "chat_request"
 TASK_TYPE_GREETING = "greeting"
@@ -70,6 +71,13 @@ class LlamaIndexExtension(Extension):
                 f"get {PROPERTY_CHAT_MEMORY_TOKEN_LIMIT} property failed, err: {err}"
             )
 
+        # collection of the catalog attached on start, queried until a document is uploaded
+        try:
+            self.collection_name = ten.get_property_string(PROPERTY_COLLECTION)
+            logger.info("collection for querying {}".format(self.collection_name))
+        except Exception as err:
+            logger.info(f"get {PROPERTY_COLLECTION} property failed, err: {err}")
+
         self.thread = threading.Thread(target=self.async_handle, args=[ten])
         self.thread.start()
 
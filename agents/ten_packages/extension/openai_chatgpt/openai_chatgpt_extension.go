@@ -19,13 +19,19 @@ import (
 	"sync/atomic"
 	"time"
 
+	"agent_pkg/metrics"
+	"agent_pkg/tracing"
+	"agent_pkg/transcript"
 	"ten_framework/ten"
 
 	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
 	logTag = slog.String("extension", "OPENAI_CHATGPT_EXTENSION")
+	tracer = tracing.Tracer("openai_chatgpt")
 )
 
 type openaiChatGPTExtension struct {
@@ -53,6 +59,8 @@ const (
 	propertyGreeting         = "greeting"          // Optional
 	propertyProxyUrl         = "proxy_url"         // Optional
 	propertyMaxMemoryLength  = "max_memory_length" // Optional
+
+	metricsExtension = "openai_chatgpt"
 )
 
 var (
@@ -62,6 +70,8 @@ var (
 
 	outdateTs atomic.Int64
 	wg        sync.WaitGroup
+
+	currentTurn atomic.Pointer[tracing.Turn] // the last turn, interrupted by flush
 )
 
 func newChatGPTExtension(name string) ten.Extension {
@@ -191,12 +201,23 @@ func (p *openaiChatGPTExtension) OnStart(tenEnv ten.TenEnv) {
 			slog.Error(fmt.Sprintf("greeting [%s] send failed, err: %v", greeting, err), logTag)
 		} else {
 			slog.Info(fmt.Sprintf("greeting [%s] sent", greeting), logTag)
+			nowTs := time.Now().UnixMilli()
+			transcript.Append(&transcript.Record{Role: transcript.RoleAssistant, Text: greeting, StartTs: nowTs, EndTs: nowTs})
 		}
 	}
 
 	tenEnv.OnStartDone()
 }
 
+// OnStop exports the spans of the extension before the worker exits.
+func (p *openaiChatGPTExtension) OnStop(tenEnv ten.TenEnv) {
+	slog.Info("OnStop", logTag)
+
+	tracing.Flush()
+
+	tenEnv.OnStopDone()
+}
+
 // OnCmd receives cmd from ten graph.
 // current supported cmd:
 //   - name: flush
@@ -218,6 +239,7 @@ func (p *openaiChatGPTExtension) OnCmd(
 	switch cmdName {
 	case cmdInFlush:
 		outdateTs.Store(time.Now().UnixMicro())
+		metrics.Inc(metrics.Flushes, metricsExtension)
 
 		wg.Wait() // wait for chat completion stream to finish
 
@@ -229,6 +251,10 @@ func (p *openaiChatGPTExtension) OnCmd(
 			tenEnv.ReturnResult(cmdResult, cmd)
 			return
 		}
+		if turn := currentTurn.Load(); turn != nil {
+			setTurnProperties(outCmd, turn)
+			slog.Info(fmt.Sprintf("cmd %s interrupts turn %s", cmdOutFlush, turn.Id), logTag)
+		}
 		if err := tenEnv.SendCmd(outCmd, nil); err != nil {
 			slog.Error(fmt.Sprintf("send cmd %s failed, err: %v", cmdOutFlush, err), logTag)
 			cmdResult, _ := ten.NewCmdResult(ten.StatusCodeError)
@@ -272,7 +298,14 @@ func (p *openaiChatGPTExtension) OnData(
 		slog.Debug("ignore empty text", logTag)
 		return
 	}
-	slog.Info(fmt.Sprintf("OnData input text: [%s]", inputText), logTag)
+
+	// start the turn, its trace continues in the following extensions by the properties of the data and cmds sent for it
+	ctx, turnSpan, turn := tracing.StartTurn(tracer, "turn", attribute.String(tracing.AttributeExtension, metricsExtension))
+	currentTurn.Store(turn)
+	slog.Info(fmt.Sprintf("OnData input text: [%s], turnId: %s", inputText, turn.Id), logTag)
+
+	nowTs := time.Now().UnixMilli()
+	transcript.Append(&transcript.Record{TurnId: turn.Id, Role: transcript.RoleUser, Text: inputText, StartTs: nowTs, EndTs: nowTs})
 
 	// prepare memory
 	for len(memoryChan) > 0 {
@@ -297,12 +330,17 @@ func (p *openaiChatGPTExtension) OnData(
 	wg.Add(1)
 	go func(startTime time.Time, inputText string, memory []openai.ChatCompletionMessage) {
 		defer wg.Done()
-		slog.Info(fmt.Sprintf("GetChatCompletionsStream for input text: [%s] memory: %v", inputText, memory), logTag)
+		defer turnSpan.End()
+		slog.Info(fmt.Sprintf("GetChatCompletionsStream for input text: [%s] turnId: %s memory: %v", inputText, turn.Id, memory), logTag)
+
+		_, streamSpan := tracer.Start(ctx, "llm.stream", trace.WithTimestamp(startTime))
+		defer streamSpan.End()
 
 		// Get result from ai
 		resp, err := p.openaiChatGPT.getChatCompletionsStream(memory)
 		if err != nil {
 			slog.Error(fmt.Sprintf("GetChatCompletionsStream for input text: [%s] failed, err: %v", inputText, err), logTag)
+			streamSpan.RecordError(err)
 			return
 		}
 		defer func() {
@@ -314,10 +352,15 @@ func (p *openaiChatGPTExtension) OnData(
 
 		var sentence, fullContent string
 		var firstSentenceSent bool
+		var tokens, sentences int
+		var interrupted bool
+		var firstTokenLatency, firstSentenceLatency time.Duration
 		for {
 			if startTime.UnixMicro() < outdateTs.Load() { // Check whether to interrupt
 				slog.Info(fmt.Sprintf("GetChatCompletionsStream recv interrupt and flushing for input text: [%s], startTs: %d, outdateTs: %d",
 					inputText, startTime.UnixMicro(), outdateTs.Load()), logTag)
+				metrics.Inc(metrics.InterruptedStreams, metricsExtension)
+				interrupted = true
 				break
 			}
 
@@ -330,6 +373,12 @@ func (p *openaiChatGPTExtension) OnData(
 			var content string
 			if len(chatCompletions.Choices) > 0 && chatCompletions.Choices[0].Delta.Content != "" {
 				content = chatCompletions.Choices[0].Delta.Content
+				if tokens == 0 {
+					firstTokenLatency = time.Since(startTime)
+					metrics.ObserveDuration(metrics.LLMTimeToFirstToken, metricsExtension, firstTokenLatency)
+					streamSpan.AddEvent("first_token")
+				}
+				tokens++
 			}
 			fullContent += content
 
@@ -351,6 +400,7 @@ func (p *openaiChatGPTExtension) OnData(
 				}
 				outputData.SetProperty(dataOutTextDataPropertyText, sentence)
 				outputData.SetProperty(dataOutTextDataPropertyTextEndOfSegment, false)
+				setTurnProperties(outputData, turn)
 				if err := tenEnv.SendData(outputData); err != nil {
 					slog.Error(fmt.Sprintf("GetChatCompletionsStream recv for input text: [%s] send sentence [%s] failed, err: %v", inputText, sentence, err), logTag)
 					break
@@ -358,15 +408,38 @@ func (p *openaiChatGPTExtension) OnData(
 					slog.Info(fmt.Sprintf("GetChatCompletionsStream recv for input text: [%s] sent sentence [%s]", inputText, sentence), logTag)
 				}
 				sentence = ""
+				sentences++
 
 				if !firstSentenceSent {
 					firstSentenceSent = true
+					firstSentenceLatency = time.Since(startTime)
+					streamSpan.AddEvent("first_sentence")
+					metrics.ObserveDuration(metrics.LLMTimeToFirstSentence, metricsExtension, firstSentenceLatency)
 					slog.Info(fmt.Sprintf("GetChatCompletionsStream recv for input text: [%s] first sentence sent, first_sentency_latency %dms",
 						inputText, time.Since(startTime).Milliseconds()), logTag)
 				}
 			}
 		}
 
+		metrics.Observe(metrics.LLMResponseTokens, metricsExtension, float64(tokens))
+		streamSpan.SetAttributes(
+			attribute.Int("llm.tokens", tokens),
+			attribute.Int("llm.sentences", sentences),
+			attribute.Bool(tracing.AttributeInterrupted, interrupted),
+		)
+
+		transcript.Append(&transcript.Record{
+			TurnId:                 turn.Id,
+			Role:                   transcript.RoleAssistant,
+			Text:                   fullContent,
+			StartTs:                startTime.UnixMilli(),
+			EndTs:                  time.Now().UnixMilli(),
+			Interrupted:            interrupted,
+			FirstTokenLatencyMs:    firstTokenLatency.Milliseconds(),
+			FirstSentenceLatencyMs: firstSentenceLatency.Milliseconds(),
+			Tokens:                 tokens,
+		})
+
 		// remember response as assistant content in memory
 		memoryChan <- openai.ChatCompletionMessage{
 			Role:    openai.ChatMessageRoleAssistant,
@@ -377,6 +450,7 @@ func (p *openaiChatGPTExtension) OnData(
 		outputData, _ := ten.NewData("text_data")
 		outputData.SetProperty(dataOutTextDataPropertyText, sentence)
 		outputData.SetProperty(dataOutTextDataPropertyTextEndOfSegment, true)
+		setTurnProperties(outputData, turn)
 		if err := tenEnv.SendData(outputData); err != nil {
 			slog.Error(fmt.Sprintf("GetChatCompletionsStream for input text: [%s] end of segment with sentence [%s] send failed, err: %v", inputText, sentence, err), logTag)
 		} else {
@@ -385,6 +459,17 @@ func (p *openaiChatGPTExtension) OnData(
 	}(time.Now(), inputText, append([]openai.ChatCompletionMessage{}, memory...))
 }
 
+// msg is the property setter of ten.Data and ten.Cmd.
+type msg interface {
+	SetProperty(path string, value any) error
+}
+
+// setTurnProperties stamps the turn on the data or cmd sent for it.
+func setTurnProperties(m msg, turn *tracing.Turn) {
+	m.SetProperty(tracing.PropertyTurnId, turn.Id)
+	m.SetProperty(tracing.PropertyTraceparent, turn.Traceparent)
+}
+
 func init() {
 	slog.Info("init")
 
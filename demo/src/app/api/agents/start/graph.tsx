@@ -103,7 +103,7 @@ export const getGraphProperties = (graphName: string, language: string, voiceTyp
                 "model": "gpt-4o-realtime-preview",
                 "voice": voiceNameMap[language]["openai"][voiceType],
                 "language": language,
-                ...localizationOptions
+                "greeting": localizationOptions["greeting"],
             }
         }
     } else if (graphName == "va.openai.azure") {
@@ -113,7 +113,7 @@ export const getGraphProperties = (graphName: string, language: string, voiceTyp
             },
             "openai_chatgpt": {
                 "model": "gpt-4o-mini",
-                ...localizationOptions
+                "greeting": localizationOptions["greeting"],
             },
             "azure_tts": {
                 "azure_synthesis_voice_name": voiceNameMap[language]["azure"][voiceType]
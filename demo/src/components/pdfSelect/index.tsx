@@ -37,7 +37,7 @@ const PdfSelect = () => {
     }].concat(res.data.map((item: any) => {
       return {
         value: item.collection,
-        label: item.file_name
+        label: item.name
       }
     })))
     setSelectedPdf('')
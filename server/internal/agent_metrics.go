@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gogf/gf/crypto/gmd5"
+)
+
+// AgentMetrics is the snapshot of the pipeline metrics recorded by the
+// extensions of a worker, served on the metrics socket of the worker.
+type AgentMetrics struct {
+	Pid     int            `json:"pid"`
+	StartTs int64          `json:"start_ts"`
+	Ts      int64          `json:"ts"`
+	Metrics []*AgentMetric `json:"metrics"`
+}
+
+// AgentMetric is a metric of an extension, a counter or a summary.
+type AgentMetric struct {
+	Name      string  `json:"name"`
+	Extension string  `json:"extension"`
+	Kind      string  `json:"kind"`
+	Help      string  `json:"help"`
+	Value     float64 `json:"value,omitempty"`
+	Count     uint64  `json:"count,omitempty"`
+	Sum       float64 `json:"sum,omitempty"`
+	Min       float64 `json:"min,omitempty"`
+	Max       float64 `json:"max,omitempty"`
+	Last      float64 `json:"last,omitempty"`
+}
+
+const (
+	// Environment telling the worker where to serve its metrics
+	agentMetricsSocketEnv = "AGENT_METRICS_SOCKET"
+	// Directory of the metrics sockets, short as the path of a unix socket is
+	// limited to 108 bytes, which a long LOG_PATH would exceed
+	agentMetricsSocketDir = "/tmp/astra"
+	// Environment telling the worker where to write its traces when OTLP is not configured
+	agentTracesFileEnv = "AGENT_TRACES_FILE"
+
+	agentMetricsTimeout = 1 * time.Second
+	// Prefix of the agent metrics exported by /metrics
+	agentMetricsPrefix = "astra_agent_"
+)
+
+// agentMetricsSocket returns a new metrics socket of the worker of the channel.
+func agentMetricsSocket(channelName string) string {
+	return fmt.Sprintf("%s/metrics-%s-%d.sock", agentMetricsSocketDir, gmd5.MustEncryptString(channelName), time.Now().UnixNano())
+}
+
+// fetchAgentMetrics reads the metrics of the worker from its metrics socket.
+func (w *Worker) fetchAgentMetrics() (*AgentMetrics, error) {
+	if w.MetricsSocket == "" {
+		return nil, fmt.Errorf("worker has no metrics socket")
+	}
+
+	client := &http.Client{
+		Timeout: agentMetricsTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", w.MetricsSocket)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	res, err := client.Get("http://worker/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s, status: %d", codeErrHttpStatusNotOk.msg, res.StatusCode)
+	}
+
+	var metrics AgentMetrics
+	if err := json.NewDecoder(res.Body).Decode(&metrics); err != nil {
+		return nil, err
+	}
+	return &metrics, nil
+}
+
+// fetchAllAgentMetrics reads the metrics of all the workers in parallel, the
+// workers failing to answer are skipped.
+func fetchAllAgentMetrics(list []*Worker) map[*Worker]*AgentMetrics {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	all := make(map[*Worker]*AgentMetrics)
+
+	for _, worker := range list {
+		wg.Add(1)
+		go func(worker *Worker) {
+			defer wg.Done()
+
+			metrics, err := worker.fetchAgentMetrics()
+			if err != nil {
+				slog.Debug("Worker fetch agent metrics failed", "err", err, "channelName", worker.ChannelName, logTag)
+				return
+			}
+
+			lock.Lock()
+			all[worker] = metrics
+			lock.Unlock()
+		}(worker)
+	}
+	wg.Wait()
+
+	return all
+}
+
+// writeAgentMetrics writes the metrics of the workers in the Prometheus text
+// format, by channel, graph and extension.
+func writeAgentMetrics(c *gin.Context, list []*Worker) {
+	families := make(map[string]*metricVec)
+	var names []string
+
+	for worker, metrics := range fetchAllAgentMetrics(list) {
+		for _, m := range metrics.Metrics {
+			name := agentMetricsPrefix + m.Name
+			family, ok := families[name]
+			if !ok {
+				family = newMetricVec(name, m.Help, m.Kind, "channel", "graph", "extension")
+				families[name] = family
+				names = append(names, name)
+			}
+
+			if m.Kind == metricKindSummary {
+				family.setSummary(m.Sum, m.Count, worker.ChannelName, worker.GraphName, m.Extension)
+			} else {
+				family.set(m.Value, worker.ChannelName, worker.GraphName, m.Extension)
+			}
+		}
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		families[name].write(c.Writer)
+	}
+}
+
+func (s *HttpServer) handlerWorkerMetrics(c *gin.Context) {
+	channelName := c.Param("channel")
+
+	worker := tenantWorker(c, channelName)
+	if worker == nil {
+		slog.Error("handlerWorkerMetrics channel not existed", "channelName", channelName, logTag)
+		s.output(c, codeErrChannelNotExisted, nil, http.StatusBadRequest)
+		return
+	}
+
+	metrics, err := worker.fetchAgentMetrics()
+	if err != nil {
+		slog.Error("handlerWorkerMetrics fetch failed", "err", err, "channelName", channelName, logTag)
+		s.output(c, codeErrReadAgentMetricsFailed, nil, http.StatusServiceUnavailable)
+		return
+	}
+
+	s.output(c, codeSuccess, metrics)
+}
@@ -0,0 +1,317 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Authenticator authenticates the requests to the server, and signs the
+// requests the server sends to other servers of the cluster.
+type Authenticator interface {
+	// Authenticate returns the key the request is made with.
+	Authenticate(r *http.Request) (*AuthKey, error)
+	// Sign sets the credentials of the key on an outgoing request.
+	Sign(header http.Header, method string, uri string, body []byte, keyId string) error
+}
+
+// AuthKey is an api key of a tenant. An admin key is not scoped to the
+// channels of its tenant, and is allowed to manage the cluster.
+type AuthKey struct {
+	Id     string `json:"-"`
+	Tenant string `json:"tenant"`
+	Secret string `json:"secret,omitempty"` // hmac only
+	Admin  bool   `json:"admin,omitempty"`
+}
+
+// apiKeyAuth authenticates the requests by their static api key.
+type apiKeyAuth struct {
+	keys map[string]*AuthKey
+}
+
+// hmacAuth authenticates the requests by their signature, made with the
+// secret of their api key over the method, uri, timestamp, nonce and body.
+type hmacAuth struct {
+	keys map[string]*AuthKey
+	seen *signatureCache
+}
+
+// signatureCache keeps the signatures of the authenticated requests until
+// their timestamp expires, so that a request can't be replayed.
+type signatureCache struct {
+	lock       sync.Mutex
+	expireTs   map[string]int64 // by hex signature
+	maxEntries int
+}
+
+const (
+	// Auth modes
+	AuthModeNone   = "none"
+	AuthModeApiKey = "api_key"
+	AuthModeHmac   = "hmac"
+
+	authHeaderApiKey    = "X-Api-Key"
+	authHeaderTimestamp = "X-Timestamp"
+	authHeaderSignature = "X-Signature"
+	authHeaderNonce     = "X-Nonce"
+
+	// Max difference between the timestamp of a signed request and the server clock
+	authHmacSkewSeconds = 300
+	// Max length of the nonce of a signed request
+	authHmacNonceMaxLength = 64
+	// Max signatures kept against replays, requests are refused beyond it
+	authHmacSeenMax = 100000
+
+	authKeyContextKey = "auth_key"
+)
+
+var (
+	errAuthKeyMissing       = errors.New("api key missing")
+	errAuthKeyInvalid       = errors.New("api key invalid")
+	errAuthTimestampInvalid = errors.New("timestamp invalid or expired")
+	errAuthSignatureInvalid = errors.New("signature invalid")
+	errAuthNonceInvalid     = errors.New("nonce invalid")
+	errAuthReplayed         = errors.New("request replayed")
+	errAuthSeenFull         = errors.New("too many signed requests")
+)
+
+// NewAuthenticator creates the authenticator of the mode with the keys by id,
+// nil means no auth.
+func NewAuthenticator(mode string, keys map[string]*AuthKey) (Authenticator, error) {
+	for id, key := range keys {
+		key.Id = id
+	}
+
+	switch mode {
+	case "", AuthModeNone:
+		return nil, nil
+	case AuthModeApiKey:
+		return &apiKeyAuth{keys: keys}, nil
+	case AuthModeHmac:
+		for id, key := range keys {
+			if key.Secret == "" {
+				return nil, fmt.Errorf("secret of key %s missing", id)
+			}
+		}
+		return &hmacAuth{keys: keys, seen: newSignatureCache(authHmacSeenMax)}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth mode %s", mode)
+	}
+}
+
+func (a *apiKeyAuth) Authenticate(r *http.Request) (*AuthKey, error) {
+	keyId := r.Header.Get(authHeaderApiKey)
+	if keyId == "" {
+		keyId = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if keyId == "" {
+		return nil, errAuthKeyMissing
+	}
+
+	// Compare every key in constant time, so that keys can't be guessed by timing
+	var found *AuthKey
+	for id, key := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(id), []byte(keyId)) == 1 {
+			found = key
+		}
+	}
+	if found == nil {
+		return nil, errAuthKeyInvalid
+	}
+
+	return found, nil
+}
+
+func (a *apiKeyAuth) Sign(header http.Header, method string, uri string, body []byte, keyId string) error {
+	if _, ok := a.keys[keyId]; !ok {
+		return errAuthKeyInvalid
+	}
+
+	header.Set(authHeaderApiKey, keyId)
+	return nil
+}
+
+func (a *hmacAuth) Authenticate(r *http.Request) (*AuthKey, error) {
+	keyId := r.Header.Get(authHeaderApiKey)
+	if keyId == "" {
+		return nil, errAuthKeyMissing
+	}
+
+	key, ok := a.keys[keyId]
+	if !ok {
+		return nil, errAuthKeyInvalid
+	}
+
+	timestamp := r.Header.Get(authHeaderTimestamp)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || abs(time.Now().Unix()-ts) > authHmacSkewSeconds {
+		return nil, errAuthTimestampInvalid
+	}
+
+	nonce := r.Header.Get(authHeaderNonce)
+	if nonce == "" || len(nonce) > authHmacNonceMaxLength {
+		return nil, errAuthNonceInvalid
+	}
+
+	// The body is read for the signature, and put back for the handlers. It's
+	// limited by bodyLimitMiddleware, so that it can't exhaust the memory
+	var body []byte
+	if r.Body != nil {
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get(authHeaderSignature))
+	if err != nil || !hmac.Equal(signature, hmacSignature(key.Secret, r.Method, r.URL.RequestURI(), timestamp, nonce, body)) {
+		return nil, errAuthSignatureInvalid
+	}
+
+	// The signature is only kept once verified, so that unsigned requests can't fill the cache
+	if err = a.seen.add(hex.EncodeToString(signature), ts+authHmacSkewSeconds); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (a *hmacAuth) Sign(header http.Header, method string, uri string, body []byte, keyId string) error {
+	key, ok := a.keys[keyId]
+	if !ok {
+		return errAuthKeyInvalid
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := uuid.NewString()
+	header.Set(authHeaderApiKey, keyId)
+	header.Set(authHeaderTimestamp, timestamp)
+	header.Set(authHeaderNonce, nonce)
+	header.Set(authHeaderSignature, hex.EncodeToString(hmacSignature(key.Secret, method, uri, timestamp, nonce, body)))
+	return nil
+}
+
+// hmacSignature signs "<method>\n<uri>\n<timestamp>\n<nonce>\n<hex sha256 of body>" with HMAC-SHA256.
+func hmacSignature(secret string, method string, uri string, timestamp string, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{method, uri, timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n")))
+	return mac.Sum(nil)
+}
+
+func newSignatureCache(maxEntries int) *signatureCache {
+	return &signatureCache{
+		expireTs:   make(map[string]int64),
+		maxEntries: maxEntries,
+	}
+}
+
+// add keeps the signature until expireTs, it fails if the signature is
+// already kept. The expired signatures are pruned when the cache is full,
+// and the signature is refused if it's still full, rather than evicting a
+// signature which could then be replayed.
+func (c *signatureCache) add(signature string, expireTs int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now().Unix()
+	if ts, ok := c.expireTs[signature]; ok && ts >= now {
+		return errAuthReplayed
+	}
+
+	if len(c.expireTs) >= c.maxEntries {
+		for k, ts := range c.expireTs {
+			if ts < now {
+				delete(c.expireTs, k)
+			}
+		}
+		if len(c.expireTs) >= c.maxEntries {
+			return errAuthSeenFull
+		}
+	}
+
+	c.expireTs[signature] = expireTs
+	return nil
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// authMiddleware rejects the requests which are not authenticated, except the
+// health checks and the callbacks of the workers. The key of the request is
+// kept in the context.
+func (s *HttpServer) authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.config.Authenticator == nil || c.Request.URL.Path == "/" || c.Request.URL.Path == "/health" || c.FullPath() == ingestionJobCallbackPath {
+			c.Next()
+			return
+		}
+
+		key, err := s.config.Authenticator.Authenticate(c.Request)
+		if s.outputBodyTooLarge(c, err) {
+			c.Abort()
+			return
+		}
+		if err != nil {
+			s.output(c, codeErrUnauthorized, map[string]any{"reason": err.Error()}, http.StatusUnauthorized)
+			c.Abort()
+			return
+		}
+
+		c.Set(authKeyContextKey, key)
+		c.Next()
+	}
+}
+
+// adminMiddleware rejects the requests made with a key which is not admin.
+func (s *HttpServer) adminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key := requestKey(c); key != nil && !key.Admin {
+			s.output(c, codeErrForbidden, nil, http.StatusForbidden)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// requestKey returns the key of the request, nil if auth is disabled.
+func requestKey(c *gin.Context) *AuthKey {
+	if v, ok := c.Get(authKeyContextKey); ok {
+		return v.(*AuthKey)
+	}
+	return nil
+}
+
+// requestTenant returns the tenant of the request, empty if auth is disabled.
+func requestTenant(c *gin.Context) string {
+	if key := requestKey(c); key != nil {
+		return key.Tenant
+	}
+	return ""
+}
+
+// canAccess checks whether the request is allowed to touch the channels of the tenant.
+func canAccess(c *gin.Context, tenant string) bool {
+	key := requestKey(c)
+	return key == nil || key.Admin || key.Tenant == tenant
+}
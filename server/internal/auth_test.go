@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHmacAuthenticate(t *testing.T) {
+	auth, err := NewAuthenticator(AuthModeHmac, map[string]*AuthKey{
+		"key1": {Tenant: "acme", Secret: "secret1"},
+		"key2": {Tenant: "other", Secret: "secret2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"channel_name":"test"}`)
+	tests := []struct {
+		name   string
+		modify func(r *http.Request)
+		err    error
+	}{
+		{"signed", func(r *http.Request) {}, nil},
+		{"key missing", func(r *http.Request) { r.Header.Del(authHeaderApiKey) }, errAuthKeyMissing},
+		{"key unknown", func(r *http.Request) { r.Header.Set(authHeaderApiKey, "key3") }, errAuthKeyInvalid},
+		{"signed by another key", func(r *http.Request) { r.Header.Set(authHeaderApiKey, "key2") }, errAuthSignatureInvalid},
+		{"body changed", func(r *http.Request) { r.Body = http.NoBody }, errAuthSignatureInvalid},
+		{"uri changed", func(r *http.Request) { r.URL.RawQuery = "channel_name=other" }, errAuthSignatureInvalid},
+		{"signature not hex", func(r *http.Request) { r.Header.Set(authHeaderSignature, "xyz") }, errAuthSignatureInvalid},
+		{"nonce changed", func(r *http.Request) { r.Header.Set(authHeaderNonce, "other") }, errAuthSignatureInvalid},
+		{"nonce missing", func(r *http.Request) { r.Header.Del(authHeaderNonce) }, errAuthNonceInvalid},
+		{"timestamp missing", func(r *http.Request) { r.Header.Del(authHeaderTimestamp) }, errAuthTimestampInvalid},
+		{"timestamp expired", func(r *http.Request) {
+			r.Header.Set(authHeaderTimestamp, strconv.FormatInt(time.Now().Unix()-authHmacSkewSeconds-1, 10))
+		}, errAuthTimestampInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/ping", bytes.NewReader(body))
+			if err := auth.Sign(r.Header, r.Method, r.URL.RequestURI(), body, "key1"); err != nil {
+				t.Fatal(err)
+			}
+			tt.modify(r)
+
+			key, err := auth.Authenticate(r)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err == nil && key.Tenant != "acme" {
+				t.Fatalf("tenant = %s, want acme", key.Tenant)
+			}
+		})
+	}
+}
+
+func TestHmacAuthenticateReplayed(t *testing.T) {
+	auth, _ := NewAuthenticator(AuthModeHmac, map[string]*AuthKey{"key1": {Secret: "secret1"}})
+
+	body := []byte(`{"channel_name":"test"}`)
+	header := http.Header{}
+	auth.Sign(header, http.MethodPost, "/ping", body, "key1")
+
+	for i, want := range []error{nil, errAuthReplayed} {
+		r := httptest.NewRequest(http.MethodPost, "/ping", bytes.NewReader(body))
+		r.Header = header.Clone()
+		if _, err := auth.Authenticate(r); !errors.Is(err, want) {
+			t.Fatalf("request %d: err = %v, want %v", i, err, want)
+		}
+	}
+
+	// The same request signed again has another nonce
+	r := httptest.NewRequest(http.MethodPost, "/ping", bytes.NewReader(body))
+	auth.Sign(r.Header, r.Method, r.URL.RequestURI(), body, "key1")
+	if _, err := auth.Authenticate(r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignatureCacheAdd(t *testing.T) {
+	now := time.Now().Unix()
+	c := newSignatureCache(2)
+
+	tests := []struct {
+		signature string
+		expireTs  int64
+		err       error
+	}{
+		{"a", now - 1, nil},
+		{"a", now + 60, nil}, // expired, kept again
+		{"a", now + 60, errAuthReplayed},
+		{"b", now - 1, nil},
+		{"c", now + 60, nil}, // full, b pruned as expired
+		{"d", now + 60, errAuthSeenFull},
+	}
+	for _, tt := range tests {
+		if err := c.add(tt.signature, tt.expireTs); !errors.Is(err, tt.err) {
+			t.Fatalf("add(%s, %d) err = %v, want %v", tt.signature, tt.expireTs-now, err, tt.err)
+		}
+	}
+}
+
+func TestHmacAuthenticateBodyKept(t *testing.T) {
+	auth, _ := NewAuthenticator(AuthModeHmac, map[string]*AuthKey{"key1": {Secret: "secret1"}})
+
+	body := []byte(`{"channel_name":"test"}`)
+	r := httptest.NewRequest(http.MethodPost, "/ping", bytes.NewReader(body))
+	auth.Sign(r.Header, r.Method, r.URL.RequestURI(), body, "key1")
+	if _, err := auth.Authenticate(r); err != nil {
+		t.Fatal(err)
+	}
+
+	var read bytes.Buffer
+	read.ReadFrom(r.Body)
+	if !bytes.Equal(read.Bytes(), body) {
+		t.Fatalf("body = %s, want %s", read.Bytes(), body)
+	}
+}
+
+func TestHmacAuthenticateBodyLimited(t *testing.T) {
+	auth, _ := NewAuthenticator(AuthModeHmac, map[string]*AuthKey{"key1": {Secret: "secret1"}})
+
+	body := bytes.Repeat([]byte("a"), 1024)
+	r := httptest.NewRequest(http.MethodPost, "/ping", bytes.NewReader(body))
+	auth.Sign(r.Header, r.Method, r.URL.RequestURI(), body, "key1")
+	r.Body = http.MaxBytesReader(httptest.NewRecorder(), r.Body, 512)
+
+	var maxBytesErr *http.MaxBytesError
+	if _, err := auth.Authenticate(r); !errors.As(err, &maxBytesErr) {
+		t.Fatalf("err = %v, want a max bytes error", err)
+	}
+}
+
+func TestHmacSign(t *testing.T) {
+	auth, _ := NewAuthenticator(AuthModeHmac, map[string]*AuthKey{"key1": {Secret: "secret1"}})
+
+	header := http.Header{}
+	if err := auth.Sign(header, http.MethodPost, "/nodes/heartbeat", nil, "key3"); !errors.Is(err, errAuthKeyInvalid) {
+		t.Fatalf("err = %v, want %v", err, errAuthKeyInvalid)
+	}
+	if err := auth.Sign(header, http.MethodPost, "/nodes/heartbeat", nil, "key1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{authHeaderApiKey, authHeaderTimestamp, authHeaderNonce, authHeaderSignature} {
+		if header.Get(name) == "" {
+			t.Fatalf("header %s missing", name)
+		}
+	}
+}
+
+func TestNewAuthenticatorHmacSecretMissing(t *testing.T) {
+	if _, err := NewAuthenticator(AuthModeHmac, map[string]*AuthKey{"key1": {Tenant: "acme"}}); err == nil {
+		t.Fatal("err = nil, want secret missing")
+	}
+}
@@ -0,0 +1,293 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CatalogCollection is a vector collection of the catalog, with the document
+// ingested into it.
+type CatalogCollection struct {
+	Collection string `json:"collection"`
+	Name       string `json:"name"` // the file name unless renamed
+	Tenant     string `json:"tenant,omitempty"`
+	FileName   string `json:"file_name"`
+	Sha256     string `json:"sha256"`
+	Chunks     int    `json:"chunks"`
+	CreateTs   int64  `json:"create_ts"`
+}
+
+// CollectionRenameReq renames a collection of the catalog.
+type CollectionRenameReq struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// collectionCatalog persists the collections to a json file. The file may be
+// shared by the servers of a cluster, so it's changed under a lock file and
+// read again on every request.
+type collectionCatalog struct {
+	file string
+}
+
+const (
+	catalogFile = "collections.json"
+)
+
+var (
+	collectionsCatalog *collectionCatalog
+
+	errCatalogCollectionNotFound = errors.New("collection not found")
+)
+
+func newCollectionCatalog(file string) *collectionCatalog {
+	return &collectionCatalog{
+		file: file,
+	}
+}
+
+// list returns the collections of the catalog, oldest first.
+func (c *collectionCatalog) list() (list []*CatalogCollection, err error) {
+	content, err := os.ReadFile(c.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	err = json.Unmarshal(content, &list)
+	return
+}
+
+// find returns the collection of the name, nil if not found.
+func (c *collectionCatalog) find(collection string) (*CatalogCollection, error) {
+	list, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+
+	if i := slices.IndexFunc(list, func(e *CatalogCollection) bool { return e.Collection == collection }); i >= 0 {
+		return list[i], nil
+	}
+	return nil, nil
+}
+
+// findDigest returns the collection of the document of the digest ingested
+// for the tenant, nil if not found.
+func (c *collectionCatalog) findDigest(tenant string, digest string) (*CatalogCollection, error) {
+	list, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+
+	if i := slices.IndexFunc(list, func(e *CatalogCollection) bool { return e.Tenant == tenant && e.Sha256 == digest }); i >= 0 {
+		return list[i], nil
+	}
+	return nil, nil
+}
+
+func (c *collectionCatalog) add(collection *CatalogCollection) error {
+	return c.update(func(list []*CatalogCollection) ([]*CatalogCollection, error) {
+		return append(list, collection), nil
+	})
+}
+
+func (c *collectionCatalog) rename(collection string, name string) error {
+	return c.update(func(list []*CatalogCollection) ([]*CatalogCollection, error) {
+		i := slices.IndexFunc(list, func(e *CatalogCollection) bool { return e.Collection == collection })
+		if i < 0 {
+			return nil, errCatalogCollectionNotFound
+		}
+		list[i].Name = name
+		return list, nil
+	})
+}
+
+func (c *collectionCatalog) remove(collection string) error {
+	return c.update(func(list []*CatalogCollection) ([]*CatalogCollection, error) {
+		i := slices.IndexFunc(list, func(e *CatalogCollection) bool { return e.Collection == collection })
+		if i < 0 {
+			return nil, errCatalogCollectionNotFound
+		}
+		return slices.Delete(list, i, i+1), nil
+	})
+}
+
+// seed adds the presets to the catalog if it was never written, so that a
+// preset removed from the catalog isn't added again. The presets without a
+// tenant can only be accessed by the admins, or by all without auth.
+func (c *collectionCatalog) seed(presets []*CatalogCollection) (seeded bool, err error) {
+	err = c.update(func(list []*CatalogCollection) ([]*CatalogCollection, error) {
+		if _, err := os.Stat(c.file); !os.IsNotExist(err) {
+			return list, nil
+		}
+
+		nowTs := time.Now().Unix()
+		for _, preset := range presets {
+			if preset.Name == "" {
+				preset.Name = preset.Collection
+			}
+			if preset.FileName == "" {
+				preset.FileName = preset.Name
+			}
+			if preset.CreateTs == 0 {
+				preset.CreateTs = nowTs
+			}
+		}
+		seeded = true
+		return presets, nil
+	})
+	return
+}
+
+// update changes the collections of the catalog with fn, under the lock file.
+func (c *collectionCatalog) update(fn func(list []*CatalogCollection) ([]*CatalogCollection, error)) error {
+	lockFile, err := os.OpenFile(c.file+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+	if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
+	list, err := c.list()
+	if err != nil {
+		return err
+	}
+	if list, err = fn(list); err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that a crash never leaves a truncated catalog
+	tmpFile := c.file + ".tmp"
+	if err = os.WriteFile(tmpFile, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, c.file)
+}
+
+// catalogIngestionJob adds the collection of the ready job to the catalog.
+func catalogIngestionJob(job *IngestionJob) {
+	err := collectionsCatalog.add(&CatalogCollection{
+		Collection: job.Collection,
+		Name:       job.FileName,
+		Tenant:     job.Tenant,
+		FileName:   job.FileName,
+		Sha256:     job.Sha256,
+		Chunks:     job.Chunks,
+		CreateTs:   time.Now().Unix(),
+	})
+	if err != nil {
+		slog.Error("Catalog add collection failed", "err", err, "collection", job.Collection, "jobId", job.Id, logTag)
+		return
+	}
+
+	slog.Info("Catalog add collection", "collection", job.Collection, "jobId", job.Id, logTag)
+}
+
+// tenantCollections returns the collections of the catalog the request can access.
+func tenantCollections(c *gin.Context) ([]*CatalogCollection, error) {
+	list, err := collectionsCatalog.list()
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		list = []*CatalogCollection{}
+	}
+
+	return slices.DeleteFunc(list, func(e *CatalogCollection) bool { return !canAccess(c, e.Tenant) }), nil
+}
+
+func (s *HttpServer) handlerCollections(c *gin.Context) {
+	list, err := tenantCollections(c)
+	if err != nil {
+		slog.Error("handlerCollections read catalog failed", "err", err, logTag)
+		s.output(c, codeErrCatalogFailed, nil, http.StatusInternalServerError)
+		return
+	}
+
+	s.output(c, codeSuccess, list)
+}
+
+func (s *HttpServer) handlerCollectionRename(c *gin.Context) {
+	collection := c.Param("collection")
+
+	var req CollectionRenameReq
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		slog.Error("handlerCollectionRename params invalid", "err", err, "collection", collection, logTag)
+		s.output(c, codeErrParamsInvalid, nil, http.StatusBadRequest)
+		return
+	}
+
+	if !s.outputCollectionFound(c, collection) {
+		return
+	}
+
+	if err := collectionsCatalog.rename(collection, req.Name); err != nil {
+		s.outputCatalogUpdateFailed(c, "handlerCollectionRename", collection, err)
+		return
+	}
+
+	slog.Info("handlerCollectionRename end", "collection", collection, "name", req.Name, logTag)
+	s.output(c, codeSuccess, map[string]any{"collection": collection, "name": req.Name})
+}
+
+// handlerCollectionDelete removes the collection from the catalog, the
+// vectors are left in the vector store.
+func (s *HttpServer) handlerCollectionDelete(c *gin.Context) {
+	collection := c.Param("collection")
+
+	if !s.outputCollectionFound(c, collection) {
+		return
+	}
+
+	if err := collectionsCatalog.remove(collection); err != nil {
+		s.outputCatalogUpdateFailed(c, "handlerCollectionDelete", collection, err)
+		return
+	}
+
+	slog.Info("handlerCollectionDelete end", "collection", collection, logTag)
+	s.output(c, codeSuccess, map[string]any{"collection": collection})
+}
+
+// outputCollectionFound checks whether the collection is in the catalog and
+// can be accessed by the request, and outputs the error if not.
+func (s *HttpServer) outputCollectionFound(c *gin.Context, collection string) bool {
+	entry, err := collectionsCatalog.find(collection)
+	if err != nil {
+		slog.Error("Catalog read failed", "err", err, "collection", collection, logTag)
+		s.output(c, codeErrCatalogFailed, nil, http.StatusInternalServerError)
+		return false
+	}
+	if entry == nil || !canAccess(c, entry.Tenant) {
+		slog.Error("Catalog collection not found", "collection", collection, logTag)
+		s.output(c, codeErrCollectionNotFound, nil, http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func (s *HttpServer) outputCatalogUpdateFailed(c *gin.Context, handler string, collection string, err error) {
+	slog.Error(handler+" update catalog failed", "err", err, "collection", collection, logTag)
+	if errors.Is(err, errCatalogCollectionNotFound) {
+		s.output(c, codeErrCollectionNotFound, nil, http.StatusNotFound)
+		return
+	}
+	s.output(c, codeErrCatalogFailed, nil, http.StatusInternalServerError)
+}
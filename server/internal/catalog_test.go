@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCollectionCatalogSeed(t *testing.T) {
+	catalog := newCollectionCatalog(filepath.Join(t.TempDir(), catalogFile))
+
+	seeded, err := catalog.seed([]*CatalogCollection{{Collection: "a1", Name: "doc.pdf", Tenant: "acme"}, {Collection: "a2"}})
+	if err != nil || !seeded {
+		t.Fatalf("seeded = %v, err = %v, want seeded", seeded, err)
+	}
+	list, _ := catalog.list()
+	if len(list) != 2 || list[0].FileName != "doc.pdf" || list[1].Name != "a2" || list[1].FileName != "a2" || list[1].CreateTs == 0 {
+		t.Fatalf("list = %+v, want the presets named and timed", list)
+	}
+
+	// A preset removed isn't seeded again
+	if err = catalog.remove("a1"); err != nil {
+		t.Fatal(err)
+	}
+	seeded, err = catalog.seed([]*CatalogCollection{{Collection: "a1", Name: "doc.pdf", Tenant: "acme"}})
+	if err != nil || seeded {
+		t.Fatalf("seeded = %v, err = %v, want not seeded", seeded, err)
+	}
+	if list, _ = catalog.list(); len(list) != 1 || list[0].Collection != "a2" {
+		t.Fatalf("list = %+v, want a2 only", list)
+	}
+}
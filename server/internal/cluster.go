@@ -0,0 +1,309 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Node is a server in node mode as known by the coordinator, refreshed by the
+// heartbeats of the node.
+type Node struct {
+	Id             string   `json:"node_id"`
+	Url            string   `json:"url"`
+	WorkersRunning int      `json:"workers_running"`
+	WorkersMax     int      `json:"workers_max"`
+	Channels       []string `json:"channels"`
+	UpdateTs       int64    `json:"update_ts"`
+
+	Tenants map[string]string `json:"tenants,omitempty"` // tenant by channel name
+}
+
+// cluster is the state of the coordinator: the live nodes and the channels
+// placed on them.
+type cluster struct {
+	lock  sync.RWMutex
+	nodes map[string]*Node
+	// Channels started on a node but not reported by its heartbeats yet
+	placements map[string]*placement
+}
+
+type placement struct {
+	nodeId string
+	tenant string
+	ts     int64
+}
+
+// clusterChannel is a channel running on a node.
+type clusterChannel struct {
+	nodeId string
+	tenant string
+}
+
+const (
+	// Server modes
+	ServerModeStandalone  = "standalone"
+	ServerModeCoordinator = "coordinator"
+	ServerModeNode        = "node"
+
+	// A node is dropped after missing this many heartbeats
+	nodeHeartbeatsMissedMax = 3
+	// A placement is dropped if the node doesn't report the channel in time
+	placementKeepSeconds = 60
+)
+
+var (
+	nodes = newCluster()
+
+	errClusterChannelExisted = errors.New("channel existed")
+	errClusterNoNode         = errors.New("no node available")
+)
+
+func newCluster() *cluster {
+	return &cluster{
+		nodes:      make(map[string]*Node),
+		placements: make(map[string]*placement),
+	}
+}
+
+// heartbeat registers the node or refreshes it.
+func (cl *cluster) heartbeat(node *Node) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if _, ok := cl.nodes[node.Id]; !ok {
+		slog.Info("Node registered", "node", node, logTag)
+	}
+
+	node.UpdateTs = time.Now().Unix()
+	cl.nodes[node.Id] = node
+
+	// The channels reported by the node are confirmed
+	for _, channelName := range node.Channels {
+		if p, ok := cl.placements[channelName]; ok && p.nodeId == node.Id {
+			delete(cl.placements, channelName)
+		}
+	}
+}
+
+// load returns the workers running on the node, including the ones placed
+// since its last heartbeat.
+func (cl *cluster) load(node *Node) int {
+	load := node.WorkersRunning
+	for channelName, p := range cl.placements {
+		if p.nodeId == node.Id && !slices.Contains(node.Channels, channelName) {
+			load++
+		}
+	}
+	return load
+}
+
+// pickLocked returns the least loaded node with a free worker slot, nil if none.
+func (cl *cluster) pickLocked() *Node {
+	var picked *Node
+	var pickedLoad float64
+	for _, node := range cl.nodes {
+		load := cl.load(node)
+		if node.WorkersMax <= 0 || load >= node.WorkersMax {
+			continue
+		}
+
+		ratio := float64(load) / float64(node.WorkersMax)
+		if picked == nil || ratio < pickedLoad || (ratio == pickedLoad && node.Id < picked.Id) {
+			picked = node
+			pickedLoad = ratio
+		}
+	}
+
+	return picked
+}
+
+// place places the channel of the tenant on the least loaded node, and counts
+// it on the node before it's started, so that concurrent starts are spread
+// over the nodes. The channel is checked and placed at once, so that
+// concurrent starts of a channel can't place it on two nodes. admit is given
+// the channels of the tenant, including the ones placed.
+func (cl *cluster) place(channelName string, tenant string, admit func(running int) error) (*Node, error) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if node, _ := cl.ownerLocked(channelName); node != nil {
+		return node, errClusterChannelExisted
+	}
+
+	node := cl.pickLocked()
+	if node == nil {
+		return nil, errClusterNoNode
+	}
+
+	running := 0
+	for _, channel := range cl.channelsLocked() {
+		if channel.tenant == tenant {
+			running++
+		}
+	}
+	if err := admit(running); err != nil {
+		return nil, err
+	}
+
+	cl.placements[channelName] = &placement{nodeId: node.Id, tenant: tenant, ts: time.Now().Unix()}
+	return node, nil
+}
+
+// unplace forgets the channel, once it's stopped on its node.
+func (cl *cluster) unplace(channelName string) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	delete(cl.placements, channelName)
+	for _, node := range cl.nodes {
+		node.Channels = slices.DeleteFunc(node.Channels, func(c string) bool { return c == channelName })
+	}
+}
+
+// owner returns the node running the channel and the tenant of the channel,
+// nil if none.
+func (cl *cluster) owner(channelName string) (*Node, string) {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+
+	return cl.ownerLocked(channelName)
+}
+
+func (cl *cluster) ownerLocked(channelName string) (*Node, string) {
+	for _, node := range cl.nodes {
+		if slices.Contains(node.Channels, channelName) {
+			return node, node.Tenants[channelName]
+		}
+	}
+
+	if p, ok := cl.placements[channelName]; ok {
+		if node, ok := cl.nodes[p.nodeId]; ok {
+			return node, p.tenant
+		}
+	}
+
+	return nil, ""
+}
+
+// channels returns every channel by name, including the channels not reported
+// by their node yet.
+func (cl *cluster) channels() map[string]*clusterChannel {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+
+	return cl.channelsLocked()
+}
+
+func (cl *cluster) channelsLocked() map[string]*clusterChannel {
+	channels := make(map[string]*clusterChannel)
+	for channelName, p := range cl.placements {
+		channels[channelName] = &clusterChannel{nodeId: p.nodeId, tenant: p.tenant}
+	}
+	for _, node := range cl.nodes {
+		for _, channelName := range node.Channels {
+			channels[channelName] = &clusterChannel{nodeId: node.Id, tenant: node.Tenants[channelName]}
+		}
+	}
+	return channels
+}
+
+// list returns copies of the nodes, sorted by id.
+func (cl *cluster) list() []*Node {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+
+	list := make([]*Node, 0, len(cl.nodes))
+	for _, node := range cl.nodes {
+		n := *node
+		n.Channels = slices.Clone(node.Channels)
+		n.Tenants = maps.Clone(node.Tenants)
+		list = append(list, &n)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+
+	return list
+}
+
+// prune drops the nodes missing heartbeats, and the placements never
+// confirmed by their node.
+func (cl *cluster) prune(heartbeatSeconds int) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	nowTs := time.Now().Unix()
+	for id, node := range cl.nodes {
+		if node.UpdateTs+int64(heartbeatSeconds*nodeHeartbeatsMissedMax) < nowTs {
+			slog.Warn("Node expired", "node", node, logTag)
+			delete(cl.nodes, id)
+		}
+	}
+	for channelName, p := range cl.placements {
+		if _, ok := cl.nodes[p.nodeId]; !ok || p.ts+placementKeepSeconds < nowTs {
+			delete(cl.placements, channelName)
+		}
+	}
+}
+
+func (s *HttpServer) pruneNodes() {
+	for {
+		time.Sleep(time.Duration(s.config.NodeHeartbeatSeconds) * time.Second)
+		nodes.prune(s.config.NodeHeartbeatSeconds)
+	}
+}
+
+// heartbeatRequest creates the heartbeat request of the node, signed with the
+// node key if auth is enabled.
+func (s *HttpServer) heartbeatRequest(node *Node) *resty.Request {
+	body, _ := json.Marshal(node)
+	req := HttpClient.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(body)
+
+	if s.config.Authenticator != nil {
+		if err := s.config.Authenticator.Sign(req.Header, http.MethodPost, "/nodes/heartbeat", body, s.config.NodeAuthKey); err != nil {
+			slog.Error("Node heartbeat sign failed", "err", err, logTag)
+		}
+	}
+
+	return req
+}
+
+// heartbeat reports the workers of this node to the coordinator periodically.
+func (s *HttpServer) heartbeat() {
+	url := s.config.CoordinatorUrl + "/nodes/heartbeat"
+	for {
+		node := &Node{
+			Id:             s.config.NodeId,
+			Url:            s.config.NodeUrl,
+			WorkersRunning: workers.Size(),
+			WorkersMax:     s.config.WorkersMax,
+			Channels:       make([]string, 0, workers.Size()),
+			Tenants:        make(map[string]string),
+		}
+		for _, v := range workers.Values() {
+			worker := v.(*Worker)
+			node.Channels = append(node.Channels, worker.ChannelName)
+			if worker.Tenant != "" {
+				node.Tenants[worker.ChannelName] = worker.Tenant
+			}
+		}
+
+		res, err := s.heartbeatRequest(node).Post(url)
+		if err != nil {
+			slog.Error("Node heartbeat failed", "err", err, "coordinatorUrl", s.config.CoordinatorUrl, logTag)
+		} else if res.IsError() {
+			slog.Error("Node heartbeat failed", "status", res.StatusCode(), "coordinatorUrl", s.config.CoordinatorUrl, logTag)
+		}
+
+		time.Sleep(time.Duration(s.config.NodeHeartbeatSeconds) * time.Second)
+	}
+}
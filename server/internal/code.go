@@ -17,12 +17,38 @@ var (
 	codeErrGenerateTokenFailed = NewCode("10005", "generate token failed")
 	codeErrSaveFileFailed      = NewCode("10006", "save file failed")
 	codeErrParseJsonFailed     = NewCode("10007", "parse json failed")
+	codeErrUnauthorized        = NewCode("10008", "unauthorized")
+	codeErrForbidden           = NewCode("10009", "forbidden")
 
-	codeErrProcessPropertyFailed = NewCode("10100", "process property json failed")
-	codeErrStartWorkerFailed     = NewCode("10101", "start worker failed")
-	codeErrStopWorkerFailed      = NewCode("10102", "stop worker failed")
-	codeErrHttpStatusNotOk       = NewCode("10103", "http status not 200")
-	codeErrUpdateWorkerFailed    = NewCode("10104", "update worker failed")
+	codeErrTenantWorkersLimit       = NewCode("10010", "tenant workers limit")
+	codeErrRateLimited              = NewCode("10011", "rate limited")
+	codeErrTenantWorkerMinutesLimit = NewCode("10012", "tenant worker minutes limit")
+	codeErrGraphNotFound            = NewCode("10013", "graph not found")
+	codeErrPropertiesInvalid        = NewCode("10014", "properties invalid")
+	codeErrGraphPatchInvalid        = NewCode("10015", "graph patch invalid")
+	codeErrSecretsNotFound          = NewCode("10016", "secrets not found")
+	codeErrUploadTooLarge           = NewCode("10017", "upload too large")
+	codeErrUploadTypeNotAllowed     = NewCode("10018", "upload type not allowed")
+	codeErrIngestionJobNotFound     = NewCode("10019", "ingestion job not found")
+	codeErrCollectionNotFound       = NewCode("10020", "collection not found")
+	codeErrTokenExpireInvalid       = NewCode("10021", "token expire invalid")
+	codeErrRequestTooLarge          = NewCode("10022", "request too large")
+
+	codeErrProcessPropertyFailed  = NewCode("10100", "process property json failed")
+	codeErrStartWorkerFailed      = NewCode("10101", "start worker failed")
+	codeErrStopWorkerFailed       = NewCode("10102", "stop worker failed")
+	codeErrHttpStatusNotOk        = NewCode("10103", "http status not 200")
+	codeErrUpdateWorkerFailed     = NewCode("10104", "update worker failed")
+	codeErrReadWorkerLogFailed    = NewCode("10105", "read worker log failed")
+	codeErrWorkerNotReady         = NewCode("10106", "worker not ready")
+	codeErrNoPortAvailable        = NewCode("10107", "no port available")
+	codeErrNoNodeAvailable        = NewCode("10108", "no node available")
+	codeErrProxyFailed            = NewCode("10109", "proxy to node failed")
+	codeErrReadAgentMetricsFailed = NewCode("10110", "read agent metrics failed")
+	codeErrReadTranscriptFailed   = NewCode("10111", "read transcript failed")
+	codeErrReadGraphsFailed       = NewCode("10112", "read graphs failed")
+	codeErrRetentionSweepFailed   = NewCode("10113", "retention sweep failed")
+	codeErrCatalogFailed          = NewCode("10114", "collection catalog failed")
 )
 
 func NewCode(code string, msg string) *Code {
@@ -13,13 +13,20 @@ const (
 	// Extension name
 	extensionNameAgoraRTC   = "agora_rtc"
 	extensionNameHttpServer = "http_server"
+	extensionNameLlamaIndex = "llama_index"
 
 	// Property json
 	PropertyJsonFile = "./agents/property.json"
-	// Token expire time
-	tokenExpirationInSeconds = uint32(86400)
+	// Manifest of an extension addon, by addon name
+	ExtensionManifestFile = "./agents/ten_packages/extension/%s/manifest.json"
 
 	WORKER_TIMEOUT_INFINITY = -1
+
+	// Default page size of /workers
+	workersPageLimit = 100
+
+	// Context key of the code of the response
+	outputCodeContextKey = "output_code"
 )
 
 var (
@@ -42,5 +49,55 @@ var (
 		"WorkerHttpServerPort": {
 			{ExtensionName: extensionNameHttpServer, Property: "listen_port"},
 		},
+		"Collection": {
+			{ExtensionName: extensionNameLlamaIndex, Property: "collection"},
+		},
+	}
+
+	// Environment configuring the server, removed from the environment of the
+	// workers. AGORA_APP_ID is kept, it's a placeholder of property.json.
+	serverEnvNames = []string{
+		"AGORA_APP_CERTIFICATE",
+		"AUTH_KEYS",
+		"AUTH_MODE",
+		"CATALOG_FILE",
+		"COORDINATOR_URL",
+		"CORS_ALLOW_ORIGINS",
+		"LOG_PATH",
+		"LOG_STDOUT",
+		"NODE_AUTH_KEY",
+		"NODE_HEARTBEAT_SECONDS",
+		"NODE_ID",
+		"NODE_URL",
+		"RETENTION_POLICIES",
+		"RETENTION_SWEEP_MINUTES",
+		"SECRETS_ENV_FALLBACK",
+		"SECRETS_ENV_FILE_DIR",
+		"SECRETS_FILE",
+		"SECRETS_HTTP_TOKEN",
+		"SECRETS_HTTP_URL",
+		"SECRETS_KEY",
+		"SECRETS_PROVIDER",
+		"SERVER_MODE",
+		"SERVER_PORT",
+		"TENANT_QUOTAS",
+		"TOKEN_EXPIRE_SECONDS",
+		"TOKEN_EXPIRE_SECONDS_MAX",
+		"TOKEN_EXPIRE_SECONDS_MIN",
+		"TOKEN_REFRESH_BEFORE_SECONDS",
+		"UPLOAD_ALLOWED_TYPES",
+		"UPLOAD_MAX_BYTES",
+		"VECTOR_DOCUMENT_PRESET_LIST",
+		"WORKERS_KEEP_ON_EXIT",
+		"WORKERS_MAX",
+		"WORKER_HTTP_SERVER_PORT_MAX",
+		"WORKER_HTTP_SERVER_PORT_MIN",
+		"WORKER_LOG_BUFFER_LINES",
+		"WORKER_QUIT_TIMEOUT_SECONDES",
+		"WORKER_READY_PATTERN",
+		"WORKER_RUNTIMES",
+		"WORKER_START_TIMEOUT_SECONDS",
+		"WORKER_STOP_DRAIN_SECONDS",
+		"WORKER_STOP_TIMEOUT_SECONDS",
 	}
 )
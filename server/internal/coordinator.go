@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// Memory used to parse the uploads for their channel name, the rest goes to temp files
+	proxyMultipartMemoryBytes = 32 << 20
+)
+
+func (s *HttpServer) handlerNodes(c *gin.Context) {
+	s.output(c, codeSuccess, nodes.list())
+}
+
+func (s *HttpServer) handlerNodeHeartbeat(c *gin.Context) {
+	var node Node
+
+	if err := c.ShouldBindJSON(&node); err != nil || node.Id == "" || node.Url == "" {
+		slog.Error("handlerNodeHeartbeat params invalid", "err", err, "node", node, logTag)
+		s.output(c, codeErrParamsInvalid, nil, http.StatusBadRequest)
+		return
+	}
+
+	slog.Debug("handlerNodeHeartbeat", "node", node, logTag)
+	nodes.heartbeat(&node)
+	s.output(c, codeSuccess, nil)
+}
+
+// handlerClusterList lists the channels of all the nodes.
+func (s *HttpServer) handlerClusterList(c *gin.Context) {
+	channels := nodes.channels()
+	filtered := make([]map[string]interface{}, 0, len(channels))
+	for channelName, channel := range channels {
+		if !canAccess(c, channel.tenant) {
+			continue
+		}
+		filtered = append(filtered, map[string]interface{}{
+			"channelName": channelName,
+			"nodeId":      channel.nodeId,
+		})
+	}
+	s.output(c, codeSuccess, filtered)
+}
+
+// handlerClusterStart places the worker on the least loaded node.
+func (s *HttpServer) handlerClusterStart(c *gin.Context) {
+	body, err := c.GetRawData()
+	if s.outputBodyTooLarge(c, err) {
+		return
+	}
+	if err != nil {
+		s.output(c, codeErrParamsInvalid, nil, http.StatusBadRequest)
+		return
+	}
+
+	channelName := gjson.GetBytes(body, "channel_name").String()
+	requestId := gjson.GetBytes(body, "request_id").String()
+	if strings.TrimSpace(channelName) == "" {
+		slog.Error("handlerClusterStart channel empty", "channelName", channelName, "requestId", requestId, logTag)
+		s.output(c, codeErrChannelEmpty, nil, http.StatusBadRequest)
+		return
+	}
+
+	// The quotas of the tenant are checked with the placement, so that they
+	// count the concurrent starts
+	tenant := requestTenant(c)
+	node, err := nodes.place(channelName, tenant, func(running int) error {
+		return quotas.admitClusterStart(tenant, running)
+	})
+	var quotaErr *quotaExceededError
+	if errors.As(err, &quotaErr) {
+		slog.Error("handlerClusterStart tenant quota exceeded", "err", err, "tenant", tenant, "channelName", channelName, "requestId", requestId, logTag)
+		s.outputQuotaExceeded(c, quotaErr)
+		return
+	}
+	if errors.Is(err, errClusterChannelExisted) {
+		slog.Error("handlerClusterStart channel existed", "channelName", channelName, "nodeId", node.Id, "requestId", requestId, logTag)
+		s.output(c, codeErrChannelExisted, nil, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("handlerClusterStart no node available", "channelName", channelName, "requestId", requestId, logTag)
+		s.output(c, codeErrNoNodeAvailable, nil, http.StatusServiceUnavailable)
+		return
+	}
+	slog.Info("handlerClusterStart placed", "channelName", channelName, "nodeId", node.Id, "requestId", requestId, logTag)
+
+	s.proxy(c, node, body, func(ok bool) {
+		if !ok {
+			nodes.unplace(channelName)
+			quotas.refundStart(tenant)
+		}
+	})
+}
+
+// handlerClusterForward forwards the request to the node running the channel.
+func (s *HttpServer) handlerClusterForward(c *gin.Context) {
+	body, err := c.GetRawData()
+	if s.outputBodyTooLarge(c, err) {
+		return
+	}
+	if err != nil {
+		s.output(c, codeErrParamsInvalid, nil, http.StatusBadRequest)
+		return
+	}
+
+	channelName := requestChannelName(c, body)
+	node, tenant := nodes.owner(channelName)
+	if node == nil || !canAccess(c, tenant) {
+		slog.Error("handlerClusterForward channel not existed", "channelName", channelName, "path", c.Request.URL.Path, logTag)
+		s.output(c, codeErrChannelNotExisted, nil, http.StatusBadRequest)
+		return
+	}
+
+	var onResult func(ok bool)
+	if c.Request.URL.Path == "/stop" {
+		onResult = func(ok bool) {
+			if ok {
+				nodes.unplace(channelName)
+			}
+		}
+	}
+	s.proxy(c, node, body, onResult)
+}
+
+// requestChannelName returns the channel name of the request from the path,
+// the query, the multipart form or the json body.
+func requestChannelName(c *gin.Context, body []byte) string {
+	if channelName := c.Param("channel"); channelName != "" {
+		return channelName
+	}
+	if channelName := c.Query("channel_name"); channelName != "" {
+		return channelName
+	}
+
+	if c.ContentType() == gin.MIMEMultipartPOSTForm {
+		req := c.Request.Clone(c.Request.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if err := req.ParseMultipartForm(proxyMultipartMemoryBytes); err != nil {
+			return ""
+		}
+		defer req.MultipartForm.RemoveAll()
+		return req.FormValue("channel_name")
+	}
+
+	return gjson.GetBytes(body, "channel_name").String()
+}
+
+// proxy sends the request with the body to the node, and the response back
+// to the client as it comes, so that followed logs are streamed. onResult, if
+// set, is called with whether the node succeeded, from the code of its response.
+func (s *HttpServer) proxy(c *gin.Context, node *Node, body []byte, onResult func(ok bool)) {
+	target, err := url.Parse(node.Url)
+	if err != nil {
+		slog.Error("proxy node url invalid", "err", err, "node", node, logTag)
+		s.output(c, codeErrProxyFailed, nil, http.StatusBadGateway)
+		return
+	}
+
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Request.ContentLength = int64(len(body))
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.FlushInterval = -1
+	proxy.ModifyResponse = func(res *http.Response) error {
+		if onResult == nil {
+			return nil
+		}
+
+		content, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		res.Body = io.NopCloser(bytes.NewReader(content))
+
+		onResult(res.StatusCode == http.StatusOK && gjson.GetBytes(content, "code").String() == codeSuccess.code)
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		slog.Error("proxy failed", "err", err, "nodeId", node.Id, "path", r.URL.Path, logTag)
+		if onResult != nil {
+			onResult(false)
+		}
+		s.output(c, codeErrProxyFailed, nil, http.StatusBadGateway)
+	}
+
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// WorkerEvent is a worker lifecycle event pushed to the subscribers of /events.
+type WorkerEvent struct {
+	Type        string         `json:"type"`
+	ChannelName string         `json:"channel_name"`
+	Ts          int64          `json:"ts"`
+	Data        map[string]any `json:"data,omitempty"`
+
+	tenant string // tenant of the worker, only its subscribers get the event
+}
+
+type eventBus struct {
+	lock        sync.RWMutex
+	subscribers map[chan *WorkerEvent]struct{}
+}
+
+const (
+	// Worker event types
+	workerEventStarting        = "worker_starting"
+	workerEventStarted         = "worker_started"
+	workerEventExited          = "worker_exited"
+	workerEventRestarting      = "worker_restarting"
+	workerEventTimedOut        = "worker_timed_out"
+	workerEventStopped         = "worker_stopped"
+	workerEventUpdateForwarded = "update_forwarded"
+	workerEventIngestionJob    = "ingestion_job"
+	workerEventTokenRefreshed  = "token_refreshed"
+
+	// Events buffered per subscriber, events are dropped for slow subscribers
+	eventSubscriberBufferSize = 128
+	// Interval of the keepalive comment sent to idle subscribers
+	eventKeepaliveSeconds = 15
+)
+
+var (
+	workerEvents = newEventBus()
+)
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscribers: make(map[chan *WorkerEvent]struct{}),
+	}
+}
+
+func (b *eventBus) subscribe() chan *WorkerEvent {
+	ch := make(chan *WorkerEvent, eventSubscriberBufferSize)
+
+	b.lock.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.lock.Unlock()
+
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan *WorkerEvent) {
+	b.lock.Lock()
+	delete(b.subscribers, ch)
+	b.lock.Unlock()
+}
+
+// publish sends the event of the worker of the channel to all subscribers
+// without blocking the caller.
+func (b *eventBus) publish(eventType string, channelName string, data map[string]any) {
+	tenant := ""
+	if worker := findWorker(channelName); worker != nil {
+		tenant = worker.Tenant
+	}
+	b.publishTenant(tenant, eventType, channelName, data)
+}
+
+// publishTenant publishes the event of a worker of the tenant, for the workers
+// which are not registered yet.
+func (b *eventBus) publishTenant(tenant string, eventType string, channelName string, data map[string]any) {
+	event := &WorkerEvent{
+		Type:        eventType,
+		ChannelName: channelName,
+		Ts:          time.Now().UnixMilli(),
+		Data:        data,
+		tenant:      tenant,
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			slog.Warn("Event subscriber too slow, event dropped", "event", event, logTag)
+		}
+	}
+}
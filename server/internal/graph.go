@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// Graph is a predefined graph of property.json.
+type Graph struct {
+	Name        string            `json:"name"`
+	AutoStart   bool              `json:"auto_start"`
+	Addons      []string          `json:"addons"`
+	Nodes       []*GraphNode      `json:"nodes"`
+	Connections []json.RawMessage `json:"connections"`
+}
+
+// GraphNode is an extension or extension group of a graph. Properties are
+// the properties of the extension which can be overridden by the properties
+// of /start, Property is the value of the properties in property.json.
+type GraphNode struct {
+	Type           string           `json:"type"`
+	Name           string           `json:"name"`
+	Addon          string           `json:"addon"`
+	ExtensionGroup string           `json:"extension_group,omitempty"`
+	Properties     []*GraphProperty `json:"properties,omitempty"`
+	Property       json.RawMessage  `json:"property,omitempty"` // details only
+
+	propertyTypes map[string]string // by property name, nil if the manifest of the addon is not found
+}
+
+// GraphProperty is a property of an extension, typed by the api.property of
+// the manifest of its addon.
+type GraphProperty struct {
+	Name    string `json:"name"`
+	Type    string `json:"type,omitempty"`    // empty if the manifest of the addon is not found
+	Default any    `json:"default,omitempty"` // value in property.json
+	Env     string `json:"env,omitempty"`     // environment the value is read from, instead of a default
+}
+
+const (
+	graphNodeTypeExtension = "extension"
+)
+
+var (
+	// Property value read from the environment by the runtime, e.g. ${env:OPENAI_API_KEY}
+	graphPropertyEnvRegexp = regexp.MustCompile(`^\$\{env:([^}|]+)(\|[^}]*)?\}$`)
+)
+
+// loadGraphs reads the predefined graphs of property.json, with the
+// properties of their extensions typed by the manifests.
+func loadGraphs() ([]*Graph, error) {
+	content, err := os.ReadFile(PropertyJsonFile)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make(map[string]map[string]string)
+	graphs := []*Graph{}
+	for _, g := range gjson.GetBytes(content, "_ten.predefined_graphs").Array() {
+		graph := &Graph{
+			Name:        g.Get("name").String(),
+			AutoStart:   g.Get("auto_start").Bool(),
+			Addons:      []string{},
+			Nodes:       []*GraphNode{},
+			Connections: []json.RawMessage{},
+		}
+
+		for _, n := range g.Get("nodes").Array() {
+			graph.Nodes = append(graph.Nodes, newGraphNode(n, manifests))
+		}
+		graph.updateAddons()
+
+		for _, connection := range g.Get("connections").Array() {
+			graph.Connections = append(graph.Connections, json.RawMessage(connection.Raw))
+		}
+
+		graphs = append(graphs, graph)
+	}
+
+	return graphs, nil
+}
+
+// newGraphNode creates the node of the graph from its json, the manifests
+// cache the property types by addon.
+func newGraphNode(n gjson.Result, manifests map[string]map[string]string) *GraphNode {
+	node := &GraphNode{
+		Type:           n.Get("type").String(),
+		Name:           n.Get("name").String(),
+		Addon:          n.Get("addon").String(),
+		ExtensionGroup: n.Get("extension_group").String(),
+	}
+	if n.Get("property").Exists() {
+		node.Property = json.RawMessage(n.Get("property").Raw)
+	}
+
+	if node.Type == graphNodeTypeExtension {
+		types, ok := manifests[node.Addon]
+		if !ok {
+			types = extensionPropertyTypes(node.Addon)
+			manifests[node.Addon] = types
+		}
+		node.propertyTypes = types
+		node.Properties = graphNodeProperties(node.Name, n.Get("property"), types)
+	}
+
+	return node
+}
+
+// updateAddons lists the addons of the extensions of the graph.
+func (g *Graph) updateAddons() {
+	g.Addons = []string{}
+	for _, node := range g.Nodes {
+		if node.Type == graphNodeTypeExtension && !slices.Contains(g.Addons, node.Addon) {
+			g.Addons = append(g.Addons, node.Addon)
+		}
+	}
+}
+
+// propertyPath returns the sjson path of the property of the extension, in the
+// property.json of a worker which only keeps this graph. Empty if the extension
+// is not in the graph. The node is addressed by index, as sjson only sets the
+// properties existing in property.json through a query.
+func (g *Graph) propertyPath(extensionName string, property string) string {
+	i := slices.IndexFunc(g.Nodes, func(node *GraphNode) bool {
+		return node.Type == graphNodeTypeExtension && node.Name == extensionName
+	})
+	if i < 0 {
+		return ""
+	}
+	return fmt.Sprintf("_ten.predefined_graphs.0.nodes.%d.property.%s", i, property)
+}
+
+// findGraph returns the predefined graph of the name, nil if not found.
+func findGraph(name string) (*Graph, error) {
+	graphs, err := loadGraphs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, graph := range graphs {
+		if graph.Name == name {
+			return graph, nil
+		}
+	}
+	return nil, nil
+}
+
+// extensionPropertyTypes returns the types of the properties of the addon by
+// name, from the api.property of its manifest. Nil if the manifest is not found.
+func extensionPropertyTypes(addon string) map[string]string {
+	content, err := os.ReadFile(fmt.Sprintf(ExtensionManifestFile, addon))
+	if err != nil {
+		slog.Debug("Read extension manifest failed", "err", err, "addon", addon, logTag)
+		return nil
+	}
+
+	types := make(map[string]string)
+	gjson.GetBytes(content, "api.property").ForEach(func(key, value gjson.Result) bool {
+		types[key.String()] = value.Get("type").String()
+		return true
+	})
+	return types
+}
+
+// graphNodeProperties returns the properties of the extension declared by its
+// manifest or set in property.json, except the ones set by the server on /start.
+func graphNodeProperties(extensionName string, values gjson.Result, types map[string]string) []*GraphProperty {
+	properties := make(map[string]*GraphProperty)
+	for name, typ := range types {
+		properties[name] = &GraphProperty{Name: name, Type: typ}
+	}
+	values.ForEach(func(key, value gjson.Result) bool {
+		property, ok := properties[key.String()]
+		if !ok {
+			property = &GraphProperty{Name: key.String()}
+			properties[key.String()] = property
+		}
+
+		if matches := graphPropertyEnvRegexp.FindStringSubmatch(value.String()); value.Type == gjson.String && matches != nil {
+			property.Env = matches[1]
+		} else {
+			property.Default = value.Value()
+		}
+		return true
+	})
+
+	list := make([]*GraphProperty, 0, len(properties))
+	for _, name := range sortedKeys(properties) {
+		if !isStartProp(extensionName, name) {
+			list = append(list, properties[name])
+		}
+	}
+	return list
+}
+
+func (s *HttpServer) handlerGraphs(c *gin.Context) {
+	graphs, err := loadGraphs()
+	if err != nil {
+		slog.Error("handlerGraphs load graphs failed", "err", err, logTag)
+		s.output(c, codeErrReadGraphsFailed, nil, http.StatusInternalServerError)
+		return
+	}
+
+	// The values of the properties are only in the details
+	for _, graph := range graphs {
+		for _, node := range graph.Nodes {
+			node.Property = nil
+		}
+	}
+
+	s.output(c, codeSuccess, graphs)
+}
+
+func (s *HttpServer) handlerGraph(c *gin.Context) {
+	name := c.Param("name")
+
+	graph, err := findGraph(name)
+	if err != nil {
+		slog.Error("handlerGraph load graphs failed", "err", err, "graph", name, logTag)
+		s.output(c, codeErrReadGraphsFailed, nil, http.StatusInternalServerError)
+		return
+	}
+	if graph == nil {
+		slog.Error("handlerGraph graph not found", "graph", name, logTag)
+		s.output(c, codeErrGraphNotFound, nil, http.StatusNotFound)
+		return
+	}
+
+	s.output(c, codeSuccess, graph)
+}
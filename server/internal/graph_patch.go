@@ -0,0 +1,401 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/tidwall/gjson"
+)
+
+// GraphPatch changes the predefined graph of /start for this agent only. The
+// nodes are removed first, then added or replaced, then the connections set.
+type GraphPatch struct {
+	Nodes       []*GraphPatchNode  `json:"nodes,omitempty"`
+	RemoveNodes []string           `json:"remove_nodes,omitempty"` // with their connections
+	Connections []*GraphConnection `json:"connections,omitempty"`
+}
+
+// GraphPatchNode adds a node, or replaces the node of the same name. With
+// Replace it replaces the node of that name instead, e.g. to swap the addon of
+// an extension, and the connections of the replaced node are rewired to it.
+type GraphPatchNode struct {
+	Replace        string         `json:"replace,omitempty"`
+	Type           string         `json:"type,omitempty"` // default extension
+	Name           string         `json:"name,omitempty"` // default the addon
+	Addon          string         `json:"addon"`
+	ExtensionGroup string         `json:"extension_group,omitempty"` // default the group of the replaced node
+	Property       map[string]any `json:"property,omitempty"`
+}
+
+// GraphConnection is the messages an extension sends, by kind. In a patch it
+// replaces all the messages of the extension, none removes them.
+type GraphConnection struct {
+	ExtensionGroup string          `json:"extension_group,omitempty"`
+	Extension      string          `json:"extension"`
+	Cmd            []*GraphMessage `json:"cmd,omitempty"`
+	Data           []*GraphMessage `json:"data,omitempty"`
+	AudioFrame     []*GraphMessage `json:"audio_frame,omitempty"`
+	VideoFrame     []*GraphMessage `json:"video_frame,omitempty"`
+}
+
+// GraphMessage is a message sent to the extensions of Dest.
+type GraphMessage struct {
+	Name string       `json:"name"`
+	Dest []*GraphDest `json:"dest"`
+}
+
+type GraphDest struct {
+	ExtensionGroup string `json:"extension_group,omitempty"`
+	Extension      string `json:"extension"`
+}
+
+const (
+	graphNodeTypeExtensionGroup = "extension_group"
+
+	// Message kinds, the manifests declare them in <kind>_in and <kind>_out
+	graphMessageCmd        = "cmd"
+	graphMessageData       = "data"
+	graphMessageAudioFrame = "audio_frame"
+	graphMessageVideoFrame = "video_frame"
+)
+
+var (
+	graphMessageKinds = []string{graphMessageCmd, graphMessageData, graphMessageAudioFrame, graphMessageVideoFrame}
+)
+
+// messages returns the messages of the connection by kind.
+func (c *GraphConnection) messages() map[string]*[]*GraphMessage {
+	return map[string]*[]*GraphMessage{
+		graphMessageCmd:        &c.Cmd,
+		graphMessageData:       &c.Data,
+		graphMessageAudioFrame: &c.AudioFrame,
+		graphMessageVideoFrame: &c.VideoFrame,
+	}
+}
+
+// empty checks whether the connection sends no message.
+func (c *GraphConnection) empty() bool {
+	return len(c.Cmd) == 0 && len(c.Data) == 0 && len(c.AudioFrame) == 0 && len(c.VideoFrame) == 0
+}
+
+// connections decodes the connections of the graph.
+func (g *Graph) connections() ([]*GraphConnection, error) {
+	connections := make([]*GraphConnection, 0, len(g.Connections))
+	for _, raw := range g.Connections {
+		var connection GraphConnection
+		if err := json.Unmarshal(raw, &connection); err != nil {
+			return nil, err
+		}
+		connections = append(connections, &connection)
+	}
+	return connections, nil
+}
+
+// setConnections encodes the connections into the graph.
+func (g *Graph) setConnections(connections []*GraphConnection) {
+	g.Connections = make([]json.RawMessage, 0, len(connections))
+	for _, connection := range connections {
+		raw, _ := json.Marshal(connection)
+		g.Connections = append(g.Connections, raw)
+	}
+}
+
+// node returns the node of the name, nil if not found.
+func (g *Graph) node(name string) *GraphNode {
+	for _, node := range g.Nodes {
+		if node.Name == name {
+			return node
+		}
+	}
+	return nil
+}
+
+// patched returns a copy of the graph with the patch applied. The errors are
+// the patch operations which can't be applied, and the problems of the
+// patched graph which the predefined graph doesn't have.
+func (g *Graph) patched(patch *GraphPatch) (*Graph, []*GraphFieldError) {
+	errs := []*GraphFieldError{}
+
+	connections, err := g.connections()
+	if err != nil {
+		return nil, append(errs, &GraphFieldError{Field: "connections", Reason: fmt.Sprintf("predefined connections invalid, %v", err)})
+	}
+
+	p := &Graph{Name: g.Name, AutoStart: g.AutoStart, Nodes: slices.Clone(g.Nodes)}
+
+	for _, name := range patch.RemoveNodes {
+		i := slices.IndexFunc(p.Nodes, func(node *GraphNode) bool { return node.Name == name })
+		if i < 0 {
+			errs = append(errs, &GraphFieldError{Field: fmt.Sprintf("graph_patch.remove_nodes.%s", name), Reason: "node not in graph"})
+			continue
+		}
+		p.Nodes = slices.Delete(p.Nodes, i, i+1)
+		connections = removeGraphConnections(connections, name)
+	}
+
+	manifests := make(map[string]map[string]string)
+	for _, patchNode := range patch.Nodes {
+		if patchNode.Type == "" {
+			patchNode.Type = graphNodeTypeExtension
+		}
+		if patchNode.Name == "" {
+			patchNode.Name = patchNode.Addon
+		}
+
+		target := patchNode.Name
+		if patchNode.Replace != "" {
+			target = patchNode.Replace
+		}
+		i := slices.IndexFunc(p.Nodes, func(node *GraphNode) bool { return node.Name == target })
+		if i < 0 && patchNode.Replace != "" {
+			errs = append(errs, &GraphFieldError{Field: fmt.Sprintf("graph_patch.nodes.%s.replace", patchNode.Name), Reason: fmt.Sprintf("node %s not in graph", patchNode.Replace)})
+			continue
+		}
+		if i >= 0 && patchNode.ExtensionGroup == "" {
+			patchNode.ExtensionGroup = p.Nodes[i].ExtensionGroup
+		}
+
+		raw, _ := json.Marshal(map[string]any{
+			"type":            patchNode.Type,
+			"name":            patchNode.Name,
+			"addon":           patchNode.Addon,
+			"extension_group": patchNode.ExtensionGroup,
+			"property":        patchNode.Property,
+		})
+		node := newGraphNode(gjson.ParseBytes(raw), manifests)
+		if patchNode.Type != graphNodeTypeExtension {
+			node.ExtensionGroup = ""
+		}
+		if patchNode.Property == nil {
+			node.Property = nil
+		}
+
+		if i < 0 {
+			p.Nodes = append(p.Nodes, node)
+			continue
+		}
+		p.Nodes[i] = node
+		renameGraphConnections(connections, target, node)
+	}
+
+	for _, connection := range patch.Connections {
+		if connection.ExtensionGroup == "" {
+			if node := p.node(connection.Extension); node != nil {
+				connection.ExtensionGroup = node.ExtensionGroup
+			}
+		}
+		for _, messages := range connection.messages() {
+			for _, message := range *messages {
+				for _, dest := range message.Dest {
+					if node := p.node(dest.Extension); node != nil && dest.ExtensionGroup == "" {
+						dest.ExtensionGroup = node.ExtensionGroup
+					}
+				}
+			}
+		}
+
+		i := slices.IndexFunc(connections, func(c *GraphConnection) bool { return c.Extension == connection.Extension })
+		switch {
+		case connection.empty() && i >= 0:
+			connections = slices.Delete(connections, i, i+1)
+		case connection.empty():
+		case i >= 0:
+			connections[i] = connection
+		default:
+			connections = append(connections, connection)
+		}
+	}
+
+	p.setConnections(connections)
+	p.updateAddons()
+
+	// Only the problems brought by the patch are reported, the predefined
+	// graphs are run as they are
+	predefined := make(map[GraphFieldError]bool)
+	for _, err := range g.validate() {
+		predefined[*err] = true
+	}
+	for _, err := range p.validate() {
+		if !predefined[*err] {
+			errs = append(errs, err)
+		}
+	}
+
+	return p, errs
+}
+
+// removeGraphConnections removes the messages sent by and to the extension.
+func removeGraphConnections(connections []*GraphConnection, extension string) []*GraphConnection {
+	kept := []*GraphConnection{}
+	for _, connection := range connections {
+		if connection.Extension == extension {
+			continue
+		}
+
+		for _, messages := range connection.messages() {
+			keptMessages := []*GraphMessage{}
+			for _, message := range *messages {
+				message.Dest = slices.DeleteFunc(message.Dest, func(dest *GraphDest) bool { return dest.Extension == extension })
+				if len(message.Dest) > 0 {
+					keptMessages = append(keptMessages, message)
+				}
+			}
+			*messages = keptMessages
+		}
+
+		if !connection.empty() {
+			kept = append(kept, connection)
+		}
+	}
+	return kept
+}
+
+// renameGraphConnections points the messages sent by and to the extension to the node.
+func renameGraphConnections(connections []*GraphConnection, extension string, node *GraphNode) {
+	for _, connection := range connections {
+		if connection.Extension == extension {
+			connection.Extension = node.Name
+			connection.ExtensionGroup = node.ExtensionGroup
+		}
+
+		for _, messages := range connection.messages() {
+			for _, message := range *messages {
+				for _, dest := range message.Dest {
+					if dest.Extension == extension {
+						dest.Extension = node.Name
+						dest.ExtensionGroup = node.ExtensionGroup
+					}
+				}
+			}
+		}
+	}
+}
+
+// validate returns the problems of the graph: duplicated nodes, extensions
+// without addon or extension group, addons not installed, connections from or
+// to missing extensions, and messages not declared by the manifests of their
+// source and destination addons.
+func (g *Graph) validate() []*GraphFieldError {
+	errs := []*GraphFieldError{}
+
+	// The extension groups only have to be declared by the graphs declaring some
+	groups := []string{}
+	for _, node := range g.Nodes {
+		if node.Type == graphNodeTypeExtensionGroup {
+			groups = append(groups, node.Name)
+		}
+	}
+
+	names := make(map[string]bool)
+	apis := make(map[string]gjson.Result)
+	for _, node := range g.Nodes {
+		field := fmt.Sprintf("nodes.%s", node.Name)
+		if node.Name == "" {
+			errs = append(errs, &GraphFieldError{Field: "nodes", Reason: "node without name"})
+			continue
+		}
+		if names[node.Name] {
+			errs = append(errs, &GraphFieldError{Field: field, Reason: "node duplicated"})
+		}
+		names[node.Name] = true
+
+		if node.Type != graphNodeTypeExtension {
+			continue
+		}
+		if node.Addon == "" {
+			errs = append(errs, &GraphFieldError{Field: field, Reason: "extension without addon"})
+		} else if _, ok := apis[node.Addon]; !ok {
+			api, err := extensionApi(node.Addon)
+			if err != nil {
+				errs = append(errs, &GraphFieldError{Field: field, Reason: fmt.Sprintf("addon %s not installed", node.Addon)})
+			}
+			apis[node.Addon] = api
+		}
+		if node.ExtensionGroup == "" {
+			errs = append(errs, &GraphFieldError{Field: field, Reason: "extension without extension group"})
+		} else if len(groups) > 0 && !slices.Contains(groups, node.ExtensionGroup) {
+			errs = append(errs, &GraphFieldError{Field: field, Reason: fmt.Sprintf("extension group %s not in graph", node.ExtensionGroup)})
+		}
+	}
+
+	connections, err := g.connections()
+	if err != nil {
+		return append(errs, &GraphFieldError{Field: "connections", Reason: err.Error()})
+	}
+
+	for _, connection := range connections {
+		field := fmt.Sprintf("connections.%s", connection.Extension)
+		source := g.extension(connection.Extension)
+		if source == nil {
+			errs = append(errs, &GraphFieldError{Field: field, Reason: "extension not in graph"})
+			continue
+		}
+		if connection.ExtensionGroup != source.ExtensionGroup {
+			errs = append(errs, &GraphFieldError{Field: field, Reason: fmt.Sprintf("extension is in group %s, not %s", source.ExtensionGroup, connection.ExtensionGroup)})
+		}
+
+		for _, kind := range graphMessageKinds {
+			for _, message := range *connection.messages()[kind] {
+				messageField := fmt.Sprintf("%s.%s.%s", field, kind, message.Name)
+				if api := apis[source.Addon]; api.Exists() && !extensionDeclares(api, kind+"_out", message.Name) {
+					errs = append(errs, &GraphFieldError{Field: messageField, Reason: fmt.Sprintf("%s not declared in %s_out of addon %s", message.Name, kind, source.Addon)})
+				}
+
+				for _, dest := range message.Dest {
+					destField := fmt.Sprintf("%s.dest.%s", messageField, dest.Extension)
+					node := g.extension(dest.Extension)
+					if node == nil {
+						errs = append(errs, &GraphFieldError{Field: destField, Reason: "extension not in graph"})
+						continue
+					}
+					if dest.ExtensionGroup != node.ExtensionGroup {
+						errs = append(errs, &GraphFieldError{Field: destField, Reason: fmt.Sprintf("extension is in group %s, not %s", node.ExtensionGroup, dest.ExtensionGroup)})
+					}
+					if api := apis[node.Addon]; api.Exists() && !extensionDeclares(api, kind+"_in", message.Name) {
+						errs = append(errs, &GraphFieldError{Field: destField, Reason: fmt.Sprintf("%s not declared in %s_in of addon %s", message.Name, kind, node.Addon)})
+					}
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// extensionApi returns the api of the manifest of the addon.
+func extensionApi(addon string) (gjson.Result, error) {
+	content, err := os.ReadFile(fmt.Sprintf(ExtensionManifestFile, addon))
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return gjson.GetBytes(content, "api"), nil
+}
+
+// extensionDeclares checks whether the messages of the api, e.g. data_in,
+// declare the message name.
+func extensionDeclares(api gjson.Result, messages string, name string) bool {
+	for _, message := range api.Get(messages).Array() {
+		if message.Get("name").String() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// propertyJsonNodes returns the nodes as written in property.json.
+func (g *Graph) propertyJsonNodes() []map[string]any {
+	nodes := make([]map[string]any, 0, len(g.Nodes))
+	for _, node := range g.Nodes {
+		n := map[string]any{"type": node.Type, "name": node.Name, "addon": node.Addon}
+		if node.ExtensionGroup != "" {
+			n["extension_group"] = node.ExtensionGroup
+		}
+		if node.Property != nil {
+			n["property"] = node.Property
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testGraphConnections are asr -> llm -> tts, the flush cmd of llm isn't
+// declared by tts, a problem of the predefined graph.
+func testGraphConnections() []*GraphConnection {
+	return []*GraphConnection{
+		{ExtensionGroup: "default", Extension: "asr", Data: []*GraphMessage{
+			{Name: "text_data", Dest: []*GraphDest{{ExtensionGroup: "default", Extension: "llm"}}},
+		}},
+		{ExtensionGroup: "default", Extension: "llm",
+			Cmd: []*GraphMessage{
+				{Name: "flush", Dest: []*GraphDest{{ExtensionGroup: "default", Extension: "tts"}}},
+			},
+			Data: []*GraphMessage{
+				{Name: "text_data", Dest: []*GraphDest{{ExtensionGroup: "default", Extension: "tts"}}},
+			},
+		},
+	}
+}
+
+// chdirTemp changes the working directory to a temp dir for the test, as the
+// agents files are read relative to it.
+func chdirTemp(t *testing.T) {
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// writeTestFile writes the file, creating its dir.
+func writeTestFile(t *testing.T, file string, content string) {
+	os.MkdirAll(filepath.Dir(file), 0755)
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestGraph writes the manifests of the addons of the test graph.
+func newTestGraph(t *testing.T) *Graph {
+	chdirTemp(t)
+	manifests := map[string]string{
+		"asr":  `{"api": {"data_out": [{"name": "text_data"}]}}`,
+		"llm":  `{"api": {"data_in": [{"name": "text_data"}], "data_out": [{"name": "text_data"}], "cmd_out": [{"name": "flush"}]}}`,
+		"tts":  `{"api": {"data_in": [{"name": "text_data"}]}}`,
+		"tts2": `{"api": {"data_in": [{"name": "text_data"}], "cmd_in": [{"name": "flush"}]}}`,
+	}
+	for addon, manifest := range manifests {
+		writeTestFile(t, fmt.Sprintf(ExtensionManifestFile, addon), manifest)
+	}
+
+	g := &Graph{Name: "test", Nodes: []*GraphNode{
+		{Type: graphNodeTypeExtensionGroup, Name: "default"},
+		{Type: graphNodeTypeExtension, Name: "asr", Addon: "asr", ExtensionGroup: "default"},
+		{Type: graphNodeTypeExtension, Name: "llm", Addon: "llm", ExtensionGroup: "default"},
+		{Type: graphNodeTypeExtension, Name: "tts", Addon: "tts", ExtensionGroup: "default"},
+	}}
+	g.setConnections(testGraphConnections())
+	g.updateAddons()
+	return g
+}
+
+func TestGraphValidate(t *testing.T) {
+	g := newTestGraph(t)
+
+	errs := g.validate()
+	want := []*GraphFieldError{
+		{Field: "connections.llm.cmd.flush.dest.tts", Reason: "flush not declared in cmd_in of addon tts"},
+	}
+	if !reflect.DeepEqual(errs, want) {
+		t.Fatalf("errs = %s, want %s", fieldErrorsString(errs), fieldErrorsString(want))
+	}
+}
+
+func TestGraphPatched(t *testing.T) {
+	tests := []struct {
+		name        string
+		patch       string
+		errs        []*GraphFieldError
+		addons      []string
+		connections string
+	}{
+		{
+			name:        "remove node",
+			patch:       `{"remove_nodes": ["tts"]}`,
+			errs:        []*GraphFieldError{},
+			addons:      []string{"asr", "llm"},
+			connections: `[{"extension_group":"default","extension":"asr","data":[{"name":"text_data","dest":[{"extension_group":"default","extension":"llm"}]}]}]`,
+		},
+		{
+			name:  "remove node not in graph",
+			patch: `{"remove_nodes": ["vad"]}`,
+			errs: []*GraphFieldError{
+				{Field: "graph_patch.remove_nodes.vad", Reason: "node not in graph"},
+			},
+			addons: []string{"asr", "llm", "tts"},
+		},
+		{
+			name:   "replace node",
+			patch:  `{"nodes": [{"replace": "tts", "name": "tts2", "addon": "tts2"}]}`,
+			errs:   []*GraphFieldError{},
+			addons: []string{"asr", "llm", "tts2"},
+			connections: `[{"extension_group":"default","extension":"asr","data":[{"name":"text_data","dest":[{"extension_group":"default","extension":"llm"}]}]},` +
+				`{"extension_group":"default","extension":"llm","cmd":[{"name":"flush","dest":[{"extension_group":"default","extension":"tts2"}]}],"data":[{"name":"text_data","dest":[{"extension_group":"default","extension":"tts2"}]}]}]`,
+		},
+		{
+			name:  "replace node not in graph",
+			patch: `{"nodes": [{"replace": "vad", "addon": "tts2"}]}`,
+			errs: []*GraphFieldError{
+				{Field: "graph_patch.nodes.tts2.replace", Reason: "node vad not in graph"},
+			},
+			addons: []string{"asr", "llm", "tts"},
+		},
+		{
+			name:  "add node not installed",
+			patch: `{"nodes": [{"addon": "vad"}]}`,
+			errs: []*GraphFieldError{
+				{Field: "nodes.vad", Reason: "addon vad not installed"},
+				{Field: "nodes.vad", Reason: "extension without extension group"},
+			},
+			addons: []string{"asr", "llm", "tts", "vad"},
+		},
+		{
+			name:  "connect extension not in graph",
+			patch: `{"connections": [{"extension": "asr", "data": [{"name": "text_data", "dest": [{"extension": "vad"}]}]}]}`,
+			errs: []*GraphFieldError{
+				{Field: "connections.asr.data.text_data.dest.vad", Reason: "extension not in graph"},
+			},
+			addons: []string{"asr", "llm", "tts"},
+		},
+		{
+			name:  "connect message not declared",
+			patch: `{"connections": [{"extension": "asr", "data": [{"name": "image", "dest": [{"extension": "llm"}]}]}]}`,
+			errs: []*GraphFieldError{
+				{Field: "connections.asr.data.image", Reason: "image not declared in data_out of addon asr"},
+				{Field: "connections.asr.data.image.dest.llm", Reason: "image not declared in data_in of addon llm"},
+			},
+			addons: []string{"asr", "llm", "tts"},
+		},
+		{
+			name:        "disconnect extension",
+			patch:       `{"connections": [{"extension": "llm"}]}`,
+			errs:        []*GraphFieldError{},
+			addons:      []string{"asr", "llm", "tts"},
+			connections: `[{"extension_group":"default","extension":"asr","data":[{"name":"text_data","dest":[{"extension_group":"default","extension":"llm"}]}]}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGraph(t)
+			predefined, _ := json.Marshal(g.Connections)
+
+			var patch GraphPatch
+			if err := json.Unmarshal([]byte(tt.patch), &patch); err != nil {
+				t.Fatal(err)
+			}
+			p, errs := g.patched(&patch)
+			if !reflect.DeepEqual(errs, tt.errs) {
+				t.Fatalf("errs = %s, want %s", fieldErrorsString(errs), fieldErrorsString(tt.errs))
+			}
+			if !reflect.DeepEqual(p.Addons, tt.addons) {
+				t.Fatalf("addons = %v, want %v", p.Addons, tt.addons)
+			}
+			if tt.connections != "" {
+				if connections, _ := json.Marshal(p.Connections); string(connections) != tt.connections {
+					t.Fatalf("connections = %s, want %s", connections, tt.connections)
+				}
+			}
+
+			// The predefined graph is kept as it is
+			if connections, _ := json.Marshal(g.Connections); string(connections) != string(predefined) {
+				t.Fatalf("predefined connections = %s, want %s", connections, predefined)
+			}
+		})
+	}
+}
+
+func TestRemoveGraphConnections(t *testing.T) {
+	tests := []struct {
+		extension   string
+		connections string
+	}{
+		{"asr", `[{"extension_group":"default","extension":"llm","cmd":[{"name":"flush","dest":[{"extension_group":"default","extension":"tts"}]}],"data":[{"name":"text_data","dest":[{"extension_group":"default","extension":"tts"}]}]}]`},
+		{"llm", `[]`},
+		{"vad", `[{"extension_group":"default","extension":"asr","data":[{"name":"text_data","dest":[{"extension_group":"default","extension":"llm"}]}]},` +
+			`{"extension_group":"default","extension":"llm","cmd":[{"name":"flush","dest":[{"extension_group":"default","extension":"tts"}]}],"data":[{"name":"text_data","dest":[{"extension_group":"default","extension":"tts"}]}]}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.extension, func(t *testing.T) {
+			connections, _ := json.Marshal(removeGraphConnections(testGraphConnections(), tt.extension))
+			if string(connections) != tt.connections {
+				t.Fatalf("connections = %s, want %s", connections, tt.connections)
+			}
+		})
+	}
+}
+
+func TestRenameGraphConnections(t *testing.T) {
+	connections := testGraphConnections()
+	renameGraphConnections(connections, "llm", &GraphNode{Name: "llm2", ExtensionGroup: "llm"})
+
+	got, _ := json.Marshal(connections)
+	want := `[{"extension_group":"default","extension":"asr","data":[{"name":"text_data","dest":[{"extension_group":"llm","extension":"llm2"}]}]},` +
+		`{"extension_group":"llm","extension":"llm2","cmd":[{"name":"flush","dest":[{"extension_group":"default","extension":"tts"}]}],"data":[{"name":"text_data","dest":[{"extension_group":"default","extension":"tts"}]}]}]`
+	if string(got) != want {
+		t.Fatalf("connections = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// GraphFieldError is an invalid field of a request starting a graph.
+type GraphFieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// Ranges of the integer types of the manifests
+var graphPropertyIntRanges = map[string][2]float64{
+	"int8":   {math.MinInt8, math.MaxInt8},
+	"int16":  {math.MinInt16, math.MaxInt16},
+	"int32":  {math.MinInt32, math.MaxInt32},
+	"int64":  {math.MinInt64, math.MaxInt64},
+	"uint8":  {0, math.MaxUint8},
+	"uint16": {0, math.MaxUint16},
+	"uint32": {0, math.MaxUint32},
+	"uint64": {0, math.MaxUint64},
+}
+
+// validateProperties checks the properties by extension name of /start
+// against the graph. Every extension must be a node of the graph, and every
+// property must be declared by the manifest of its addon with the value of
+// its type. Without a manifest any property is allowed, and a property of
+// property.json must keep the kind of its value there.
+func (g *Graph) validateProperties(properties map[string]map[string]any) []*GraphFieldError {
+	errs := []*GraphFieldError{}
+
+	for _, extensionName := range sortedKeys(properties) {
+		node := g.extension(extensionName)
+		if node == nil {
+			errs = append(errs, &GraphFieldError{
+				Field:  fmt.Sprintf("properties.%s", extensionName),
+				Reason: fmt.Sprintf("extension not in graph %s", g.Name),
+			})
+			continue
+		}
+
+		var defaults map[string]any
+		json.Unmarshal(node.Property, &defaults)
+
+		props := properties[extensionName]
+		for _, name := range sortedKeys(props) {
+			field := fmt.Sprintf("properties.%s.%s", extensionName, name)
+			value := props[name]
+
+			if node.propertyTypes == nil {
+				if def, ok := defaults[name]; ok && def != nil && jsonKind(def) != jsonKind(value) {
+					errs = append(errs, &GraphFieldError{Field: field, Reason: fmt.Sprintf("expected %s, got %s", jsonKind(def), jsonKind(value))})
+				}
+				continue
+			}
+
+			typ, ok := node.propertyTypes[name]
+			if !ok {
+				if !isStartProp(extensionName, name) {
+					errs = append(errs, &GraphFieldError{Field: field, Reason: fmt.Sprintf("property not declared by addon %s", node.Addon)})
+				}
+				continue
+			}
+			if reason := validatePropertyValue(typ, value); reason != "" {
+				errs = append(errs, &GraphFieldError{Field: field, Reason: reason})
+			}
+		}
+	}
+
+	return errs
+}
+
+// extension returns the extension node of the name, nil if not found.
+func (g *Graph) extension(name string) *GraphNode {
+	for _, node := range g.Nodes {
+		if node.Type == graphNodeTypeExtension && node.Name == name {
+			return node
+		}
+	}
+	return nil
+}
+
+// validatePropertyValue returns why the JSON value is not of the manifest
+// type, empty if it is.
+func validatePropertyValue(typ string, value any) string {
+	if value == nil {
+		return fmt.Sprintf("expected %s, got null", typ)
+	}
+
+	switch typ {
+	case "bool":
+		if _, ok := value.(bool); !ok {
+			return fmt.Sprintf("expected bool, got %s", jsonKind(value))
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Sprintf("expected string, got %s", jsonKind(value))
+		}
+	case "float32", "float64":
+		v, ok := value.(float64)
+		if !ok {
+			return fmt.Sprintf("expected %s, got %s", typ, jsonKind(value))
+		}
+		if typ == "float32" && math.Abs(v) > math.MaxFloat32 {
+			return fmt.Sprintf("%v out of range of %s", v, typ)
+		}
+	case "int8", "int16", "int32", "int64", "uint8", "uint16", "uint32", "uint64":
+		v, ok := value.(float64)
+		if !ok {
+			return fmt.Sprintf("expected %s, got %s", typ, jsonKind(value))
+		}
+		if v != math.Trunc(v) {
+			return fmt.Sprintf("expected %s, got %v", typ, v)
+		}
+		if r := graphPropertyIntRanges[typ]; v < r[0] || v > r[1] {
+			return fmt.Sprintf("%v out of range of %s", v, typ)
+		}
+	case "object":
+		if _, ok := value.(map[string]any); !ok {
+			return fmt.Sprintf("expected object, got %s", jsonKind(value))
+		}
+	case "array":
+		if _, ok := value.([]any); !ok {
+			return fmt.Sprintf("expected array, got %s", jsonKind(value))
+		}
+	default:
+		return fmt.Sprintf("type %s can't be set by a request", typ)
+	}
+	return ""
+}
+
+// jsonKind returns the JSON kind of the decoded value.
+func jsonKind(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// isStartProp checks whether the property of the extension is set by the server on /start.
+func isStartProp(extensionName string, property string) bool {
+	for _, props := range startPropMap {
+		for _, prop := range props {
+			if prop.ExtensionName == extensionName && prop.Property == property {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
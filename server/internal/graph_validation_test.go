@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestValidatePropertyValue(t *testing.T) {
+	tests := []struct {
+		typ    string
+		value  any
+		reason string
+	}{
+		{"bool", true, ""},
+		{"bool", "true", "expected bool, got string"},
+		{"string", "gpt-4o", ""},
+		{"string", 1.0, "expected string, got number"},
+		{"string", nil, "expected string, got null"},
+		{"float64", 0.5, ""},
+		{"float64", "0.5", "expected float64, got string"},
+		{"float32", 1e39, "1e+39 out of range of float32"},
+		{"int64", 512.0, ""},
+		{"int64", "512", "expected int64, got string"},
+		{"int64", 0.5, "expected int64, got 0.5"},
+		{"int8", 128.0, "128 out of range of int8"},
+		{"uint32", -1.0, "-1 out of range of uint32"},
+		{"object", map[string]any{"a": 1.0}, ""},
+		{"object", []any{}, "expected object, got array"},
+		{"array", []any{"a"}, ""},
+		{"array", map[string]any{}, "expected array, got object"},
+		{"buf", "", "type buf can't be set by a request"},
+	}
+
+	for _, tt := range tests {
+		if reason := validatePropertyValue(tt.typ, tt.value); reason != tt.reason {
+			t.Errorf("validatePropertyValue(%s, %v) = %q, want %q", tt.typ, tt.value, reason, tt.reason)
+		}
+	}
+}
+
+func TestValidateProperties(t *testing.T) {
+	graph := &Graph{
+		Name: "va.openai.azure",
+		Nodes: []*GraphNode{
+			{
+				Type:          graphNodeTypeExtension,
+				Name:          extensionNameAgoraRTC,
+				Addon:         "agora_rtc",
+				propertyTypes: map[string]string{"agora_asr_language": "string"},
+			},
+			{
+				Type:          graphNodeTypeExtension,
+				Name:          "openai_chatgpt",
+				Addon:         "openai_chatgpt",
+				propertyTypes: map[string]string{"model": "string", "max_tokens": "int64"},
+			},
+			{
+				Type:     graphNodeTypeExtension,
+				Name:     "azure_tts",
+				Addon:    "azure_tts",
+				Property: json.RawMessage(`{"azure_synthesis_voice_name": "en-US-JaneNeural", "volume": null}`),
+			},
+			{Type: "extension_group", Name: "default"},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		properties map[string]map[string]any
+		errs       []*GraphFieldError
+	}{
+		{"valid", map[string]map[string]any{
+			"openai_chatgpt": {"model": "gpt-4o", "max_tokens": 512.0},
+			"azure_tts":      {"azure_synthesis_voice_name": "zh-CN-XiaoxiaoNeural", "volume": 1.0, "rate": 1.0},
+		}, []*GraphFieldError{}},
+		{"property set on start", map[string]map[string]any{
+			extensionNameAgoraRTC: {"channel": "test", "agora_asr_language": "en-US"},
+		}, []*GraphFieldError{}},
+		{"extension not in graph", map[string]map[string]any{
+			"openai_v2v_python": {"model": "gpt-4o"},
+			"default":           {"model": "gpt-4o"},
+		}, []*GraphFieldError{
+			{Field: "properties.default", Reason: "extension not in graph va.openai.azure"},
+			{Field: "properties.openai_v2v_python", Reason: "extension not in graph va.openai.azure"},
+		}},
+		{"property not declared", map[string]map[string]any{
+			"openai_chatgpt": {"greting": "hi"},
+		}, []*GraphFieldError{
+			{Field: "properties.openai_chatgpt.greting", Reason: "property not declared by addon openai_chatgpt"},
+		}},
+		{"wrong types", map[string]map[string]any{
+			"openai_chatgpt": {"model": "gpt-4o", "max_tokens": "512"},
+			"azure_tts":      {"azure_synthesis_voice_name": 1.0},
+		}, []*GraphFieldError{
+			{Field: "properties.azure_tts.azure_synthesis_voice_name", Reason: "expected string, got number"},
+			{Field: "properties.openai_chatgpt.max_tokens", Reason: "expected int64, got string"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := graph.validateProperties(tt.properties)
+			if !reflect.DeepEqual(errs, tt.errs) {
+				t.Fatalf("errs = %s, want %s", fieldErrorsString(errs), fieldErrorsString(tt.errs))
+			}
+		})
+	}
+}
+
+func fieldErrorsString(errs []*GraphFieldError) string {
+	content, _ := json.Marshal(errs)
+	return string(content)
+}
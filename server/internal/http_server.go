@@ -8,17 +8,21 @@
 package internal
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
-	rtctokenbuilder "github.com/AgoraIO/Tools/DynamicKey/AgoraDynamicKey/go/src/rtctokenbuilder2"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"github.com/gogf/gf/crypto/gmd5"
@@ -31,14 +35,42 @@ type HttpServer struct {
 }
 
 type HttpServerConfig struct {
-	AppId                    string
-	AppCertificate           string
-	LogPath                  string
-	Log2Stdout               bool
-	PropertyJsonFile         string
-	Port                     string
-	WorkersMax               int
-	WorkerQuitTimeoutSeconds int
+	AppId                     string
+	AppCertificate            string
+	LogPath                   string
+	Log2Stdout                bool
+	PropertyJsonFile          string
+	Port                      string
+	WorkersMax                int
+	WorkerQuitTimeoutSeconds  int
+	WorkerStartTimeoutSeconds int
+	WorkerReadyPattern        *regexp.Regexp
+	WorkerStopDrainSeconds    int
+	WorkerStopTimeoutSeconds  int
+	WorkerLogBufferLines      int
+	WorkerRuntimes            map[string]*WorkerRuntimeConfig // by graph name
+	WorkerHttpServerPortMin   int
+	WorkerHttpServerPortMax   int
+	ServerMode                string
+	CoordinatorUrl            string // node mode only
+	NodeId                    string // node mode only
+	NodeUrl                   string // node mode only, the url the coordinator reaches this node at
+	NodeHeartbeatSeconds      int
+	NodeAuthKey               string // node mode only, the key signing the heartbeats
+	Authenticator             Authenticator
+	CorsAllowOrigins          []string
+	TenantQuotas              map[string]*TenantQuota // by tenant
+	SecretsProvider           SecretsProvider         // nil if the workers resolve the secrets from their environment
+	SecretsEnvFallback        []string                // secrets read from the environment of the server if the provider doesn't have them
+	Retention                 *Retention
+	UploadMaxBytes            int64
+	UploadAllowedTypes        []string
+	CatalogFile               string
+	CatalogPresets            []*CatalogCollection // seeded into the catalog if it doesn't exist
+	TokenExpireSeconds        uint32
+	TokenExpireSecondsMin     uint32
+	TokenExpireSecondsMax     uint32
+	TokenRefreshBeforeSeconds uint32
 }
 
 type PingReq struct {
@@ -55,7 +87,12 @@ type StartReq struct {
 	Token                string                            `json:"token,omitempty"`
 	WorkerHttpServerPort int32                             `json:"worker_http_server_port,omitempty"`
 	Properties           map[string]map[string]interface{} `json:"properties,omitempty"`
+	GraphPatch           *GraphPatch                       `json:"graph_patch,omitempty"`
+	Collection           string                            `json:"collection,omitempty"`
 	QuitTimeoutSeconds   int                               `json:"timeout,omitempty"`
+	RestartPolicy        *WorkerRestartPolicy              `json:"restart_policy,omitempty"`
+
+	tokenExpireTs int64 // of the token generated for the worker, zero if it doesn't expire
 }
 
 type StopReq struct {
@@ -64,9 +101,26 @@ type StopReq struct {
 }
 
 type GenerateTokenReq struct {
-	RequestId   string `json:"request_id,omitempty"`
-	ChannelName string `json:"channel_name,omitempty"`
-	Uid         uint32 `json:"uid,omitempty"`
+	RequestId              string            `json:"request_id,omitempty"`
+	ChannelName            string            `json:"channel_name,omitempty"`
+	Uid                    uint32            `json:"uid,omitempty"`
+	Account                string            `json:"account,omitempty"` // string account, instead of the uid
+	Role                   string            `json:"role,omitempty"`
+	ExpireSeconds          uint32            `json:"expire_seconds,omitempty"`
+	PrivilegeExpireSeconds map[string]uint32 `json:"privilege_expire_seconds,omitempty"` // by privilege, the token expire by default
+	Rtm                    bool              `json:"rtm,omitempty"`                      // also a RTM token of the uid or account
+}
+
+type WorkersReq struct {
+	ChannelName string `form:"channel_name,omitempty"`
+	GraphName   string `form:"graph_name,omitempty"`
+	Offset      int    `form:"offset,omitempty" binding:"min=0"`
+	Limit       int    `form:"limit,omitempty" binding:"min=0,max=1000"`
+}
+
+type WorkerLogsReq struct {
+	Tail   int  `form:"tail,omitempty" binding:"min=0,max=10000"`
+	Follow bool `form:"follow,omitempty"`
 }
 
 type VectorDocumentUpdate struct {
@@ -83,6 +137,25 @@ type VectorDocumentUpload struct {
 }
 
 func NewHttpServer(httpServerConfig *HttpServerConfig) *HttpServer {
+	workersStore = newWorkerStore(filepath.Join(httpServerConfig.LogPath, workerStoreFile))
+	if httpServerConfig.CatalogFile == "" {
+		httpServerConfig.CatalogFile = filepath.Join(httpServerConfig.LogPath, catalogFile)
+	}
+	collectionsCatalog = newCollectionCatalog(httpServerConfig.CatalogFile)
+	if len(httpServerConfig.CatalogPresets) > 0 {
+		if seeded, err := collectionsCatalog.seed(httpServerConfig.CatalogPresets); err != nil {
+			slog.Error("seed catalog failed", "err", err, "catalogFile", httpServerConfig.CatalogFile, logTag)
+		} else if seeded {
+			slog.Info("seed catalog", "collections", len(httpServerConfig.CatalogPresets), "catalogFile", httpServerConfig.CatalogFile, logTag)
+		}
+	}
+	workerReadyPattern = httpServerConfig.WorkerReadyPattern
+	httpServerPorts.setRange(int32(httpServerConfig.WorkerHttpServerPortMin), int32(httpServerConfig.WorkerHttpServerPortMax))
+	quotas.setQuotas(httpServerConfig.TenantQuotas)
+	if err := os.MkdirAll(agentMetricsSocketDir, 0700); err != nil {
+		slog.Error("create metrics socket dir failed", "err", err, "dir", agentMetricsSocketDir, logTag)
+	}
+
 	return &HttpServer{
 		config: httpServerConfig,
 	}
@@ -96,12 +169,16 @@ func (s *HttpServer) handlerHealth(c *gin.Context) {
 func (s *HttpServer) handlerList(c *gin.Context) {
 	slog.Info("handlerList start", logTag)
 	// Create a slice of maps to hold the filtered data
-	filtered := make([]map[string]interface{}, len(workers.Keys()))
+	filtered := make([]map[string]interface{}, 0, workers.Size())
 	for _, channelName := range workers.Keys() {
 		worker := workers.Get(channelName).(*Worker)
+		if !canAccess(c, worker.Tenant) {
+			continue
+		}
 		workerJson := map[string]interface{}{
-			"channelName": worker.ChannelName,
-			"createTs":    worker.CreateTs,
+			"channelName":  worker.ChannelName,
+			"createTs":     worker.CreateTs,
+			"restartCount": worker.RestartCount,
 		}
 		filtered = append(filtered, workerJson)
 	}
@@ -109,6 +186,187 @@ func (s *HttpServer) handlerList(c *gin.Context) {
 	s.output(c, codeSuccess, filtered)
 }
 
+func (s *HttpServer) handlerWorkers(c *gin.Context) {
+	var req WorkersReq
+
+	if err := c.ShouldBindQuery(&req); err != nil {
+		slog.Error("handlerWorkers params invalid", "err", err, logTag)
+		s.output(c, codeErrParamsInvalid, nil, http.StatusBadRequest)
+		return
+	}
+
+	if req.Limit == 0 {
+		req.Limit = workersPageLimit
+	}
+
+	slog.Info("handlerWorkers start", "req", req, logTag)
+
+	list := []*Worker{}
+	for _, v := range workers.Values() {
+		worker := v.(*Worker)
+		if !canAccess(c, worker.Tenant) {
+			continue
+		}
+		if req.GraphName != "" && worker.GraphName != req.GraphName {
+			continue
+		}
+		if req.ChannelName != "" && !strings.HasPrefix(worker.ChannelName, req.ChannelName) {
+			continue
+		}
+		list = append(list, worker)
+	}
+
+	// Sort by create time, so that pages are stable
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreateTs != list[j].CreateTs {
+			return list[i].CreateTs < list[j].CreateTs
+		}
+		return list[i].ChannelName < list[j].ChannelName
+	})
+
+	// The offset is clamped first, so that adding the limit can't overflow
+	total := len(list)
+	offset := min(req.Offset, total)
+	list = list[offset : offset+min(req.Limit, total-offset)]
+
+	stats := getProcessGroupsStats()
+	infos := make([]*WorkerInfo, 0, len(list))
+	for _, worker := range list {
+		infos = append(infos, worker.info(worker.stats(stats)))
+	}
+
+	slog.Info("handlerWorkers end", "total", total, logTag)
+	s.output(c, codeSuccess, map[string]any{"total": total, "offset": req.Offset, "limit": req.Limit, "workers": infos})
+}
+
+func (s *HttpServer) handlerWorker(c *gin.Context) {
+	channelName := c.Param("channel")
+
+	worker := tenantWorker(c, channelName)
+	if worker == nil {
+		slog.Error("handlerWorker channel not existed", "channelName", channelName, logTag)
+		s.output(c, codeErrChannelNotExisted, nil, http.StatusBadRequest)
+		return
+	}
+
+	s.output(c, codeSuccess, worker.info(worker.stats(nil)))
+}
+
+func (s *HttpServer) handlerWorkerLogs(c *gin.Context) {
+	channelName := c.Param("channel")
+
+	var req WorkerLogsReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		slog.Error("handlerWorkerLogs params invalid", "err", err, "channelName", channelName, logTag)
+		s.output(c, codeErrParamsInvalid, nil, http.StatusBadRequest)
+		return
+	}
+
+	if req.Tail == 0 {
+		req.Tail = logTailDefault
+	}
+
+	worker := findWorker(channelName)
+	if worker == nil || !canAccess(c, worker.Tenant) {
+		slog.Error("handlerWorkerLogs channel not existed", "channelName", channelName, logTag)
+		s.output(c, codeErrChannelNotExisted, nil, http.StatusBadRequest)
+		return
+	}
+
+	slog.Info("handlerWorkerLogs start", "channelName", channelName, "req", req, logTag)
+
+	// Read the tail first, so that errors can still be reported as json
+	var lines []string
+	var seq, offset int64
+	if worker.Log2Stdout {
+		if worker.logRing == nil {
+			slog.Error("handlerWorkerLogs no log buffer", "channelName", channelName, logTag)
+			s.output(c, codeErrReadWorkerLogFailed, nil, http.StatusNotFound)
+			return
+		}
+		lines, seq = worker.logRing.tail(req.Tail)
+	} else {
+		var err error
+		if lines, offset, err = tailLogFile(worker.LogFile, req.Tail); err != nil {
+			slog.Error("handlerWorkerLogs read log file failed", "err", err, "channelName", channelName, "logFile", worker.LogFile, logTag)
+			s.output(c, codeErrReadWorkerLogFailed, nil, http.StatusNotFound)
+			return
+		}
+	}
+
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	for _, line := range lines {
+		fmt.Fprintln(c.Writer, line)
+	}
+	c.Writer.Flush()
+
+	if !req.Follow {
+		return
+	}
+
+	// Follow until the worker exits and its logs are drained, or the client leaves
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-time.After(logFollowSleepMs * time.Millisecond):
+		}
+
+		exited := worker.hasExited()
+		if worker.Log2Stdout {
+			lines, seq = worker.logRing.since(seq)
+			for _, line := range lines {
+				fmt.Fprintln(w, line)
+			}
+			return !exited || len(lines) > 0
+		}
+
+		content, next, err := readLogFile(worker.LogFile, offset)
+		if err != nil {
+			slog.Error("handlerWorkerLogs follow log file failed", "err", err, "channelName", channelName, "logFile", worker.LogFile, logTag)
+			return false
+		}
+		w.Write(content)
+		offset = next
+		return !exited || len(content) > 0
+	})
+
+	slog.Info("handlerWorkerLogs end", "channelName", channelName, logTag)
+}
+
+func (s *HttpServer) handlerEvents(c *gin.Context) {
+	channelName := c.Query("channel_name")
+
+	slog.Info("handlerEvents start", "channelName", channelName, logTag)
+
+	events := workerEvents.subscribe()
+	defer workerEvents.unsubscribe(events)
+
+	keepalive := time.NewTicker(eventKeepaliveSeconds * time.Second)
+	defer keepalive.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-events:
+			if (channelName == "" || channelName == event.ChannelName) && canAccess(c, event.tenant) {
+				c.SSEvent(event.Type, event)
+			}
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+
+	slog.Info("handlerEvents end", "channelName", channelName, logTag)
+}
+
 func (s *HttpServer) handlerPing(c *gin.Context) {
 	var req PingReq
 
@@ -126,26 +384,40 @@ func (s *HttpServer) handlerPing(c *gin.Context) {
 		return
 	}
 
-	if !workers.Contains(req.ChannelName) {
+	worker := tenantWorker(c, req.ChannelName)
+	if worker == nil {
 		slog.Error("handlerPing channel not existed", "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
 		s.output(c, codeErrChannelNotExisted, http.StatusBadRequest)
 		return
 	}
 
-	// Update worker
-	worker := workers.Get(req.ChannelName).(*Worker)
+	// Update worker, saved by the next timeout check as pings are frequent
 	worker.UpdateTs = time.Now().Unix()
+	workersStore.touch()
 
 	slog.Info("handlerPing end", "worker", worker, "requestId", req.RequestId, logTag)
 	s.output(c, codeSuccess, nil)
 }
 
+// workerRuntimeConfig returns the runtime config of the graph, nil means the
+// process runtime.
+func (s *HttpServer) workerRuntimeConfig(graphName string) *WorkerRuntimeConfig {
+	if config, ok := s.config.WorkerRuntimes[graphName]; ok {
+		return config
+	}
+	return s.config.WorkerRuntimes[workerRuntimeDefaultGraph]
+}
+
 func (s *HttpServer) handlerStart(c *gin.Context) {
-	workersRunning := workers.Size()
+	startTime := time.Now()
 
-	slog.Info("handlerStart start", "workersRunning", workersRunning, logTag)
+	slog.Info("handlerStart start", "workersRunning", workers.Size(), logTag)
 
 	var req StartReq
+	graphLabel := metricLabelUnknown
+	defer func() {
+		metricStartDuration.observe(time.Since(startTime).Seconds(), graphLabel, c.GetString(outputCodeContextKey))
+	}()
 	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
 		slog.Error("handlerStart params invalid", "err", err, "requestId", req.RequestId, logTag)
 		s.output(c, codeErrParamsInvalid, http.StatusBadRequest)
@@ -158,41 +430,187 @@ func (s *HttpServer) handlerStart(c *gin.Context) {
 		return
 	}
 
-	if workersRunning >= s.config.WorkersMax {
-		slog.Error("handlerStart workers exceed", "workersRunning", workersRunning, "WorkersMax", s.config.WorkersMax, "requestId", req.RequestId, logTag)
-		s.output(c, codeErrWorkersLimit, http.StatusTooManyRequests)
+	graph, err := findGraph(req.GraphName)
+	if err != nil {
+		slog.Error("handlerStart load graphs failed", "err", err, "requestId", req.RequestId, logTag)
+		s.output(c, codeErrReadGraphsFailed, nil, http.StatusInternalServerError)
+		return
+	}
+	if graph == nil {
+		slog.Error("handlerStart graph not found", "graph", req.GraphName, "requestId", req.RequestId, logTag)
+		s.output(c, codeErrGraphNotFound, nil, http.StatusBadRequest)
+		return
+	}
+	graphLabel = graph.Name
+
+	if req.GraphPatch != nil {
+		var errs []*GraphFieldError
+		if graph, errs = graph.patched(req.GraphPatch); len(errs) > 0 {
+			slog.Error("handlerStart graph patch invalid", "graph", req.GraphName, "errors", errs, "requestId", req.RequestId, logTag)
+			s.output(c, codeErrGraphPatchInvalid, map[string]any{"errors": errs}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Overrides the agent can't read would leave it started but mute
+	if errs := graph.validateProperties(req.Properties); len(errs) > 0 {
+		slog.Error("handlerStart properties invalid", "graph", req.GraphName, "errors", errs, "requestId", req.RequestId, logTag)
+		s.output(c, codeErrPropertiesInvalid, map[string]any{"errors": errs}, http.StatusBadRequest)
 		return
 	}
 
-	if workers.Contains(req.ChannelName) {
+	// The collection is queried by the llama_index extension from the start
+	if req.Collection != "" {
+		if graph.propertyPath(extensionNameLlamaIndex, "collection") == "" {
+			errs := []*GraphFieldError{{Field: "collection", Reason: fmt.Sprintf("extension %s not in graph", extensionNameLlamaIndex)}}
+			slog.Error("handlerStart collection not queried", "graph", req.GraphName, "collection", req.Collection, "requestId", req.RequestId, logTag)
+			s.output(c, codeErrPropertiesInvalid, map[string]any{"errors": errs}, http.StatusBadRequest)
+			return
+		}
+		if !s.outputCollectionFound(c, req.Collection) {
+			return
+		}
+	}
+
+	if req.RestartPolicy != nil {
+		if err := req.RestartPolicy.validate(); err != nil {
+			slog.Error("handlerStart restart policy invalid", "err", err, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
+			s.output(c, codeErrParamsInvalid, nil, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The channel is reserved until the worker is registered, as starting it
+	// waits for its readiness. The workers being started count in the limits
+	tenant := requestTenant(c)
+	err = reserveWorker(req.ChannelName, tenant, func(running []*Worker, starting []string) error {
+		if len(running)+len(starting) >= s.config.WorkersMax {
+			return errWorkersLimit
+		}
+
+		// The coordinator enforces the other quotas of the starts it places
+		if s.config.ServerMode == ServerModeNode {
+			return quotas.admitNodeStart(tenant, tenantWorkers(running, tenant))
+		}
+		tenantStarting := 0
+		for _, t := range starting {
+			if t == tenant {
+				tenantStarting++
+			}
+		}
+		return quotas.admitStart(tenant, tenantWorkers(running, tenant), tenantStarting)
+	})
+	var quotaErr *quotaExceededError
+	switch {
+	case errors.Is(err, errWorkerChannelExisted):
 		slog.Error("handlerStart channel existed", "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
 		s.output(c, codeErrChannelExisted, http.StatusBadRequest)
 		return
+	case errors.Is(err, errWorkersLimit):
+		slog.Error("handlerStart workers exceed", "WorkersMax", s.config.WorkersMax, "requestId", req.RequestId, logTag)
+		s.output(c, codeErrWorkersLimit, http.StatusTooManyRequests)
+		return
+	case errors.As(err, &quotaErr):
+		slog.Error("handlerStart tenant quota exceeded", "err", err, "tenant", tenant, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
+		s.outputQuotaExceeded(c, quotaErr)
+		return
+	}
+	defer releaseWorker(req.ChannelName)
+
+	// A start which failed doesn't count in the rate of the tenant
+	started := false
+	defer func() {
+		if !started {
+			quotas.refundStart(tenant)
+		}
+	}()
+
+	port, err := httpServerPorts.lease(req.ChannelName)
+	if err != nil {
+		slog.Error("handlerStart lease port failed", "err", err, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
+		s.output(c, codeErrNoPortAvailable, nil, http.StatusServiceUnavailable)
+		return
 	}
 
-	req.WorkerHttpServerPort = getHttpServerPort()
-	propertyJsonFile, logFile, err := s.processProperty(&req)
+	// The port is released when the worker is removed once started
+	defer func() {
+		if !started {
+			httpServerPorts.release(port, req.ChannelName)
+		}
+	}()
+
+	req.WorkerHttpServerPort = port
+	propertyJsonFile, logFile, err := s.processProperty(&req, graph, tenant)
 	if err != nil {
-		slog.Error("handlerStart process property", "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
+		slog.Error("handlerStart process property", "err", err, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
+
+		var secretsErr *secretsError
+		if errors.As(err, &secretsErr) {
+			s.output(c, codeErrSecretsNotFound, map[string]any{"errors": secretsErr.errs}, http.StatusBadRequest)
+			return
+		}
+
 		s.output(c, codeErrProcessPropertyFailed, http.StatusInternalServerError)
 		return
 	}
 
+	// The secrets must not outlive a worker which failed to start
+	defer func() {
+		if !started && s.config.SecretsProvider != nil {
+			os.Remove(propertyJsonFile)
+		}
+	}()
+
 	worker := newWorker(req.ChannelName, logFile, s.config.Log2Stdout, propertyJsonFile)
+	worker.GraphName = req.GraphName
+	worker.Tenant = tenant
+	worker.Runtime = s.workerRuntimeConfig(req.GraphName)
+	if worker.runtime, err = newWorkerRuntime(worker.Runtime); err != nil {
+		slog.Error("handlerStart create worker runtime failed", "err", err, "runtime", worker.Runtime, "requestId", req.RequestId, logTag)
+		s.output(c, codeErrStartWorkerFailed, nil, http.StatusInternalServerError)
+		return
+	}
+	worker.RestartPolicy = req.RestartPolicy
+	// The token is only refreshed for the graphs joining the channel
+	if graph.propertyPath(extensionNameAgoraRTC, "token") != "" {
+		worker.TokenExpireTs = req.tokenExpireTs
+	}
+	worker.SecretsResolved = s.config.SecretsProvider != nil
+	if s.config.Log2Stdout {
+		worker.logRing = newLogRing(s.config.WorkerLogBufferLines)
+	}
 	worker.HttpServerPort = req.WorkerHttpServerPort
+	worker.TracesFile = strings.TrimSuffix(logFile, ".log") + ".traces.jsonl"
+	worker.TranscriptFile = transcriptFile(logFile)
+	worker.MetricsSocket = agentMetricsSocket(req.ChannelName)
 
 	if req.QuitTimeoutSeconds > 0 {
 		worker.QuitTimeoutSeconds = req.QuitTimeoutSeconds
 	} else {
 		worker.QuitTimeoutSeconds = s.config.WorkerQuitTimeoutSeconds
 	}
+	worker.StartTimeoutSeconds = s.config.WorkerStartTimeoutSeconds
+	worker.StopDrainSeconds = s.config.WorkerStopDrainSeconds
+	worker.StopTimeoutSeconds = s.config.WorkerStopTimeoutSeconds
 
+	workerEvents.publishTenant(worker.Tenant, workerEventStarting, req.ChannelName, map[string]any{"request_id": req.RequestId, "graph_name": req.GraphName, "http_server_port": worker.HttpServerPort})
 	if err := worker.start(&req); err != nil {
 		slog.Error("handlerStart start worker failed", "err", err, "requestId", req.RequestId, logTag)
+
+		var notReadyErr *workerNotReadyError
+		if errors.As(err, &notReadyErr) {
+			s.output(c, codeErrWorkerNotReady, map[string]any{"reason": notReadyErr.reason, "log": notReadyErr.log}, http.StatusInternalServerError)
+			return
+		}
+
 		s.output(c, codeErrStartWorkerFailed, http.StatusInternalServerError)
 		return
 	}
-	workers.SetIfNotExist(req.ChannelName, worker)
+	started = true
+	registerWorker(worker)
+	workersStore.save()
+	workerEvents.publish(workerEventStarted, req.ChannelName, map[string]any{"request_id": req.RequestId, "pid": worker.Pid})
+	metricWorkerStarts.add(1, worker.GraphName)
 
 	slog.Info("handlerStart end", "workersRunning", workers.Size(), "worker", worker, "requestId", req.RequestId, logTag)
 	s.output(c, codeSuccess, nil)
@@ -215,69 +633,32 @@ func (s *HttpServer) handlerStop(c *gin.Context) {
 		return
 	}
 
-	if !workers.Contains(req.ChannelName) {
+	worker := tenantWorker(c, req.ChannelName)
+	if worker == nil {
 		slog.Error("handlerStop channel not existed", "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
 		s.output(c, codeErrChannelNotExisted, http.StatusBadRequest)
 		return
 	}
 
-	worker := workers.Get(req.ChannelName).(*Worker)
-	if err := worker.stop(req.RequestId, req.ChannelName); err != nil {
-		slog.Error("handlerStop kill app failed", "err", err, "worker", workers.Get(req.ChannelName), "requestId", req.RequestId, logTag)
-		s.output(c, codeErrStopWorkerFailed, http.StatusInternalServerError)
+	stages, err := worker.stop(req.RequestId, req.ChannelName)
+	if err != nil {
+		slog.Error("handlerStop kill app failed", "err", err, "worker", worker, "requestId", req.RequestId, logTag)
+		s.output(c, codeErrStopWorkerFailed, map[string]any{"stages": stages}, http.StatusInternalServerError)
 		return
 	}
 
 	slog.Info("handlerStop end", "requestId", req.RequestId, logTag)
-	s.output(c, codeSuccess, nil)
+	s.output(c, codeSuccess, map[string]any{"stages": stages})
 }
 
-func (s *HttpServer) handlerGenerateToken(c *gin.Context) {
-	var req GenerateTokenReq
-
-	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
-		slog.Error("handlerGenerateToken params invalid", "err", err, logTag)
-		s.output(c, codeErrParamsInvalid, http.StatusBadRequest)
-		return
-	}
-
-	slog.Info("handlerGenerateToken start", "req", req, logTag)
-
-	if strings.TrimSpace(req.ChannelName) == "" {
-		slog.Error("handlerGenerateToken channel empty", "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
-		s.output(c, codeErrChannelEmpty, http.StatusBadRequest)
-		return
-	}
-
-	if s.config.AppCertificate == "" {
-		s.output(c, codeSuccess, map[string]any{"appId": s.config.AppId, "token": s.config.AppId, "channel_name": req.ChannelName, "uid": req.Uid})
-		return
-	}
-
-	token, err := rtctokenbuilder.BuildTokenWithUid(s.config.AppId, s.config.AppCertificate, req.ChannelName, req.Uid, rtctokenbuilder.RolePublisher, tokenExpirationInSeconds, tokenExpirationInSeconds)
+func (s *HttpServer) handlerVectorDocumentPresetList(c *gin.Context) {
+	presetList, err := tenantCollections(c)
 	if err != nil {
-		slog.Error("handlerGenerateToken generate token failed", "err", err, "requestId", req.RequestId, logTag)
-		s.output(c, codeErrGenerateTokenFailed, http.StatusBadRequest)
+		slog.Error("handlerVectorDocumentPresetList read catalog failed", "err", err, logTag)
+		s.output(c, codeErrCatalogFailed, nil, http.StatusInternalServerError)
 		return
 	}
 
-	slog.Info("handlerGenerateToken end", "requestId", req.RequestId, logTag)
-	s.output(c, codeSuccess, map[string]any{"appId": s.config.AppId, "token": token, "channel_name": req.ChannelName, "uid": req.Uid})
-}
-
-func (s *HttpServer) handlerVectorDocumentPresetList(c *gin.Context) {
-	presetList := []map[string]any{}
-	vectorDocumentPresetList := os.Getenv("VECTOR_DOCUMENT_PRESET_LIST")
-
-	if vectorDocumentPresetList != "" {
-		err := json.Unmarshal([]byte(vectorDocumentPresetList), &presetList)
-		if err != nil {
-			slog.Error("handlerVectorDocumentPresetList parse json failed", "err", err, logTag)
-			s.output(c, codeErrParseJsonFailed, http.StatusBadRequest)
-			return
-		}
-	}
-
 	s.output(c, codeSuccess, presetList)
 }
 
@@ -290,7 +671,8 @@ func (s *HttpServer) handlerVectorDocumentUpdate(c *gin.Context) {
 		return
 	}
 
-	if !workers.Contains(req.ChannelName) {
+	worker := tenantWorker(c, req.ChannelName)
+	if worker == nil {
 		slog.Error("handlerVectorDocumentUpdate channel not existed", "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
 		s.output(c, codeErrChannelNotExisted, http.StatusBadRequest)
 		return
@@ -299,7 +681,6 @@ func (s *HttpServer) handlerVectorDocumentUpdate(c *gin.Context) {
 	slog.Info("handlerVectorDocumentUpdate start", "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
 
 	// update worker
-	worker := workers.Get(req.ChannelName).(*Worker)
 	err := worker.update(&WorkerUpdateReq{
 		RequestId:   req.RequestId,
 		ChannelName: req.ChannelName,
@@ -325,11 +706,16 @@ func (s *HttpServer) handlerVectorDocumentUpload(c *gin.Context) {
 
 	if err := c.ShouldBind(&req); err != nil {
 		slog.Error("handlerVectorDocumentUpload params invalid", "err", err, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
-		s.output(c, codeErrParamsInvalid, http.StatusBadRequest)
+		if s.outputBodyTooLarge(c, err) {
+			return
+		}
+
+		s.output(c, codeErrParamsInvalid, nil, http.StatusBadRequest)
 		return
 	}
 
-	if !workers.Contains(req.ChannelName) {
+	worker := tenantWorker(c, req.ChannelName)
+	if worker == nil {
 		slog.Error("handlerVectorDocumentUpload channel not existed", "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
 		s.output(c, codeErrChannelNotExisted, http.StatusBadRequest)
 		return
@@ -338,38 +724,125 @@ func (s *HttpServer) handlerVectorDocumentUpload(c *gin.Context) {
 	slog.Info("handlerVectorDocumentUpload start", "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
 
 	file := req.File
-	uploadFile := fmt.Sprintf("%s/file-%s-%d%s", s.config.LogPath, gmd5.MustEncryptString(req.ChannelName), time.Now().UnixNano(), filepath.Ext(file.Filename))
-	if err := c.SaveUploadedFile(file, uploadFile); err != nil {
+	fileName := filepath.Base(file.Filename)
+	if file.Size > s.config.UploadMaxBytes {
+		slog.Error("handlerVectorDocumentUpload file too large", "size", file.Size, "maxBytes", s.config.UploadMaxBytes, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
+		s.output(c, codeErrUploadTooLarge, map[string]any{"max_bytes": s.config.UploadMaxBytes}, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		slog.Error("handlerVectorDocumentUpload open file failed", "err", err, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
+		s.output(c, codeErrSaveFileFailed, nil, http.StatusBadRequest)
+		return
+	}
+	defer src.Close()
+
+	// The type is told by the content, whatever the name of the file
+	uploadType, err := sniffUploadType(src, file.Size, fileName)
+	if err != nil || !slices.Contains(s.config.UploadAllowedTypes, uploadType) {
+		slog.Error("handlerVectorDocumentUpload file type not allowed", "err", err, "type", uploadType, "fileName", fileName, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
+		s.output(c, codeErrUploadTypeNotAllowed, map[string]any{"allowed_types": s.config.UploadAllowedTypes}, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	uploadFile := fmt.Sprintf("%s/file-%s-%d%s", s.config.LogPath, gmd5.MustEncryptString(req.ChannelName), time.Now().UnixNano(), uploadTypeExts[uploadType])
+	digest, err := saveUpload(src, uploadFile)
+	if err != nil {
 		slog.Error("handlerVectorDocumentUpload save file failed", "err", err, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
-		s.output(c, codeErrSaveFileFailed, http.StatusBadRequest)
+		s.output(c, codeErrSaveFileFailed, nil, http.StatusBadRequest)
+		return
+	}
+	metricUploadBytes.add(float64(file.Size))
+
+	// The same document uploaded again by the tenant is queried from the
+	// collection of its unfinished job, or from its collection in the catalog,
+	// instead of being chunked and embedded again
+	digestKey := uploadDigestKey(worker.Tenant, digest)
+	reused := map[string]any{}
+	if job := findIngestionJob(uploadJobs.Get(digestKey)); job != nil && !job.finished() {
+		reused = map[string]any{"collection": job.Collection, "job_id": job.Id, "state": job.State}
+	} else if entry, err := collectionsCatalog.findDigest(worker.Tenant, digest); err != nil {
+		slog.Error("handlerVectorDocumentUpload read catalog failed", "err", err, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
+	} else if entry != nil {
+		reused = map[string]any{"collection": entry.Collection, "state": IngestionJobStateReady}
+	}
+	if collection, ok := reused["collection"].(string); ok {
+		os.Remove(uploadFile)
+
+		err = worker.update(&WorkerUpdateReq{
+			RequestId:   req.RequestId,
+			ChannelName: req.ChannelName,
+			Collection:  collection,
+			FileName:    fileName,
+			Ten: &WorkerUpdateReqTen{
+				Name: "update_querying_collection",
+				Type: "cmd",
+			},
+		})
+		if err != nil {
+			slog.Error("handlerVectorDocumentUpload update worker failed", "err", err, "channelName", req.ChannelName, "collection", collection, "requestId", req.RequestId, logTag)
+			s.output(c, codeErrUpdateWorkerFailed, nil, http.StatusBadRequest)
+			return
+		}
+
+		slog.Info("handlerVectorDocumentUpload end, collection reused", "channelName", req.ChannelName, "collection", collection, "jobId", reused["job_id"], "sha256", digest, "requestId", req.RequestId, logTag)
+		maps.Copy(reused, map[string]any{"channel_name": req.ChannelName, "file_name": fileName, "sha256": digest, "reused": true})
+		s.output(c, codeSuccess, reused)
 		return
 	}
 
 	// Generate collection
 	collection := fmt.Sprintf("a%s_%d", gmd5.MustEncryptString(req.ChannelName), time.Now().UnixNano())
-	fileName := filepath.Base(file.Filename)
+
+	// The job is created before the worker is updated, as it may report back
+	// before the update returns
+	job, err := newIngestionJob(worker, collection, fileName, digest)
+	if err != nil {
+		slog.Error("handlerVectorDocumentUpload create ingestion job failed", "err", err, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
+		os.Remove(uploadFile)
+		s.output(c, codeErrUpdateWorkerFailed, nil, http.StatusInternalServerError)
+		return
+	}
 
 	// update worker
-	worker := workers.Get(req.ChannelName).(*Worker)
-	err := worker.update(&WorkerUpdateReq{
+	err = worker.update(&WorkerUpdateReq{
 		RequestId:   req.RequestId,
 		ChannelName: req.ChannelName,
 		Collection:  collection,
 		FileName:    fileName,
 		Path:        uploadFile,
+		// The upload is removed by the worker once chunked
+		RemoveOnChunked: true,
+		JobId:           job.Id,
+		CallbackUrl:     s.ingestionJobCallbackUrl(job),
+		CallbackToken:   job.callbackToken,
 		Ten: &WorkerUpdateReqTen{
 			Name: "file_chunk",
 			Type: "cmd",
 		},
 	})
 	if err != nil {
-		slog.Error("handlerVectorDocumentUpload update worker failed", "err", err, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
+		slog.Error("handlerVectorDocumentUpload update worker failed", "err", err, "channelName", req.ChannelName, "jobId", job.Id, "requestId", req.RequestId, logTag)
+		reportIngestionJob(job.Id, &IngestionJobReport{State: IngestionJobStateFailed, Error: codeErrUpdateWorkerFailed.msg})
 		s.output(c, codeErrUpdateWorkerFailed, http.StatusBadRequest)
 		return
 	}
+	uploadJobs.Set(digestKey, job.Id)
 
-	slog.Info("handlerVectorDocumentUpload end", "channelName", req.ChannelName, "collection", collection, "uploadFile", uploadFile, "requestId", req.RequestId, logTag)
-	s.output(c, codeSuccess, map[string]any{"channel_name": req.ChannelName, "collection": collection, "file_name": fileName})
+	slog.Info("handlerVectorDocumentUpload end", "channelName", req.ChannelName, "collection", collection, "jobId", job.Id, "uploadFile", uploadFile, "sha256", digest, "requestId", req.RequestId, logTag)
+	s.output(c, codeSuccess, map[string]any{"channel_name": req.ChannelName, "collection": collection, "file_name": fileName, "sha256": digest, "reused": false, "job_id": job.Id, "state": job.State})
+}
+
+// tenantWorker returns the running worker of the channel, nil if it's not
+// existed or belongs to another tenant.
+func tenantWorker(c *gin.Context, channelName string) *Worker {
+	v := workers.Get(channelName)
+	if v == nil || !canAccess(c, v.(*Worker).Tenant) {
+		return nil
+	}
+	return v.(*Worker)
 }
 
 func (s *HttpServer) output(c *gin.Context, code *Code, data any, httpStatus ...int) {
@@ -377,10 +850,13 @@ func (s *HttpServer) output(c *gin.Context, code *Code, data any, httpStatus ...
 		httpStatus = append(httpStatus, http.StatusOK)
 	}
 
+	c.Set(outputCodeContextKey, code.code)
 	c.JSON(httpStatus[0], gin.H{"code": code.code, "msg": code.msg, "data": data})
 }
 
-func (s *HttpServer) processProperty(req *StartReq) (propertyJsonFile string, logFile string, err error) {
+// processProperty writes the property file of the worker for the graph, which
+// is patched by the request if any, with the secrets of the tenant.
+func (s *HttpServer) processProperty(req *StartReq, g *Graph, tenant string) (propertyJsonFile string, logFile string, err error) {
 	content, err := os.ReadFile(PropertyJsonFile)
 	if err != nil {
 		slog.Error("handlerStart read property.json failed", "err", err, "propertyJsonFile", propertyJsonFile, "requestId", req.RequestId, logTag)
@@ -397,13 +873,10 @@ func (s *HttpServer) processProperty(req *StartReq) (propertyJsonFile string, lo
 	}
 
 	// Generate token
-	req.Token = s.config.AppId
-	if s.config.AppCertificate != "" {
-		req.Token, err = rtctokenbuilder.BuildTokenWithUid(s.config.AppId, s.config.AppCertificate, req.ChannelName, 0, rtctokenbuilder.RoleSubscriber, tokenExpirationInSeconds, tokenExpirationInSeconds)
-		if err != nil {
-			slog.Error("handlerStart generate token failed", "err", err, "requestId", req.RequestId, logTag)
-			return
-		}
+	req.Token, req.tokenExpireTs, err = s.workerToken(req.ChannelName)
+	if err != nil {
+		slog.Error("handlerStart generate token failed", "err", err, "requestId", req.RequestId, logTag)
+		return
 	}
 
 	graph := fmt.Sprintf(`_ten.predefined_graphs.#(name=="%s")`, graphName)
@@ -434,6 +907,17 @@ func (s *HttpServer) processProperty(req *StartReq) (propertyJsonFile string, lo
 	// Replace the predefined_graphs array with the filtered array
 	propertyJson, _ = sjson.Set(propertyJson, "_ten.predefined_graphs", graphData)
 
+	if req.GraphPatch != nil {
+		if propertyJson, err = sjson.Set(propertyJson, fmt.Sprintf(`%s.nodes`, graph), g.propertyJsonNodes()); err != nil {
+			slog.Error("handlerStart set patched nodes failed", "err", err, "graph", graphName, "requestId", req.RequestId, logTag)
+			return
+		}
+		if propertyJson, err = sjson.Set(propertyJson, fmt.Sprintf(`%s.connections`, graph), g.Connections); err != nil {
+			slog.Error("handlerStart set patched connections failed", "err", err, "graph", graphName, "requestId", req.RequestId, logTag)
+			return
+		}
+	}
+
 	// Automatically start on launch
 	propertyJson, _ = sjson.Set(propertyJson, fmt.Sprintf(`%s.auto_start`, graph), true)
 
@@ -442,10 +926,14 @@ func (s *HttpServer) processProperty(req *StartReq) (propertyJsonFile string, lo
 		if extKey := extensionName; extKey != "" {
 			for prop, val := range props {
 				// Construct the path
-				path := fmt.Sprintf(`%s.nodes.#(name=="%s").property.%s`, graph, extKey, prop)
+				path := g.propertyPath(extKey, prop)
+				if path == "" {
+					continue
+				}
 				propertyJson, err = sjson.Set(propertyJson, path, val)
 				if err != nil {
 					slog.Error("handlerStart set property failed", "err", err, "graph", graphName, "extensionName", extensionName, "prop", prop, "val", val, "requestId", req.RequestId, logTag)
+					return
 				}
 			}
 		}
@@ -455,37 +943,99 @@ func (s *HttpServer) processProperty(req *StartReq) (propertyJsonFile string, lo
 	for key, props := range startPropMap {
 		if val := getFieldValue(req, key); val != "" {
 			for _, prop := range props {
-				propertyJson, _ = sjson.Set(propertyJson, fmt.Sprintf(`%s.nodes.#(name=="%s").property.%s`, graph, prop.ExtensionName, prop.Property), val)
+				if path := g.propertyPath(prop.ExtensionName, prop.Property); path != "" {
+					propertyJson, _ = sjson.Set(propertyJson, path, val)
+				}
 			}
 		}
 	}
 
+	// Inject the secrets referenced by the graph
+	if s.config.SecretsProvider != nil {
+		if propertyJson, err = resolveSecrets(s.config.SecretsProvider, s.config.SecretsEnvFallback, tenant, g, propertyJson); err != nil {
+			slog.Error("handlerStart resolve secrets failed", "err", err, "graph", graphName, "tenant", tenant, "requestId", req.RequestId, logTag)
+			return
+		}
+	}
+
 	channelNameMd5 := gmd5.MustEncryptString(req.ChannelName)
 	ts := time.Now().UnixNano()
 	propertyJsonFile = fmt.Sprintf("%s/property-%s-%d.json", s.config.LogPath, channelNameMd5, ts)
 	logFile = fmt.Sprintf("%s/app-%s-%d.log", s.config.LogPath, channelNameMd5, ts)
-	os.WriteFile(propertyJsonFile, []byte(propertyJson), 0644)
+	os.WriteFile(propertyJsonFile, []byte(propertyJson), 0600)
 
 	return
 }
 
 func (s *HttpServer) Start() {
 	r := gin.Default()
-	r.Use(corsMiddleware())
+	r.Use(corsMiddleware(s.config.CorsAllowOrigins))
+	r.Use(s.bodyLimitMiddleware())
+	r.Use(s.authMiddleware())
 
 	r.GET("/", s.handlerHealth)
 	r.GET("/health", s.handlerHealth)
+	r.GET("/metrics", s.adminMiddleware(), s.handlerMetrics)
+	r.GET("/graphs", s.handlerGraphs)
+	r.GET("/graphs/:name", s.handlerGraph)
+
+	// The coordinator runs no worker itself, but places them on the nodes
+	if s.config.ServerMode == ServerModeCoordinator {
+		r.GET("/list", s.handlerClusterList)
+		r.GET("/nodes", s.adminMiddleware(), s.handlerNodes)
+		r.POST("/nodes/heartbeat", s.adminMiddleware(), s.handlerNodeHeartbeat)
+		r.GET("/workers/:channel", s.handlerClusterForward)
+		r.GET("/workers/:channel/logs", s.handlerClusterForward)
+		r.GET("/workers/:channel/metrics", s.handlerClusterForward)
+		r.GET("/workers/:channel/transcript", s.handlerClusterForward)
+		r.POST("/start", s.handlerClusterStart)
+		r.POST("/stop", s.handlerClusterForward)
+		r.POST("/ping", s.handlerClusterForward)
+		r.POST("/token/generate", s.rateLimitMiddleware(quotaActionToken), s.handlerGenerateToken)
+		r.GET("/vector/document/preset/list", s.handlerVectorDocumentPresetList)
+		r.POST("/vector/document/update", s.handlerClusterForward)
+		r.POST(uploadRoutePath, s.rateLimitMiddleware(quotaActionUpload), s.handlerClusterForward)
+		r.GET("/vector/jobs/:id", s.handlerClusterForward)
+		r.GET("/vector/collections", s.handlerCollections)
+		r.POST("/vector/collections/:collection/rename", s.handlerCollectionRename)
+		r.DELETE("/vector/collections/:collection", s.handlerCollectionDelete)
+
+		slog.Info("server start", "port", s.config.Port, "mode", s.config.ServerMode, logTag)
+
+		go s.pruneNodes()
+		r.Run(fmt.Sprintf(":%s", s.config.Port))
+		return
+	}
+
 	r.GET("/list", s.handlerList)
+	r.GET("/events", s.handlerEvents)
+	r.GET("/workers", s.handlerWorkers)
+	r.GET("/workers/:channel", s.handlerWorker)
+	r.GET("/workers/:channel/logs", s.handlerWorkerLogs)
+	r.GET("/workers/:channel/metrics", s.handlerWorkerMetrics)
+	r.GET("/workers/:channel/transcript", s.handlerWorkerTranscript)
 	r.POST("/start", s.handlerStart)
 	r.POST("/stop", s.handlerStop)
 	r.POST("/ping", s.handlerPing)
-	r.POST("/token/generate", s.handlerGenerateToken)
+	r.POST("/token/generate", s.rateLimitMiddleware(quotaActionToken), s.handlerGenerateToken)
 	r.GET("/vector/document/preset/list", s.handlerVectorDocumentPresetList)
 	r.POST("/vector/document/update", s.handlerVectorDocumentUpdate)
-	r.POST("/vector/document/upload", s.handlerVectorDocumentUpload)
+	r.POST(uploadRoutePath, s.rateLimitMiddleware(quotaActionUpload), s.handlerVectorDocumentUpload)
+	r.GET("/vector/jobs/:id", s.handlerIngestionJob)
+	r.POST(ingestionJobCallbackPath, s.handlerIngestionJobCallback)
+	r.GET("/vector/collections", s.handlerCollections)
+	r.POST("/vector/collections/:collection/rename", s.handlerCollectionRename)
+	r.DELETE("/vector/collections/:collection", s.handlerCollectionDelete)
+	r.POST("/retention/sweep", s.adminMiddleware(), s.handlerRetentionSweep)
 
-	slog.Info("server start", "port", s.config.Port, logTag)
+	slog.Info("server start", "port", s.config.Port, "mode", s.config.ServerMode, logTag)
 
+	adoptWorkers()
 	go timeoutWorkers()
+	go s.config.Retention.run()
+	go s.refreshWorkerTokens()
+	if s.config.ServerMode == ServerModeNode {
+		go s.heartbeat()
+	}
 	r.Run(fmt.Sprintf(":%s", s.config.Port))
 }
@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gogf/gf/container/gmap"
+	"github.com/google/uuid"
+)
+
+// IngestionJob is the chunking and embedding of an uploaded document into its
+// collection, by the worker of the channel. The worker reports its progress
+// through the callback of the job.
+type IngestionJob struct {
+	Id          string `json:"id"`
+	ChannelName string `json:"channel_name"`
+	Tenant      string `json:"tenant,omitempty"`
+	Collection  string `json:"collection"`
+	FileName    string `json:"file_name"`
+	Sha256      string `json:"sha256"`
+	State       string `json:"state"`
+	Error       string `json:"error,omitempty"`
+	Chunks      int    `json:"chunks,omitempty"`
+	CreateTs    int64  `json:"create_ts"`
+	UpdateTs    int64  `json:"update_ts"`
+
+	callbackToken string // authenticates the callback of the worker
+}
+
+// IngestionJobReport is the progress of a job reported by the worker.
+type IngestionJobReport struct {
+	State  string `json:"state" binding:"required,oneof=chunking embedding ready failed"`
+	Error  string `json:"error,omitempty"`
+	Chunks int    `json:"chunks,omitempty" binding:"min=0"`
+}
+
+const (
+	// Ingestion job states
+	IngestionJobStateQueued    = "queued"
+	IngestionJobStateChunking  = "chunking"
+	IngestionJobStateEmbedding = "embedding"
+	IngestionJobStateReady     = "ready"
+	IngestionJobStateFailed    = "failed"
+
+	// Jobs are kept for a while after their last update, with their collections
+	// reused for the same document
+	ingestionJobKeepSeconds = 7 * 24 * 3600
+
+	ingestionJobCallbackPath        = "/vector/jobs/:id/callback"
+	ingestionJobCallbackHeaderToken = "X-Callback-Token"
+)
+
+var (
+	ingestionJobs = gmap.New(true) // by id
+
+	// Order of the states, a job never goes back to an earlier one
+	ingestionJobStateRanks = map[string]int{
+		IngestionJobStateQueued:    0,
+		IngestionJobStateChunking:  1,
+		IngestionJobStateEmbedding: 2,
+		IngestionJobStateReady:     3,
+		IngestionJobStateFailed:    3,
+	}
+)
+
+// newIngestionJob creates the queued job of the document uploaded to the
+// collection of the worker, and returns a copy of it.
+func newIngestionJob(worker *Worker, collection string, fileName string, digest string) (*IngestionJob, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	nowTs := time.Now().Unix()
+	job := &IngestionJob{
+		Id:            uuid.New().String(),
+		ChannelName:   worker.ChannelName,
+		Tenant:        worker.Tenant,
+		Collection:    collection,
+		FileName:      fileName,
+		Sha256:        digest,
+		State:         IngestionJobStateQueued,
+		CreateTs:      nowTs,
+		UpdateTs:      nowTs,
+		callbackToken: hex.EncodeToString(token),
+	}
+	copied := *job
+	ingestionJobs.Set(job.Id, &copied)
+	job.publish()
+
+	return job, nil
+}
+
+// findIngestionJob returns a copy of the job of the id, nil if not found.
+func findIngestionJob(id string) *IngestionJob {
+	var job *IngestionJob
+	ingestionJobs.RLockFunc(func(m map[interface{}]interface{}) {
+		if v, ok := m[id]; ok {
+			copied := *v.(*IngestionJob)
+			job = &copied
+		}
+	})
+	return job
+}
+
+// reportIngestionJob updates the job of the id with the report, and returns a
+// copy of it, nil if not found. Reports of a finished job, or going back to an earlier state as
+// they come out of order, are ignored.
+func reportIngestionJob(id string, report *IngestionJobReport) (job *IngestionJob, updated bool) {
+	ingestionJobs.LockFunc(func(m map[interface{}]interface{}) {
+		v, ok := m[id]
+		if !ok {
+			return
+		}
+		j := v.(*IngestionJob)
+
+		if !j.finished() && ingestionJobStateRanks[report.State] >= ingestionJobStateRanks[j.State] {
+			j.State = report.State
+			j.Error = report.Error
+			if report.Chunks > 0 {
+				j.Chunks = report.Chunks
+			}
+			j.UpdateTs = time.Now().Unix()
+			updated = true
+		}
+
+		copied := *j
+		job = &copied
+	})
+
+	if updated {
+		job.publish()
+		if job.State == IngestionJobStateReady {
+			catalogIngestionJob(job)
+		}
+	}
+	return job, updated
+}
+
+// failIngestionJobs fails the unfinished jobs of the channel, as its worker
+// exited and won't report them any more.
+func failIngestionJobs(channelName string, reason string) {
+	for _, v := range ingestionJobs.Values() {
+		if job := v.(*IngestionJob); job.ChannelName == channelName {
+			reportIngestionJob(job.Id, &IngestionJobReport{State: IngestionJobStateFailed, Error: reason})
+		}
+	}
+}
+
+// pruneIngestionJobs removes the jobs not updated for ingestionJobKeepSeconds.
+func pruneIngestionJobs() {
+	nowTs := time.Now().Unix()
+	ingestionJobs.LockFunc(func(m map[interface{}]interface{}) {
+		for id, v := range m {
+			if v.(*IngestionJob).UpdateTs+ingestionJobKeepSeconds < nowTs {
+				delete(m, id)
+			}
+		}
+	})
+}
+
+func (j *IngestionJob) finished() bool {
+	return j.State == IngestionJobStateReady || j.State == IngestionJobStateFailed
+}
+
+func (j *IngestionJob) publish() {
+	workerEvents.publishTenant(j.Tenant, workerEventIngestionJob, j.ChannelName, map[string]any{"job_id": j.Id, "state": j.State, "collection": j.Collection, "error": j.Error, "chunks": j.Chunks})
+}
+
+// ingestionJobCallbackUrl returns the url the worker reports the job to, the
+// workers run on the node of the server.
+func (s *HttpServer) ingestionJobCallbackUrl(job *IngestionJob) string {
+	return fmt.Sprintf("%s:%s/vector/jobs/%s/callback", workerHttpServerUrl, s.config.Port, job.Id)
+}
+
+func (s *HttpServer) handlerIngestionJob(c *gin.Context) {
+	id := c.Param("id")
+
+	job := findIngestionJob(id)
+	if job == nil || !canAccess(c, job.Tenant) {
+		slog.Error("handlerIngestionJob job not found", "jobId", id, logTag)
+		s.output(c, codeErrIngestionJobNotFound, nil, http.StatusNotFound)
+		return
+	}
+
+	s.output(c, codeSuccess, job)
+}
+
+// handlerIngestionJobCallback is called by the worker, which is authenticated
+// by the callback token of the job instead of an api key.
+func (s *HttpServer) handlerIngestionJobCallback(c *gin.Context) {
+	id := c.Param("id")
+
+	var req IngestionJobReport
+	if err := c.ShouldBindJSON(&req); err != nil {
+		slog.Error("handlerIngestionJobCallback params invalid", "err", err, "jobId", id, logTag)
+		s.output(c, codeErrParamsInvalid, nil, http.StatusBadRequest)
+		return
+	}
+
+	job := findIngestionJob(id)
+	if job == nil {
+		slog.Error("handlerIngestionJobCallback job not found", "jobId", id, logTag)
+		s.output(c, codeErrIngestionJobNotFound, nil, http.StatusNotFound)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(c.GetHeader(ingestionJobCallbackHeaderToken)), []byte(job.callbackToken)) != 1 {
+		slog.Error("handlerIngestionJobCallback callback token invalid", "jobId", id, logTag)
+		s.output(c, codeErrUnauthorized, nil, http.StatusUnauthorized)
+		return
+	}
+
+	// The job may be pruned since it was found
+	job, updated := reportIngestionJob(id, &req)
+	if job == nil {
+		slog.Error("handlerIngestionJobCallback job not found", "jobId", id, logTag)
+		s.output(c, codeErrIngestionJobNotFound, nil, http.StatusNotFound)
+		return
+	}
+	slog.Info("handlerIngestionJobCallback end", "jobId", id, "channelName", job.ChannelName, "state", req.State, "error", req.Error, "chunks", req.Chunks, "updated", updated, logTag)
+	s.output(c, codeSuccess, job)
+}
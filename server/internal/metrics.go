@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metricVec is a family of metrics by label values, written in the Prometheus
+// text format.
+type metricVec struct {
+	name    string
+	help    string
+	kind    string // counter, gauge, histogram or summary
+	labels  []string
+	buckets []float64 // histogram only, upper bounds in ascending order
+
+	lock   sync.Mutex
+	series map[string]*metricSeries // by joined label values
+}
+
+type metricSeries struct {
+	labelValues  []string
+	value        float64  // counter and gauge
+	count        uint64   // histogram and summary
+	sum          float64  // histogram and summary
+	bucketCounts []uint64 // histogram, not cumulative
+}
+
+const (
+	metricKindCounter   = "counter"
+	metricKindGauge     = "gauge"
+	metricKindHistogram = "histogram"
+	metricKindSummary   = "summary"
+
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// Label of the values of the requests which are not known, so that the
+	// clients can't create any number of series
+	metricLabelUnknown = "unknown"
+)
+
+var (
+	metricWorkerStarts   = newMetricVec("astra_worker_starts_total", "Workers started by /start.", metricKindCounter, "graph")
+	metricWorkerStops    = newMetricVec("astra_worker_stops_total", "Workers stopped.", metricKindCounter, "graph")
+	metricWorkerTimeouts = newMetricVec("astra_worker_timeouts_total", "Workers stopped for not being pinged in time.", metricKindCounter, "graph")
+	metricWorkerCrashes  = newMetricVec("astra_worker_crashes_total", "Worker processes exited on failure without being stopped.", metricKindCounter, "graph")
+	metricStartDuration  = newHistogramVec("astra_start_duration_seconds", "Duration of the /start requests.", []float64{0.5, 1, 2, 5, 10, 20, 30, 60}, "graph", "code")
+	metricUpdateDuration = newHistogramVec("astra_worker_update_duration_seconds", "Duration of the cmds forwarded to the workers.", []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}, "cmd")
+	metricUpdateErrors   = newMetricVec("astra_worker_update_errors_total", "Cmds failed to be forwarded to the workers.", metricKindCounter, "cmd")
+	metricUploadBytes    = newMetricVec("astra_upload_bytes_total", "Bytes of the documents uploaded.", metricKindCounter)
+
+	metricRetentionDeletedFiles = newMetricVec("astra_retention_deleted_files_total", "Files deleted from the log path by the retention.", metricKindCounter, "artifact")
+	metricRetentionDeletedBytes = newMetricVec("astra_retention_deleted_bytes_total", "Bytes of the files deleted from the log path by the retention.", metricKindCounter, "artifact")
+
+	// Sampled on scrape
+	metricWorkersRunning    = newMetricVec("astra_workers_running", "Workers running.", metricKindGauge)
+	metricWorkerRssBytes    = newMetricVec("astra_worker_rss_bytes", "Resident memory of the worker processes.", metricKindGauge, "channel", "graph")
+	metricWorkerCpuSeconds  = newMetricVec("astra_worker_cpu_seconds_total", "Cpu time of the worker processes.", metricKindCounter, "channel", "graph")
+	metricWorkerProcesses   = newMetricVec("astra_worker_processes", "Processes of the workers.", metricKindGauge, "channel", "graph")
+	metricWorkerRestarts    = newMetricVec("astra_worker_restarts", "Restarts of the running workers after crashes.", metricKindGauge, "channel", "graph")
+	metricsRegistered       = []*metricVec{metricWorkersRunning, metricWorkerStarts, metricWorkerStops, metricWorkerTimeouts, metricWorkerCrashes, metricStartDuration, metricUpdateDuration, metricUpdateErrors, metricUploadBytes, metricRetentionDeletedFiles, metricRetentionDeletedBytes}
+	metricsSampledPerWorker = []*metricVec{metricWorkerRssBytes, metricWorkerCpuSeconds, metricWorkerProcesses, metricWorkerRestarts}
+)
+
+func newMetricVec(name string, help string, kind string, labels ...string) *metricVec {
+	return &metricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]*metricSeries),
+	}
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *metricVec {
+	m := newMetricVec(name, help, metricKindHistogram, labels...)
+	m.buckets = buckets
+	return m
+}
+
+func (m *metricVec) seriesLocked(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	series, ok := m.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: labelValues}
+		if m.kind == metricKindHistogram {
+			series.bucketCounts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = series
+	}
+	return series
+}
+
+// add adds the value to the counter or gauge of the label values.
+func (m *metricVec) add(value float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.seriesLocked(labelValues).value += value
+}
+
+// set sets the gauge of the label values.
+func (m *metricVec) set(value float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.seriesLocked(labelValues).value = value
+}
+
+// setSummary sets the sum and count of the summary of the label values.
+func (m *metricVec) setSummary(sum float64, count uint64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	series := m.seriesLocked(labelValues)
+	series.sum = sum
+	series.count = count
+}
+
+// reset drops all the series, for the metrics sampled on scrape.
+func (m *metricVec) reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.series = make(map[string]*metricSeries)
+}
+
+// observe records the value in the histogram of the label values.
+func (m *metricVec) observe(value float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	series := m.seriesLocked(labelValues)
+	series.count++
+	series.sum += value
+	for i, bound := range m.buckets {
+		if value <= bound {
+			series.bucketCounts[i]++
+			break
+		}
+	}
+}
+
+// write writes the metric family in the Prometheus text format.
+func (m *metricVec) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := m.series[key]
+		labels := formatMetricLabels(m.labels, series.labelValues)
+		switch m.kind {
+		case metricKindSummary:
+			fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatMetricValue(series.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, series.count)
+			continue
+		case metricKindHistogram:
+		default:
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatMetricValue(series.value))
+			continue
+		}
+
+		bucketLabels := append(slices.Clone(m.labels), "le")
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += series.bucketCounts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatMetricLabels(bucketLabels, append(slices.Clone(series.labelValues), formatMetricValue(bound))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatMetricLabels(bucketLabels, append(slices.Clone(series.labelValues), "+Inf")), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatMetricValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, series.count)
+	}
+}
+
+func formatMetricLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sampleWorkerMetrics refreshes the metrics sampled from the running workers.
+func sampleWorkerMetrics() {
+	metricWorkersRunning.set(float64(workers.Size()))
+	for _, m := range metricsSampledPerWorker {
+		m.reset()
+	}
+
+	groups := getProcessGroupsStats()
+	for _, v := range workers.Values() {
+		worker := v.(*Worker)
+		metricWorkerRestarts.set(float64(worker.RestartCount), worker.ChannelName, worker.GraphName)
+
+		stats := worker.stats(groups)
+		if stats == nil {
+			continue
+		}
+		metricWorkerRssBytes.set(float64(stats.RssBytes), worker.ChannelName, worker.GraphName)
+		metricWorkerCpuSeconds.set(stats.CpuSeconds, worker.ChannelName, worker.GraphName)
+		metricWorkerProcesses.set(float64(stats.Processes), worker.ChannelName, worker.GraphName)
+	}
+}
+
+func (s *HttpServer) handlerMetrics(c *gin.Context) {
+	sampleWorkerMetrics()
+
+	c.Header("Content-Type", metricsContentType)
+	c.Status(http.StatusOK)
+	for _, m := range metricsRegistered {
+		m.write(c.Writer)
+	}
+	for _, m := range metricsSampledPerWorker {
+		m.write(c.Writer)
+	}
+
+	list := make([]*Worker, 0, workers.Size())
+	for _, v := range workers.Values() {
+		list = append(list, v.(*Worker))
+	}
+	writeAgentMetrics(c, list)
+}
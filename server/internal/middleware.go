@@ -1,18 +1,38 @@
 package internal
 
 import (
+	"errors"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
-func corsMiddleware() gin.HandlerFunc {
+const (
+	corsAllowHeaders = "Authorization, Content-Type, X-Api-Key, X-Timestamp, X-Nonce, X-Signature"
+
+	// Max bytes of the body of a request, but the uploads
+	requestBodyMaxBytes = 1024 * 1024
+)
+
+// corsMiddleware allows the origins of the allowlist, or any origin without
+// credentials if the allowlist is "*".
+func corsMiddleware(allowOrigins []string) gin.HandlerFunc {
+	allowAny := slices.Contains(allowOrigins, "*")
+
 	return func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "*")
-		c.Header("Access-Control-Allow-Headers", "*")
+		origin := c.GetHeader("Origin")
+		if allowAny {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else if origin != "" && slices.ContainsFunc(allowOrigins, func(o string) bool { return strings.EqualFold(o, origin) }) {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Access-Control-Allow-Credentials", "true")
+			c.Header("Vary", "Origin")
+		}
+		c.Header("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", corsAllowHeaders)
 		c.Header("Access-Control-Expose-Headers", "*")
-		c.Header("Access-Control-Allow-Credentials", "true")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusNoContent)
@@ -22,3 +42,35 @@ func corsMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// bodyLimitMiddleware limits the body of the requests before it's read by the
+// auth or the handlers, the uploads are limited to their max size.
+func (s *HttpServer) bodyLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		maxBytes := int64(requestBodyMaxBytes)
+		if c.FullPath() == uploadRoutePath {
+			maxBytes = s.config.UploadMaxBytes + uploadFormOverheadBytes
+		}
+		if c.Request.Body != nil {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		}
+
+		c.Next()
+	}
+}
+
+// outputBodyTooLarge responds 413 if the body was read past the limit of the
+// bodyLimitMiddleware, the uploads with their max size. False if it was not.
+func (s *HttpServer) outputBodyTooLarge(c *gin.Context, err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) {
+		return false
+	}
+
+	if c.FullPath() == uploadRoutePath {
+		s.output(c, codeErrUploadTooLarge, map[string]any{"max_bytes": s.config.UploadMaxBytes}, http.StatusRequestEntityTooLarge)
+	} else {
+		s.output(c, codeErrRequestTooLarge, map[string]any{"max_bytes": maxBytesErr.Limit}, http.StatusRequestEntityTooLarge)
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// portLeases hands out the http_server ports of the workers. A port is only
+// leased if it's not held by another worker and can be bound, and stays
+// leased until the worker owning it is removed.
+type portLeases struct {
+	lock   sync.Mutex
+	min    int32
+	max    int32
+	next   int32
+	owners map[int32]string // port to the channel name of the worker
+}
+
+const (
+	httpServerPortMinDefault = 10000
+	httpServerPortMaxDefault = 30000
+)
+
+var (
+	httpServerPorts = newPortLeases(httpServerPortMinDefault, httpServerPortMaxDefault)
+)
+
+func newPortLeases(portMin int32, portMax int32) *portLeases {
+	return &portLeases{
+		min:    portMin,
+		max:    portMax,
+		next:   portMin,
+		owners: make(map[int32]string),
+	}
+}
+
+// setRange changes the range of the ports leased from now on, ports already
+// leased are kept.
+func (p *portLeases) setRange(portMin int32, portMax int32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.min = portMin
+	p.max = portMax
+	p.next = portMin
+}
+
+// lease returns a free port of the range for the owner, searching from the
+// port after the last leased one.
+func (p *portLeases) lease(owner string) (int32, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for i := p.min; i <= p.max; i++ {
+		port := p.next
+		if p.next++; p.next > p.max {
+			p.next = p.min
+		}
+
+		if _, ok := p.owners[port]; ok {
+			continue
+		}
+		if !isPortFree(port) {
+			slog.Debug("Port in use, skipped", "port", port, logTag)
+			continue
+		}
+
+		p.owners[port] = owner
+		return port, nil
+	}
+
+	return 0, fmt.Errorf("no free port in [%d, %d], %d leased", p.min, p.max, len(p.owners))
+}
+
+// reserve leases the port held by a live worker without testing it, used for
+// the workers adopted from the store.
+func (p *portLeases) reserve(port int32, owner string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if current, ok := p.owners[port]; ok && current != owner {
+		slog.Warn("Port reserved by another worker", "port", port, "owner", current, "newOwner", owner, logTag)
+	}
+	p.owners[port] = owner
+}
+
+// release returns the port if it's still leased by the owner.
+func (p *portLeases) release(port int32, owner string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.owners[port] == owner {
+		delete(p.owners, port)
+	}
+}
+
+// isPortFree tries to bind the port on all interfaces, as the http_server
+// extension does.
+func isPortFree(port int32) bool {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ProcessStats is the resource usage of a worker process group read from /proc.
+type ProcessStats struct {
+	Processes  int     `json:"processes"`
+	RssBytes   int64   `json:"rss_bytes"`
+	CpuSeconds float64 `json:"cpu_seconds"`
+	OpenFds    int     `json:"open_fds"`
+}
+
+const (
+	procPath = "/proc"
+	// USER_HZ, it's 100 on all the architectures we run on
+	procClockTicks = 100
+)
+
+// readProcessStats reads the stats of a single process, and its process group id.
+func readProcessStats(pid int) (pgid int, stats *ProcessStats, err error) {
+	content, err := os.ReadFile(fmt.Sprintf("%s/%d/stat", procPath, pid))
+	if err != nil {
+		return // the process has exited
+	}
+
+	// The command name in the second field may contain spaces, so parse after it
+	stat := string(content)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 22 {
+		err = fmt.Errorf("invalid stat of process %d", pid)
+		return
+	}
+
+	pgid, _ = strconv.Atoi(fields[2])
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	rss, _ := strconv.ParseInt(fields[21], 10, 64)
+
+	stats = &ProcessStats{
+		Processes:  1,
+		RssBytes:   rss * int64(os.Getpagesize()),
+		CpuSeconds: float64(utime+stime) / procClockTicks,
+	}
+	if fds, err := os.ReadDir(fmt.Sprintf("%s/%d/fd", procPath, pid)); err == nil {
+		stats.OpenFds = len(fds)
+	}
+
+	return
+}
+
+func (s *ProcessStats) add(o *ProcessStats) {
+	s.Processes += o.Processes
+	s.RssBytes += o.RssBytes
+	s.CpuSeconds += o.CpuSeconds
+	s.OpenFds += o.OpenFds
+}
+
+// getProcessGroupsStats scans /proc once and sums the stats of every process
+// by its process group id.
+func getProcessGroupsStats() map[int]*ProcessStats {
+	groups := make(map[int]*ProcessStats)
+
+	entries, err := os.ReadDir(procPath)
+	if err != nil {
+		return groups
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		pgid, stats, err := readProcessStats(pid)
+		if err != nil {
+			continue
+		}
+
+		if groups[pgid] == nil {
+			groups[pgid] = &ProcessStats{}
+		}
+		groups[pgid].add(stats)
+	}
+
+	return groups
+}
@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TenantQuota limits the usage of a tenant, zero means unlimited.
+type TenantQuota struct {
+	WorkersMax          int `json:"workers_max,omitempty"`
+	StartsPerMinute     int `json:"starts_per_minute,omitempty"`
+	WorkerMinutesPerDay int `json:"worker_minutes_per_day,omitempty"`
+	TokensPerMinute     int `json:"tokens_per_minute,omitempty"`  // /token/generate
+	UploadsPerMinute    int `json:"uploads_per_minute,omitempty"` // /vector/document/upload
+}
+
+// quotaExceededError tells which quota refused the request, and when to retry.
+type quotaExceededError struct {
+	code              *Code
+	retryAfterSeconds int
+}
+
+func (e *quotaExceededError) Error() string {
+	return e.code.msg
+}
+
+// tokenBucket allows rate requests per minute, in bursts of up to rate.
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	ts     time.Time
+}
+
+// tenantQuotas enforces the quotas of the tenants, and keeps their usage.
+type tenantQuotas struct {
+	lock    sync.Mutex
+	quotas  map[string]*TenantQuota // by tenant
+	buckets map[string]*tokenBucket // by tenant and limited action
+	day     int64                   // unix day of the usage
+	usage   map[string]int64        // seconds run today by the exited workers, by tenant
+}
+
+const (
+	// Key of the quota used by tenants without their own quota
+	tenantQuotaDefault = "default"
+
+	// Limited actions
+	quotaActionStart  = "start"
+	quotaActionToken  = "token"
+	quotaActionUpload = "upload"
+
+	// Retry-After of a refused start when the tenant runs too many workers
+	quotaWorkersRetrySeconds = 30
+
+	secondsPerDay = 86400
+)
+
+var (
+	quotas = newTenantQuotas()
+)
+
+func newTenantQuotas() *tenantQuotas {
+	return &tenantQuotas{
+		quotas:  make(map[string]*TenantQuota),
+		buckets: make(map[string]*tokenBucket),
+		usage:   make(map[string]int64),
+	}
+}
+
+func newTokenBucket(perMinute int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(perMinute) / 60,
+		burst:  float64(perMinute),
+		tokens: float64(perMinute),
+		ts:     time.Now(),
+	}
+}
+
+// take consumes a token, or returns the seconds until a token is available.
+func (b *tokenBucket) take() (ok bool, retryAfterSeconds int) {
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.ts).Seconds()*b.rate)
+	b.ts = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, int(math.Ceil((1 - b.tokens) / b.rate))
+}
+
+// refund gives back a token consumed by take.
+func (b *tokenBucket) refund() {
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// setQuotas replaces the quotas, the usage is kept.
+func (q *tenantQuotas) setQuotas(quotas map[string]*TenantQuota) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if quotas == nil {
+		quotas = make(map[string]*TenantQuota)
+	}
+	q.quotas = quotas
+	q.buckets = make(map[string]*tokenBucket)
+}
+
+func (q *tenantQuotas) quota(tenant string) *TenantQuota {
+	if quota, ok := q.quotas[tenant]; ok {
+		return quota
+	}
+	return q.quotas[tenantQuotaDefault]
+}
+
+// takeLocked consumes a token of the action of the tenant, perMinute zero
+// means unlimited.
+func (q *tenantQuotas) takeLocked(tenant string, action string, perMinute int) error {
+	if perMinute <= 0 {
+		return nil
+	}
+
+	key := tenant + "/" + action
+	bucket, ok := q.buckets[key]
+	if !ok {
+		bucket = newTokenBucket(perMinute)
+		q.buckets[key] = bucket
+	}
+
+	if ok, retryAfterSeconds := bucket.take(); !ok {
+		return &quotaExceededError{code: codeErrRateLimited, retryAfterSeconds: retryAfterSeconds}
+	}
+	return nil
+}
+
+// take consumes a token of the rate limited action of the tenant.
+func (q *tenantQuotas) take(tenant string, action string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	quota := q.quota(tenant)
+	if quota == nil {
+		return nil
+	}
+
+	switch action {
+	case quotaActionToken:
+		return q.takeLocked(tenant, action, quota.TokensPerMinute)
+	case quotaActionUpload:
+		return q.takeLocked(tenant, action, quota.UploadsPerMinute)
+	}
+	return nil
+}
+
+// admitStart checks whether the tenant running the workers, and starting
+// others, is allowed to start another one, and consumes a start if so.
+func (q *tenantQuotas) admitStart(tenant string, running []*Worker, starting int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	quota := q.quota(tenant)
+	if quota == nil {
+		return nil
+	}
+
+	if quota.WorkersMax > 0 && len(running)+starting >= quota.WorkersMax {
+		return &quotaExceededError{code: codeErrTenantWorkersLimit, retryAfterSeconds: quotaWorkersRetrySeconds}
+	}
+
+	if err := q.admitWorkerMinutesLocked(tenant, quota, running); err != nil {
+		return err
+	}
+
+	return q.takeLocked(tenant, quotaActionStart, quota.StartsPerMinute)
+}
+
+// admitNodeStart is admitStart for a node, which only checks the worker
+// minutes of its own workers. The other quotas are enforced by the coordinator.
+func (q *tenantQuotas) admitNodeStart(tenant string, running []*Worker) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	quota := q.quota(tenant)
+	if quota == nil {
+		return nil
+	}
+
+	return q.admitWorkerMinutesLocked(tenant, quota, running)
+}
+
+func (q *tenantQuotas) admitWorkerMinutesLocked(tenant string, quota *TenantQuota, running []*Worker) error {
+	if quota.WorkerMinutesPerDay <= 0 {
+		return nil
+	}
+
+	nowTs := time.Now().Unix()
+	if q.usedSecondsLocked(tenant, running, nowTs) >= int64(quota.WorkerMinutesPerDay)*60 {
+		return &quotaExceededError{code: codeErrTenantWorkerMinutesLimit, retryAfterSeconds: int(secondsPerDay - nowTs%secondsPerDay)}
+	}
+	return nil
+}
+
+// refundStart gives back the start consumed by a start of the tenant which
+// failed.
+func (q *tenantQuotas) refundStart(tenant string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if bucket, ok := q.buckets[tenant+"/"+quotaActionStart]; ok {
+		bucket.refund()
+	}
+}
+
+// admitClusterStart is admitStart for the coordinator, which only knows the
+// number of workers of the tenant. The worker minutes are checked by the nodes.
+func (q *tenantQuotas) admitClusterStart(tenant string, running int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	quota := q.quota(tenant)
+	if quota == nil {
+		return nil
+	}
+
+	if quota.WorkersMax > 0 && running >= quota.WorkersMax {
+		return &quotaExceededError{code: codeErrTenantWorkersLimit, retryAfterSeconds: quotaWorkersRetrySeconds}
+	}
+
+	return q.takeLocked(tenant, quotaActionStart, quota.StartsPerMinute)
+}
+
+// usedSecondsLocked returns the seconds run today by the workers of the
+// tenant, the exited ones and the running ones.
+func (q *tenantQuotas) usedSecondsLocked(tenant string, running []*Worker, nowTs int64) int64 {
+	q.rollDayLocked(nowTs)
+
+	dayStartTs := q.day * secondsPerDay
+	used := q.usage[tenant]
+	for _, w := range running {
+		used += nowTs - max(w.CreateTs, dayStartTs)
+	}
+	return used
+}
+
+// rollDayLocked resets the usage on a new day.
+func (q *tenantQuotas) rollDayLocked(nowTs int64) {
+	if day := nowTs / secondsPerDay; day != q.day {
+		q.day = day
+		q.usage = make(map[string]int64)
+	}
+}
+
+// recordExit adds the seconds run today by the exited worker to the usage of
+// its tenant.
+func (q *tenantQuotas) recordExit(w *Worker) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.rollDayLocked(w.ExitTs)
+	q.usage[w.Tenant] += max(0, w.ExitTs-max(w.CreateTs, q.day*secondsPerDay))
+}
+
+// tenantWorkers returns the workers of the tenant among the running ones.
+func tenantWorkers(running []*Worker, tenant string) []*Worker {
+	list := []*Worker{}
+	for _, worker := range running {
+		if worker.Tenant == tenant {
+			list = append(list, worker)
+		}
+	}
+	return list
+}
+
+// outputQuotaExceeded refuses the request with the code of the exceeded quota.
+func (s *HttpServer) outputQuotaExceeded(c *gin.Context, err *quotaExceededError) {
+	c.Header("Retry-After", strconv.Itoa(err.retryAfterSeconds))
+	s.output(c, err.code, map[string]any{"retry_after_seconds": err.retryAfterSeconds}, http.StatusTooManyRequests)
+}
+
+// rateLimitMiddleware refuses the requests of the tenant over the rate of the
+// action. In a cluster the rates are only enforced by the coordinator.
+func (s *HttpServer) rateLimitMiddleware(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.config.ServerMode == ServerModeNode {
+			c.Next()
+			return
+		}
+
+		tenant := requestTenant(c)
+		if err := quotas.take(tenant, action); err != nil {
+			slog.Warn("Rate limited", "tenant", tenant, "action", action, "path", c.Request.URL.Path, logTag)
+			s.outputQuotaExceeded(c, err.(*quotaExceededError))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	tests := []struct {
+		name       string
+		perMinute  int
+		tokens     float64
+		elapsed    time.Duration
+		ok         bool
+		retryAfter int
+		tokensLeft float64
+	}{
+		{"full", 60, 60, 0, true, 0, 59},
+		{"last token", 60, 1, 0, true, 0, 0},
+		{"empty", 60, 0, 0, false, 1, 0},
+		{"empty slow rate", 6, 0, 0, false, 10, 0},
+		{"partly refilled", 6, 0.5, 0, false, 5, 0.5},
+		{"refilled", 60, 0, 2 * time.Second, true, 0, 1},
+		{"refill capped by burst", 60, 59, time.Hour, true, 0, 59},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.perMinute)
+			b.tokens = tt.tokens
+			b.ts = time.Now().Add(-tt.elapsed)
+
+			ok, retryAfter := b.take()
+			if ok != tt.ok || retryAfter != tt.retryAfter {
+				t.Fatalf("take() = %v, %d, want %v, %d", ok, retryAfter, tt.ok, tt.retryAfter)
+			}
+			// Allow for the time passed while taking
+			if b.tokens < tt.tokensLeft || b.tokens > tt.tokensLeft+0.01 {
+				t.Fatalf("tokens = %f, want %f", b.tokens, tt.tokensLeft)
+			}
+		})
+	}
+}
+
+func TestTokenBucketRefund(t *testing.T) {
+	b := newTokenBucket(2)
+	b.take()
+	b.take()
+	if ok, _ := b.take(); ok {
+		t.Fatal("take() = true, want the bucket empty")
+	}
+
+	b.refund()
+	if ok, _ := b.take(); !ok {
+		t.Fatal("take() = false, want the refunded token")
+	}
+
+	b = newTokenBucket(2)
+	b.refund()
+	if b.tokens != 2 {
+		t.Fatalf("tokens = %f, want capped at the burst 2", b.tokens)
+	}
+}
+
+func TestAdmitStartCountsStarting(t *testing.T) {
+	q := newTenantQuotas()
+	q.setQuotas(map[string]*TenantQuota{"acme": {WorkersMax: 2}})
+
+	running := []*Worker{{ChannelName: "a", Tenant: "acme", CreateTs: time.Now().Unix()}}
+	if err := q.admitStart("acme", running, 0); err != nil {
+		t.Fatalf("err = %v, want admitted", err)
+	}
+
+	var quotaErr *quotaExceededError
+	if err := q.admitStart("acme", running, 1); !errors.As(err, &quotaErr) || quotaErr.code != codeErrTenantWorkersLimit {
+		t.Fatalf("err = %v, want %s", err, codeErrTenantWorkersLimit.msg)
+	}
+}
+
+func TestRefundStart(t *testing.T) {
+	q := newTenantQuotas()
+	q.setQuotas(map[string]*TenantQuota{"acme": {StartsPerMinute: 1}})
+
+	if err := q.admitStart("acme", nil, 0); err != nil {
+		t.Fatalf("err = %v, want admitted", err)
+	}
+	if err := q.admitStart("acme", nil, 0); err == nil {
+		t.Fatal("err = nil, want rate limited")
+	}
+
+	q.refundStart("acme")
+	if err := q.admitStart("acme", nil, 0); err != nil {
+		t.Fatalf("err = %v, want admitted after the refund", err)
+	}
+
+	// Nothing to refund for a tenant which never started
+	q.refundStart("other")
+}
+
+func TestAdmitNodeStart(t *testing.T) {
+	q := newTenantQuotas()
+	q.setQuotas(map[string]*TenantQuota{"acme": {WorkersMax: 1, StartsPerMinute: 1, WorkerMinutesPerDay: 1}})
+
+	running := []*Worker{{ChannelName: "a", Tenant: "acme", CreateTs: time.Now().Unix()}}
+	for i := 0; i < 3; i++ {
+		if err := q.admitNodeStart("acme", running); err != nil {
+			t.Fatalf("err = %v, want the coordinator quotas not enforced", err)
+		}
+	}
+
+	// A minute run today by the exited workers
+	q.rollDayLocked(time.Now().Unix())
+	q.usage["acme"] = 60
+	var quotaErr *quotaExceededError
+	if err := q.admitNodeStart("acme", running); !errors.As(err, &quotaErr) || quotaErr.code != codeErrTenantWorkerMinutesLimit {
+		t.Fatalf("err = %v, want %s", err, codeErrTenantWorkerMinutesLimit.msg)
+	}
+}
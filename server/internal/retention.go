@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RetentionPolicy limits the files of an artifact type kept in the log path,
+// zero means unlimited.
+type RetentionPolicy struct {
+	MaxAgeHours        int   `json:"max_age_hours,omitempty"`
+	MaxTotalBytes      int64 `json:"max_total_bytes,omitempty"`
+	CompressAfterHours int   `json:"compress_after_hours,omitempty"` // logs only
+}
+
+// RetentionSweepResult is what a sweep did to the files of an artifact type.
+type RetentionSweepResult struct {
+	Artifact     string `json:"artifact"`
+	Compressed   int    `json:"compressed"`
+	Deleted      int    `json:"deleted"`
+	DeletedBytes int64  `json:"deleted_bytes"`
+	KeptFiles    int    `json:"kept_files"`
+	KeptBytes    int64  `json:"kept_bytes"`
+}
+
+// Retention deletes the files the workers leave in the log path, by the
+// policies of their artifact types. The files of the running workers are
+// never touched, but count in the total size.
+type Retention struct {
+	logPath       string
+	policies      map[string]*RetentionPolicy // by artifact type
+	sweepInterval time.Duration
+	lock          sync.Mutex // one sweep at a time
+}
+
+// retentionFile is a file of an artifact type in the log path.
+type retentionFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+	inUse   bool
+}
+
+const (
+	// Artifact types
+	retentionArtifactProperty = "property" // property-<md5>-<ts>.json
+	retentionArtifactLog      = "log"      // app-<md5>-<ts>.log, with the traces and transcript
+	retentionArtifactUpload   = "upload"   // file-<md5>-<ts>.<ext>
+
+	retentionCompressedSuffix = ".gz"
+)
+
+var (
+	retentionArtifacts = []string{retentionArtifactProperty, retentionArtifactLog, retentionArtifactUpload}
+)
+
+// NewRetention creates the retention of the log path with the policies by
+// artifact type, swept every sweep interval.
+func NewRetention(logPath string, policies map[string]*RetentionPolicy, sweepInterval time.Duration) (*Retention, error) {
+	for artifact := range policies {
+		if !slices.Contains(retentionArtifacts, artifact) {
+			return nil, fmt.Errorf("unknown artifact type %s", artifact)
+		}
+	}
+
+	return &Retention{
+		logPath:       logPath,
+		policies:      policies,
+		sweepInterval: sweepInterval,
+	}, nil
+}
+
+// retentionArtifact returns the artifact type of the file name in the log
+// path, empty if the file is not left by the workers.
+func retentionArtifact(name string) string {
+	switch {
+	case strings.HasPrefix(name, "property-") && strings.HasSuffix(name, ".json"):
+		return retentionArtifactProperty
+	case strings.HasPrefix(name, "app-"):
+		return retentionArtifactLog
+	case strings.HasPrefix(name, "file-"):
+		return retentionArtifactUpload
+	}
+	return ""
+}
+
+// runningWorkerFiles returns the files written for the running workers.
+func runningWorkerFiles() map[string]bool {
+	files := make(map[string]bool)
+	for _, v := range workers.Values() {
+		worker := v.(*Worker)
+		for _, file := range []string{worker.LogFile, worker.PropertyJsonFile, worker.TracesFile, worker.TranscriptFile} {
+			if file != "" {
+				files[filepath.Clean(file)] = true
+			}
+		}
+	}
+	return files
+}
+
+// run sweeps the log path periodically, if any policy is set.
+func (r *Retention) run() {
+	if len(r.policies) == 0 {
+		return
+	}
+
+	for {
+		if _, err := r.sweep(); err != nil {
+			slog.Error("Retention sweep failed", "err", err, logTag)
+		}
+		time.Sleep(r.sweepInterval)
+	}
+}
+
+// sweep compresses the old logs, then deletes the files older than the max
+// age of their artifact type, then the oldest files beyond its max total size.
+func (r *Retention) sweep() ([]*RetentionSweepResult, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	entries, err := os.ReadDir(r.logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := runningWorkerFiles()
+	files := make(map[string][]*retentionFile)
+	for _, entry := range entries {
+		artifact := retentionArtifact(entry.Name())
+		if artifact == "" || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // deleted meanwhile
+		}
+
+		path := filepath.Join(r.logPath, entry.Name())
+		files[artifact] = append(files[artifact], &retentionFile{path: path, size: info.Size(), modTime: info.ModTime(), inUse: inUse[filepath.Clean(path)]})
+	}
+
+	now := time.Now()
+	results := make([]*RetentionSweepResult, 0, len(retentionArtifacts))
+	for _, artifact := range retentionArtifacts {
+		result := &RetentionSweepResult{Artifact: artifact}
+		results = append(results, result)
+
+		policy := r.policies[artifact]
+		if policy == nil {
+			policy = &RetentionPolicy{}
+		}
+
+		// Oldest first, they are deleted first beyond the total size
+		list := files[artifact]
+		sort.Slice(list, func(i, j int) bool { return list[i].modTime.Before(list[j].modTime) })
+
+		kept := []*retentionFile{}
+		var keptBytes int64
+		for _, file := range list {
+			age := now.Sub(file.modTime)
+			if !file.inUse && policy.MaxAgeHours > 0 && age > time.Duration(policy.MaxAgeHours)*time.Hour {
+				r.delete(result, file)
+				continue
+			}
+
+			if !file.inUse && artifact == retentionArtifactLog && policy.CompressAfterHours > 0 && strings.HasSuffix(file.path, ".log") && age > time.Duration(policy.CompressAfterHours)*time.Hour {
+				if compressed, err := compressFile(file); err != nil {
+					slog.Error("Retention compress file failed", "err", err, "file", file.path, logTag)
+				} else {
+					file = compressed
+					result.Compressed++
+				}
+			}
+
+			kept = append(kept, file)
+			keptBytes += file.size
+		}
+
+		for _, file := range kept {
+			if policy.MaxTotalBytes > 0 && keptBytes > policy.MaxTotalBytes && !file.inUse {
+				r.delete(result, file)
+				keptBytes -= file.size
+				continue
+			}
+			result.KeptFiles++
+		}
+		result.KeptBytes = keptBytes
+
+		slog.Info("Retention sweep", "result", result, logTag)
+	}
+
+	return results, nil
+}
+
+func (r *Retention) delete(result *RetentionSweepResult, file *retentionFile) {
+	if err := os.Remove(file.path); err != nil {
+		slog.Error("Retention delete file failed", "err", err, "file", file.path, logTag)
+		return
+	}
+
+	result.Deleted++
+	result.DeletedBytes += file.size
+	metricRetentionDeletedFiles.add(1, result.Artifact)
+	metricRetentionDeletedBytes.add(float64(file.size), result.Artifact)
+}
+
+// compressFile gzips the file next to it and removes it, the compressed file
+// keeps its modification time so that it ages the same.
+func compressFile(file *retentionFile) (*retentionFile, error) {
+	src, err := os.Open(file.path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	path := file.path + retentionCompressedSuffix
+	tmp := path + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, file.modTime, file.modTime)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	os.Remove(file.path)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &retentionFile{path: path, size: info.Size(), modTime: file.modTime}, nil
+}
+
+func (s *HttpServer) handlerRetentionSweep(c *gin.Context) {
+	results, err := s.config.Retention.sweep()
+	if err != nil {
+		slog.Error("handlerRetentionSweep sweep failed", "err", err, logTag)
+		s.output(c, codeErrRetentionSweepFailed, nil, http.StatusInternalServerError)
+		return
+	}
+
+	s.output(c, codeSuccess, map[string]any{"results": results})
+}
@@ -0,0 +1,386 @@
+package internal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/joho/godotenv"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// SecretsProvider provides the secrets referenced by the ${env:NAME}
+// placeholders of the graphs, instead of the environment of the server.
+type SecretsProvider interface {
+	// Secrets returns the secrets of the tenant by name, the names the tenant
+	// has no secret for are left out.
+	Secrets(tenant string, names []string) (map[string]string, error)
+}
+
+// SecretsConfig configures the secrets provider.
+type SecretsConfig struct {
+	Provider   string
+	EnvFileDir string // env_file only, the secrets of a tenant are in <tenant>.env
+	File       string // encrypted_file only
+	Key        string // encrypted_file only, base64 AES-256 key
+	HttpUrl    string // http only, {tenant} is replaced by the tenant
+	HttpToken  string // http only
+}
+
+// envFileSecrets reads the secrets of a tenant from its env file.
+type envFileSecrets struct {
+	dir string
+}
+
+// encryptedFileSecrets reads the secrets by tenant from a JSON file encrypted
+// with AES-256-GCM, e.g. {"acme":{"OPENAI_API_KEY":"..."}}.
+type encryptedFileSecrets struct {
+	file string
+	key  []byte
+}
+
+// httpSecrets reads the secrets of a tenant from a Vault-style KV http api.
+type httpSecrets struct {
+	url    string
+	token  string
+	client *resty.Client
+}
+
+// secretsError is the placeholders of a property file which can't be resolved.
+type secretsError struct {
+	errs []*GraphFieldError
+}
+
+const (
+	// Secrets providers
+	SecretsProviderNone          = "none"
+	SecretsProviderEnvFile       = "env_file"
+	SecretsProviderEncryptedFile = "encrypted_file"
+	SecretsProviderHttp          = "http"
+
+	// The secrets of the default tenant apply to all tenants, and to all
+	// requests when auth is disabled
+	secretsDefaultTenant = "default"
+
+	secretsHttpHeaderToken = "X-Vault-Token"
+)
+
+var (
+	// Placeholders of property.json, e.g. ${env:OPENAI_API_KEY}
+	secretsEnvRegexp = regexp.MustCompile(`\$\{env:([^}|]+)`)
+)
+
+// NewSecretsProvider creates the secrets provider of the config, nil means the
+// placeholders are resolved by the workers from their environment.
+func NewSecretsProvider(config *SecretsConfig) (SecretsProvider, error) {
+	switch config.Provider {
+	case "", SecretsProviderNone:
+		return nil, nil
+	case SecretsProviderEnvFile:
+		if config.EnvFileDir == "" {
+			return nil, fmt.Errorf("env file dir missing")
+		}
+		return &envFileSecrets{dir: config.EnvFileDir}, nil
+	case SecretsProviderEncryptedFile:
+		if config.File == "" {
+			return nil, fmt.Errorf("secrets file missing")
+		}
+		key, err := decodeSecretsKey(config.Key)
+		if err != nil {
+			return nil, err
+		}
+		return &encryptedFileSecrets{file: config.File, key: key}, nil
+	case SecretsProviderHttp:
+		if !strings.HasPrefix(config.HttpUrl, "http://") && !strings.HasPrefix(config.HttpUrl, "https://") {
+			return nil, fmt.Errorf("secrets http url invalid")
+		}
+		return &httpSecrets{
+			url:    config.HttpUrl,
+			token:  config.HttpToken,
+			client: resty.New().SetRetryCount(0).SetTimeout(5 * time.Second),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown secrets provider %s", config.Provider)
+	}
+}
+
+func (p *envFileSecrets) Secrets(tenant string, names []string) (map[string]string, error) {
+	return tenantSecrets(tenant, names, func(tenant string) (map[string]string, error) {
+		// The tenants come from the auth keys, but must not point out of the dir
+		if tenant != filepath.Base(tenant) || tenant == ".." {
+			return nil, fmt.Errorf("tenant %s invalid", tenant)
+		}
+
+		values, err := godotenv.Read(filepath.Join(p.dir, tenant+".env"))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return values, err
+	})
+}
+
+func (p *encryptedFileSecrets) Secrets(tenant string, names []string) (map[string]string, error) {
+	// The file is read on every start, so that the secrets can be rotated
+	content, err := os.ReadFile(p.file)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decryptSecrets(p.key, content)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets map[string]map[string]string
+	if err = json.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, fmt.Errorf("secrets file invalid, %v", err)
+	}
+
+	return tenantSecrets(tenant, names, func(tenant string) (map[string]string, error) {
+		return secrets[tenant], nil
+	})
+}
+
+func (p *httpSecrets) Secrets(tenant string, names []string) (map[string]string, error) {
+	return tenantSecrets(tenant, names, func(tenant string) (map[string]string, error) {
+		req := p.client.R()
+		if p.token != "" {
+			req.SetHeader(secretsHttpHeaderToken, p.token)
+		}
+		res, err := req.Get(strings.ReplaceAll(p.url, "{tenant}", url.PathEscape(tenant)))
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode() == http.StatusNotFound {
+			return nil, nil
+		}
+		if res.StatusCode() != http.StatusOK {
+			return nil, fmt.Errorf("%s, status: %d", codeErrHttpStatusNotOk.msg, res.StatusCode())
+		}
+
+		// KV v2 nests the secrets in data.data, KV v1 in data
+		data := gjson.GetBytes(res.Body(), "data")
+		if nested := data.Get("data"); nested.IsObject() {
+			data = nested
+		}
+		if !data.IsObject() {
+			return nil, fmt.Errorf("secrets of tenant %s invalid", tenant)
+		}
+
+		values := make(map[string]string)
+		data.ForEach(func(key, value gjson.Result) bool {
+			values[key.String()] = value.String()
+			return true
+		})
+		return values, nil
+	})
+}
+
+// tenantSecrets picks the secrets of the names from the ones of the tenant
+// loaded by load, then from the ones of the default tenant.
+func tenantSecrets(tenant string, names []string, load func(tenant string) (map[string]string, error)) (map[string]string, error) {
+	tenants := []string{secretsDefaultTenant}
+	if tenant != "" && tenant != secretsDefaultTenant {
+		tenants = []string{tenant, secretsDefaultTenant}
+	}
+
+	secrets := make(map[string]string)
+	for _, t := range tenants {
+		values, err := load(t)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if _, ok := secrets[name]; ok {
+				continue
+			}
+			if value, ok := values[name]; ok {
+				secrets[name] = value
+			}
+		}
+	}
+	return secrets, nil
+}
+
+// decodeSecretsKey decodes the base64 AES-256 key of the encrypted secrets file.
+func decodeSecretsKey(key string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 32 {
+		return nil, fmt.Errorf("secrets key must be 32 bytes in base64")
+	}
+	return decoded, nil
+}
+
+// EncryptSecrets encrypts the secrets file content with the base64 AES-256
+// key, the nonce is prepended to the ciphertext.
+func EncryptSecrets(key string, plaintext []byte) ([]byte, error) {
+	decoded, err := decodeSecretsKey(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newSecretsGcm(decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decryptSecrets decrypts the content written by EncryptSecrets.
+func decryptSecrets(key []byte, content []byte) ([]byte, error) {
+	gcm, err := newSecretsGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) < gcm.NonceSize() {
+		return nil, fmt.Errorf("secrets file invalid")
+	}
+
+	plaintext, err := gcm.Open(nil, content[:gcm.NonceSize()], content[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt secrets file failed, %v", err)
+	}
+	return plaintext, nil
+}
+
+func newSecretsGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (e *secretsError) Error() string {
+	reasons := make([]string, 0, len(e.errs))
+	for _, err := range e.errs {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", err.Field, err.Reason))
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// propertyJsonEnvNames returns the names of the placeholders of property.json,
+// which are the only secrets a worker may reference.
+func propertyJsonEnvNames() ([]string, error) {
+	content, err := os.ReadFile(PropertyJsonFile)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, match := range secretsEnvRegexp.FindAllSubmatch(content, -1) {
+		if name := string(match[1]); !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// resolveSecrets replaces the placeholders of the properties of the graph, the
+// only one left in the property json, by the secrets of the tenant. A secret
+// the provider doesn't have is read from the environment of the server if its
+// name is in envFallback, or takes the default of its placeholder. The placeholders not in property.json,
+// e.g. of the properties of /start, are rejected, so that a request can't read
+// any secret of the server.
+func resolveSecrets(provider SecretsProvider, envFallback []string, tenant string, g *Graph, propertyJson string) (string, error) {
+	allowed, err := propertyJsonEnvNames()
+	if err != nil {
+		return "", err
+	}
+
+	type placeholder struct {
+		field string
+		path  string
+		name  string
+		def   *string
+	}
+	placeholders := []*placeholder{}
+	names := []string{}
+	errs := []*GraphFieldError{}
+
+	nodes := gjson.Get(propertyJson, "_ten.predefined_graphs.0.nodes").Array()
+	for _, node := range nodes {
+		extensionName := node.Get("name").String()
+		node.Get("property").ForEach(func(key, value gjson.Result) bool {
+			matches := graphPropertyEnvRegexp.FindStringSubmatch(value.String())
+			if value.Type != gjson.String || matches == nil {
+				return true
+			}
+
+			p := &placeholder{
+				field: fmt.Sprintf("nodes.%s.property.%s", extensionName, key.String()),
+				path:  g.propertyPath(extensionName, key.String()),
+				name:  matches[1],
+			}
+			if matches[2] != "" {
+				def := strings.TrimPrefix(matches[2], "|")
+				p.def = &def
+			}
+			if !slices.Contains(allowed, p.name) {
+				errs = append(errs, &GraphFieldError{Field: p.field, Reason: fmt.Sprintf("secret %s not referenced by property.json", p.name)})
+				return true
+			}
+
+			placeholders = append(placeholders, p)
+			if !slices.Contains(names, p.name) {
+				names = append(names, p.name)
+			}
+			return true
+		})
+	}
+
+	secrets, err := provider.Secrets(tenant, names)
+	if err != nil {
+		return "", err
+	}
+
+	for _, p := range placeholders {
+		value, ok := secrets[p.name]
+		if !ok && slices.Contains(envFallback, p.name) {
+			value, ok = os.LookupEnv(p.name)
+		}
+		if !ok && p.def != nil {
+			value, ok = *p.def, true
+		}
+		if !ok {
+			errs = append(errs, &GraphFieldError{Field: p.field, Reason: fmt.Sprintf("secret %s not found", p.name)})
+			continue
+		}
+
+		if propertyJson, err = sjson.Set(propertyJson, p.path, value); err != nil {
+			return "", err
+		}
+	}
+
+	if len(errs) > 0 {
+		return "", &secretsError{errs: errs}
+	}
+	return propertyJson, nil
+}
+
+// withoutEnvs returns the environment without the variables of the names.
+func withoutEnvs(environ []string, names []string) []string {
+	return slices.DeleteFunc(slices.Clone(environ), func(env string) bool {
+		name, _, _ := strings.Cut(env, "=")
+		return slices.Contains(names, name)
+	})
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// mapSecrets is a provider of the secrets by tenant.
+type mapSecrets map[string]map[string]string
+
+func (p mapSecrets) Secrets(tenant string, names []string) (map[string]string, error) {
+	return tenantSecrets(tenant, names, func(tenant string) (map[string]string, error) {
+		return p[tenant], nil
+	})
+}
+
+func TestEncryptSecrets(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("k"), 32))
+	otherKey := bytes.Repeat([]byte("o"), 32)
+	plaintext := []byte(`{"acme":{"OPENAI_API_KEY":"sk-test"}}`)
+
+	content, err := EncryptSecrets(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(content, []byte("sk-test")) {
+		t.Fatal("content has the plaintext")
+	}
+	if again, _ := EncryptSecrets(key, plaintext); bytes.Equal(again, content) {
+		t.Fatal("content encrypted twice is the same, want a new nonce")
+	}
+
+	decoded, _ := base64.StdEncoding.DecodeString(key)
+	tampered := bytes.Clone(content)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		key     []byte
+		content []byte
+		ok      bool
+	}{
+		{"decrypted", decoded, content, true},
+		{"other key", otherKey, content, false},
+		{"tampered", decoded, tampered, false},
+		{"truncated", decoded, content[:4], false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decryptSecrets(tt.key, tt.content)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && !bytes.Equal(got, plaintext) {
+				t.Fatalf("plaintext = %s, want %s", got, plaintext)
+			}
+		})
+	}
+}
+
+func TestEncryptSecretsKeyInvalid(t *testing.T) {
+	for _, key := range []string{"", "not base64", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := EncryptSecrets(key, []byte("{}")); err == nil {
+			t.Fatalf("key %q: err = nil, want key invalid", key)
+		}
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	chdirTemp(t)
+	writeTestFile(t, PropertyJsonFile, `{"_ten": {"predefined_graphs": [{"name": "test", "nodes": [
+		{"type": "extension", "name": "agora_rtc", "property": {"app_id": "${env:AGORA_APP_ID}"}},
+		{"type": "extension", "name": "openai_chatgpt", "property": {"api_key": "${env:OPENAI_API_KEY}", "proxy_url": "${env:OPENAI_PROXY_URL|}"}}
+	]}]}}`)
+	t.Setenv("AGORA_APP_ID", "app-id")
+	t.Setenv("OPENAI_API_KEY", "sk-server")
+	t.Setenv("SECRETS_KEY", "server-key")
+
+	g := &Graph{Name: "test", Nodes: []*GraphNode{
+		{Type: graphNodeTypeExtension, Name: "agora_rtc"},
+		{Type: graphNodeTypeExtension, Name: "openai_chatgpt"},
+	}}
+	propertyJson := `{"_ten": {"predefined_graphs": [{"name": "test", "nodes": [
+		{"type": "extension", "name": "agora_rtc", "property": {"app_id": "${env:AGORA_APP_ID}"}},
+		{"type": "extension", "name": "openai_chatgpt", "property": {"api_key": "${env:OPENAI_API_KEY}", "proxy_url": "${env:OPENAI_PROXY_URL|}", "prompt": "${env:SECRETS_KEY}"}}
+	]}]}}`
+	provider := mapSecrets{"acme": {"OPENAI_API_KEY": "sk-acme"}}
+
+	// The variables of the server are only read if they fall back
+	_, err := resolveSecrets(provider, nil, "acme", g, propertyJson)
+	var secretsErr *secretsError
+	if !errors.As(err, &secretsErr) {
+		t.Fatalf("err = %v, want secrets error", err)
+	}
+	want := []*GraphFieldError{
+		{Field: "nodes.openai_chatgpt.property.prompt", Reason: "secret SECRETS_KEY not referenced by property.json"},
+		{Field: "nodes.agora_rtc.property.app_id", Reason: "secret AGORA_APP_ID not found"},
+	}
+	if fieldErrorsString(secretsErr.errs) != fieldErrorsString(want) {
+		t.Fatalf("errs = %s, want %s", fieldErrorsString(secretsErr.errs), fieldErrorsString(want))
+	}
+
+	propertyJson, _ = sjson.Delete(propertyJson, "_ten.predefined_graphs.0.nodes.1.property.prompt")
+	resolved, err := resolveSecrets(provider, []string{"AGORA_APP_ID"}, "acme", g, propertyJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, value := range map[string]string{
+		"_ten.predefined_graphs.0.nodes.0.property.app_id":    "app-id",
+		"_ten.predefined_graphs.0.nodes.1.property.api_key":   "sk-acme",
+		"_ten.predefined_graphs.0.nodes.1.property.proxy_url": "",
+	} {
+		if got := gjson.Get(resolved, path).String(); got != value {
+			t.Fatalf("%s = %q, want %q", path, got, value)
+		}
+	}
+}
+
+func TestWithoutEnvs(t *testing.T) {
+	environ := []string{"PATH=/usr/bin", "SECRETS_KEY=key", "OPENAI_API_KEY=sk", "AUTH_KEYS={}"}
+	got := withoutEnvs(environ, serverEnvNames)
+
+	want := []string{"PATH=/usr/bin", "OPENAI_API_KEY=sk"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("environ = %v, want %v", got, want)
+	}
+	if len(environ) != 4 {
+		t.Fatalf("environ changed to %v", environ)
+	}
+}
@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	accesstoken "github.com/AgoraIO/Tools/DynamicKey/AgoraDynamicKey/go/src/accesstoken2"
+	rtmtokenbuilder "github.com/AgoraIO/Tools/DynamicKey/AgoraDynamicKey/go/src/rtmtokenbuilder2"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/google/uuid"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// Token roles
+	TokenRolePublisher  = "publisher"
+	TokenRoleSubscriber = "subscriber"
+
+	// Privileges of the RTC tokens
+	tokenPrivilegeJoinChannel        = "join_channel"
+	tokenPrivilegePublishAudioStream = "publish_audio_stream"
+	tokenPrivilegePublishVideoStream = "publish_video_stream"
+	tokenPrivilegePublishDataStream  = "publish_data_stream"
+
+	// Max length of the account of a RTM token, the RTC ones allow 255 bytes
+	tokenRtmAccountMaxBytes = 64
+
+	// Cmd sent to the worker's http_server with its new token
+	workerCmdUpdateToken = "update_token"
+	// Interval of the check of the tokens of the workers
+	tokenRefreshCheckSeconds = 30
+)
+
+var (
+	tokenPrivileges = map[string]uint16{
+		tokenPrivilegeJoinChannel:        accesstoken.PrivilegeJoinChannel,
+		tokenPrivilegePublishAudioStream: accesstoken.PrivilegePublishAudioStream,
+		tokenPrivilegePublishVideoStream: accesstoken.PrivilegePublishVideoStream,
+		tokenPrivilegePublishDataStream:  accesstoken.PrivilegePublishDataStream,
+	}
+
+	// Privileges of the tokens by role
+	tokenRolePrivileges = map[string][]string{
+		TokenRolePublisher:  {tokenPrivilegeJoinChannel, tokenPrivilegePublishAudioStream, tokenPrivilegePublishVideoStream, tokenPrivilegePublishDataStream},
+		TokenRoleSubscriber: {tokenPrivilegeJoinChannel},
+	}
+)
+
+// tokenExpireAllowed checks whether the expire is within the bounds of the server.
+func (s *HttpServer) tokenExpireAllowed(expireSeconds uint32) bool {
+	return expireSeconds >= s.config.TokenExpireSecondsMin && expireSeconds <= s.config.TokenExpireSecondsMax
+}
+
+// buildRtcToken builds the RTC token of the account in the channel, with the
+// privileges of the role expiring after their seconds, or with the token.
+func (s *HttpServer) buildRtcToken(channelName string, account string, role string, expireSeconds uint32, privilegeExpireSeconds map[string]uint32) (string, error) {
+	token := accesstoken.NewAccessToken(s.config.AppId, s.config.AppCertificate, expireSeconds)
+
+	serviceRtc := accesstoken.NewServiceRtc(channelName, account)
+	for _, privilege := range tokenRolePrivileges[role] {
+		privilegeExpire, ok := privilegeExpireSeconds[privilege]
+		if !ok {
+			privilegeExpire = expireSeconds
+		}
+		serviceRtc.AddPrivilege(tokenPrivileges[privilege], privilegeExpire)
+	}
+	token.AddService(serviceRtc)
+
+	return token.Build()
+}
+
+// workerToken builds the token the worker joins the channel with, valid for
+// any uid.
+func (s *HttpServer) workerToken(channelName string) (token string, expireTs int64, err error) {
+	if s.config.AppCertificate == "" {
+		return s.config.AppId, 0, nil
+	}
+
+	expireTs = time.Now().Unix() + int64(s.config.TokenExpireSeconds)
+	token, err = s.buildRtcToken(channelName, "", TokenRoleSubscriber, s.config.TokenExpireSeconds, nil)
+	return
+}
+
+// refreshWorkerTokens refreshes the tokens of the workers before they expire,
+// as the sessions of the workers may outlive them.
+func (s *HttpServer) refreshWorkerTokens() {
+	if s.config.AppCertificate == "" {
+		return
+	}
+
+	for {
+		time.Sleep(tokenRefreshCheckSeconds * time.Second)
+
+		nowTs := time.Now().Unix()
+		for _, v := range workers.Values() {
+			worker := v.(*Worker)
+			if worker.TokenExpireTs == 0 || worker.TokenExpireTs-int64(s.config.TokenRefreshBeforeSeconds) > nowTs {
+				continue
+			}
+
+			if err := s.refreshWorkerToken(worker); err != nil {
+				slog.Error("Worker refresh token failed", "err", err, "channelName", worker.ChannelName, "tokenExpireTs", worker.TokenExpireTs, logTag)
+				continue
+			}
+			slog.Info("Worker refresh token success", "channelName", worker.ChannelName, "tokenExpireTs", worker.TokenExpireTs, logTag)
+		}
+	}
+}
+
+// refreshWorkerToken writes a new token to the property file of the worker,
+// which a restarted worker reads, and sends it to the worker if its graph
+// routes the update_token cmd to agora_rtc. The token of a worker not routing
+// it expires, until the worker is restarted.
+func (s *HttpServer) refreshWorkerToken(w *Worker) error {
+	token, expireTs, err := s.workerToken(w.ChannelName)
+	if err != nil {
+		return err
+	}
+
+	if err = rewriteWorkerToken(w.PropertyJsonFile, token); err != nil {
+		return err
+	}
+
+	requestId := uuid.New().String()
+	updated := w.routesCmd(workerCmdUpdateToken)
+	if updated {
+		err = w.update(&WorkerUpdateReq{
+			RequestId:   requestId,
+			ChannelName: w.ChannelName,
+			Token:       token,
+			Ten: &WorkerUpdateReqTen{
+				Name: workerCmdUpdateToken,
+				Type: "cmd",
+			},
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		slog.Warn("Worker refresh token not sent, update_token not routed", "channelName", w.ChannelName, "tokenExpireTs", w.TokenExpireTs, "requestId", requestId, logTag)
+	}
+
+	w.TokenExpireTs = expireTs
+	workersStore.save()
+	workerEvents.publish(workerEventTokenRefreshed, w.ChannelName, map[string]any{"request_id": requestId, "token_expire_ts": expireTs, "updated": updated})
+	return nil
+}
+
+// rewriteWorkerToken sets the token of the agora_rtc extension in the property
+// file of a worker.
+func rewriteWorkerToken(propertyJsonFile string, token string) error {
+	content, err := os.ReadFile(propertyJsonFile)
+	if err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(gjson.GetBytes(content, "_ten.predefined_graphs.0.nodes").Array(), func(node gjson.Result) bool {
+		return node.Get("type").String() == graphNodeTypeExtension && node.Get("name").String() == extensionNameAgoraRTC
+	})
+	if i < 0 {
+		return fmt.Errorf("extension %s not found", extensionNameAgoraRTC)
+	}
+
+	if content, err = sjson.SetBytes(content, fmt.Sprintf("_ten.predefined_graphs.0.nodes.%d.property.token", i), token); err != nil {
+		return err
+	}
+	return os.WriteFile(propertyJsonFile, content, 0600)
+}
+
+func (s *HttpServer) handlerGenerateToken(c *gin.Context) {
+	var req GenerateTokenReq
+
+	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		slog.Error("handlerGenerateToken params invalid", "err", err, logTag)
+		s.output(c, codeErrParamsInvalid, nil, http.StatusBadRequest)
+		return
+	}
+
+	slog.Info("handlerGenerateToken start", "req", req, logTag)
+
+	if strings.TrimSpace(req.ChannelName) == "" {
+		slog.Error("handlerGenerateToken channel empty", "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
+		s.output(c, codeErrChannelEmpty, nil, http.StatusBadRequest)
+		return
+	}
+
+	// The account is the uid as a string unless a string account is given
+	account := req.Account
+	if req.Uid != 0 {
+		account = accesstoken.GetUidStr(req.Uid)
+	}
+	if req.Role == "" {
+		req.Role = TokenRolePublisher
+	}
+	if req.ExpireSeconds == 0 {
+		req.ExpireSeconds = s.config.TokenExpireSeconds
+	}
+
+	var reason string
+	switch {
+	case req.Uid != 0 && req.Account != "":
+		reason = "uid and account are exclusive"
+	case len(account) > 255:
+		reason = "account too long"
+	case tokenRolePrivileges[req.Role] == nil:
+		reason = fmt.Sprintf("role %s unknown", req.Role)
+	case req.Rtm && (account == "" || len(account) > tokenRtmAccountMaxBytes):
+		reason = fmt.Sprintf("rtm requires a uid or an account of at most %d bytes", tokenRtmAccountMaxBytes)
+	}
+	for privilege := range req.PrivilegeExpireSeconds {
+		if !slices.Contains(tokenRolePrivileges[req.Role], privilege) {
+			reason = fmt.Sprintf("privilege %s not granted to role %s", privilege, req.Role)
+		}
+	}
+	if reason != "" {
+		slog.Error("handlerGenerateToken params invalid", "reason", reason, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
+		s.output(c, codeErrParamsInvalid, map[string]any{"reason": reason}, http.StatusBadRequest)
+		return
+	}
+
+	// A privilege expires with the token at the latest
+	expireAllowed := s.tokenExpireAllowed(req.ExpireSeconds)
+	for _, privilegeExpire := range req.PrivilegeExpireSeconds {
+		expireAllowed = expireAllowed && s.tokenExpireAllowed(privilegeExpire) && privilegeExpire <= req.ExpireSeconds
+	}
+	if !expireAllowed {
+		slog.Error("handlerGenerateToken expire not allowed", "expireSeconds", req.ExpireSeconds, "privilegeExpireSeconds", req.PrivilegeExpireSeconds, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
+		s.output(c, codeErrTokenExpireInvalid, map[string]any{"min_expire_seconds": s.config.TokenExpireSecondsMin, "max_expire_seconds": s.config.TokenExpireSecondsMax}, http.StatusBadRequest)
+		return
+	}
+
+	data := map[string]any{"appId": s.config.AppId, "channel_name": req.ChannelName, "uid": req.Uid, "account": req.Account, "role": req.Role}
+	if s.config.AppCertificate == "" {
+		data["token"] = s.config.AppId
+		if req.Rtm {
+			data["rtm_token"] = s.config.AppId
+		}
+		s.output(c, codeSuccess, data)
+		return
+	}
+
+	token, err := s.buildRtcToken(req.ChannelName, account, req.Role, req.ExpireSeconds, req.PrivilegeExpireSeconds)
+	if err == nil && req.Rtm {
+		data["rtm_token"], err = rtmtokenbuilder.BuildToken(s.config.AppId, s.config.AppCertificate, account, req.ExpireSeconds)
+	}
+	if err != nil {
+		slog.Error("handlerGenerateToken generate token failed", "err", err, "requestId", req.RequestId, logTag)
+		s.output(c, codeErrGenerateTokenFailed, nil, http.StatusBadRequest)
+		return
+	}
+	data["token"] = token
+	data["expire_ts"] = time.Now().Unix() + int64(req.ExpireSeconds)
+
+	slog.Info("handlerGenerateToken end", "role", req.Role, "expireSeconds", req.ExpireSeconds, "rtm", req.Rtm, "requestId", req.RequestId, logTag)
+	s.output(c, codeSuccess, data)
+}
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestRefreshWorkerTokenNotRouted(t *testing.T) {
+	propertyJsonFile := filepath.Join(t.TempDir(), "property.json")
+	writeTestFile(t, propertyJsonFile, `{"_ten": {"predefined_graphs": [{"name": "test", "nodes": [
+		{"type": "extension_group", "name": "default"},
+		{"type": "extension", "name": "agora_rtc", "addon": "agora_rtc", "property": {"token": "old"}}
+	]}]}}`)
+
+	s := &HttpServer{config: &HttpServerConfig{
+		AppId:              "0123456789abcdef0123456789abcdef",
+		AppCertificate:     "fedcba9876543210fedcba9876543210",
+		TokenExpireSeconds: 3600,
+	}}
+	w := &Worker{ChannelName: "test", PropertyJsonFile: propertyJsonFile, TokenExpireTs: 1}
+	if err := s.refreshWorkerToken(w); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := os.ReadFile(propertyJsonFile)
+	if token := gjson.GetBytes(content, "_ten.predefined_graphs.0.nodes.1.property.token").String(); token == "" || token == "old" {
+		t.Fatalf("token = %q, want a new token", token)
+	}
+	if w.TokenExpireTs <= 1 {
+		t.Fatalf("tokenExpireTs = %d, want the expiry of the new token", w.TokenExpireTs)
+	}
+}
+
+func TestRewriteWorkerTokenAgoraRTCMissing(t *testing.T) {
+	propertyJsonFile := filepath.Join(t.TempDir(), "property.json")
+	writeTestFile(t, propertyJsonFile, `{"_ten": {"predefined_graphs": [{"name": "test", "nodes": [
+		{"type": "extension", "name": "openai_chatgpt", "addon": "openai_chatgpt"}
+	]}]}}`)
+
+	if err := rewriteWorkerToken(propertyJsonFile, "token"); err == nil {
+		t.Fatal("err = nil, want agora_rtc not found")
+	}
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gogf/gf/crypto/gmd5"
+)
+
+type WorkerTranscriptReq struct {
+	Format string `form:"format,omitempty" binding:"omitempty,oneof=json jsonl"`
+}
+
+const (
+	// Environment telling the worker where to record its transcript
+	agentTranscriptFileEnv = "AGENT_TRANSCRIPT_FILE"
+
+	transcriptFileSuffix = ".transcript.jsonl"
+
+	// Transcript formats
+	transcriptFormatJson  = "json"
+	transcriptFormatJsonl = "jsonl"
+)
+
+// transcriptFile returns the transcript file next to the log file of the worker.
+func transcriptFile(logFile string) string {
+	return strings.TrimSuffix(logFile, ".log") + transcriptFileSuffix
+}
+
+// lastTranscriptFile returns the transcript file of the last worker of the
+// channel in the log path, for the workers which are no longer kept in memory.
+func (s *HttpServer) lastTranscriptFile(channelName string) string {
+	files, err := filepath.Glob(fmt.Sprintf("%s/app-%s-*%s", s.config.LogPath, gmd5.MustEncryptString(channelName), transcriptFileSuffix))
+	if err != nil || len(files) == 0 {
+		return ""
+	}
+
+	// The file names only differ by the start time of the worker
+	sort.Strings(files)
+	return files[len(files)-1]
+}
+
+// readTranscript returns the records of the transcript file, the lines which
+// are not JSON, e.g. cut when the worker was killed, are skipped.
+func readTranscript(file string) ([]json.RawMessage, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []json.RawMessage{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, logReadChunkBytes), 16*1024*1024)
+	for scanner.Scan() {
+		if line := scanner.Bytes(); json.Valid(line) {
+			records = append(records, append(json.RawMessage{}, line...))
+		}
+	}
+	return records, scanner.Err()
+}
+
+func (s *HttpServer) handlerWorkerTranscript(c *gin.Context) {
+	channelName := c.Param("channel")
+
+	var req WorkerTranscriptReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		slog.Error("handlerWorkerTranscript params invalid", "err", err, "channelName", channelName, logTag)
+		s.output(c, codeErrParamsInvalid, nil, http.StatusBadRequest)
+		return
+	}
+
+	// The transcript of a worker forgotten after exit is only served to admins,
+	// as its tenant is no longer known
+	var file string
+	if worker := findWorker(channelName); worker != nil {
+		if canAccess(c, worker.Tenant) {
+			file = worker.TranscriptFile
+		}
+	} else if key := requestKey(c); key == nil || key.Admin {
+		file = s.lastTranscriptFile(channelName)
+	}
+	if file == "" {
+		slog.Error("handlerWorkerTranscript channel not existed", "channelName", channelName, logTag)
+		s.output(c, codeErrChannelNotExisted, nil, http.StatusBadRequest)
+		return
+	}
+
+	if req.Format == transcriptFormatJsonl {
+		if _, err := os.Stat(file); err != nil {
+			slog.Error("handlerWorkerTranscript transcript file not found", "err", err, "channelName", channelName, "transcriptFile", file, logTag)
+			s.output(c, codeErrReadTranscriptFailed, nil, http.StatusNotFound)
+			return
+		}
+		c.FileAttachment(file, fmt.Sprintf("transcript-%s.jsonl", channelName))
+		return
+	}
+
+	records, err := readTranscript(file)
+	if err != nil {
+		slog.Error("handlerWorkerTranscript read transcript failed", "err", err, "channelName", channelName, "transcriptFile", file, logTag)
+		s.output(c, codeErrReadTranscriptFailed, nil, http.StatusNotFound)
+		return
+	}
+
+	s.output(c, codeSuccess, map[string]any{"channel_name": channelName, "records": records})
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gogf/gf/container/gmap"
+)
+
+const (
+	// Types of the documents which can be uploaded
+	UploadTypePdf      = "application/pdf"
+	UploadTypeText     = "text/plain"
+	UploadTypeMarkdown = "text/markdown"
+	UploadTypeDocx     = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+
+	// Bytes of the multipart form besides the file, allowed beyond the max size of the upload
+	uploadFormOverheadBytes = 64 * 1024
+
+	uploadRoutePath = "/vector/document/upload"
+)
+
+var (
+	UploadTypes = []string{UploadTypePdf, UploadTypeText, UploadTypeMarkdown, UploadTypeDocx}
+
+	// Extension of the saved upload by type, the one of the client is not trusted
+	uploadTypeExts = map[string]string{
+		UploadTypePdf:      ".pdf",
+		UploadTypeText:     ".txt",
+		UploadTypeMarkdown: ".md",
+		UploadTypeDocx:     ".docx",
+	}
+
+	// Ingestion jobs of the documents uploaded by tenant, by the key of uploadDigestKey
+	uploadJobs = gmap.NewStrStrMap(true)
+)
+
+// sniffUploadType returns the type of the document by its content, empty if
+// it's not one of UploadTypes. The file name only tells markdown from text.
+func sniffUploadType(file multipart.File, size int64, fileName string) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	contentType, _, _ := strings.Cut(http.DetectContentType(head[:n]), ";")
+	switch contentType {
+	case UploadTypePdf:
+		return UploadTypePdf, nil
+	case UploadTypeText:
+		switch strings.ToLower(filepath.Ext(fileName)) {
+		case ".md", ".markdown":
+			return UploadTypeMarkdown, nil
+		}
+		return UploadTypeText, nil
+	case "application/zip":
+		// A docx is a zip with the document in word/document.xml
+		reader, err := zip.NewReader(file, size)
+		if err != nil {
+			return "", nil
+		}
+		for _, f := range reader.File {
+			if f.Name == "word/document.xml" {
+				return UploadTypeDocx, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// saveUpload saves the document to the file, and returns its hex SHA-256.
+func saveUpload(src multipart.File, file string) (string, error) {
+	dst, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(dst, hash), src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file)
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// uploadDigestKey returns the key of the ingestion job of the document of the
+// digest uploaded by the tenant.
+func uploadDigestKey(tenant string, digest string) string {
+	return fmt.Sprintf("%s/%s", tenant, digest)
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testUploadFile is an uploaded file in memory.
+type testUploadFile struct {
+	*bytes.Reader
+}
+
+func (f testUploadFile) Close() error {
+	return nil
+}
+
+// testZip returns a zip of the files of the names.
+func testZip(t *testing.T, names ...string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range names {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("<xml/>"))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSniffUploadType(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileName string
+		content  []byte
+		typ      string
+	}{
+		{"pdf", "doc.pdf", []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n"), UploadTypePdf},
+		{"pdf named as text", "doc.txt", []byte("%PDF-1.7\n"), UploadTypePdf},
+		{"text", "notes.txt", []byte("hello world"), UploadTypeText},
+		{"markdown", "README.MD", []byte("# Title\n\nhello"), UploadTypeMarkdown},
+		{"markdown long extension", "notes.markdown", []byte("# Title"), UploadTypeMarkdown},
+		{"empty", "empty.txt", []byte{}, UploadTypeText},
+		{"docx", "doc.docx", testZip(t, "[Content_Types].xml", "word/document.xml"), UploadTypeDocx},
+		{"zip", "doc.docx", testZip(t, "data.csv"), ""},
+		{"html", "page.txt", []byte("<!DOCTYPE html><html></html>"), ""},
+		{"png", "image.pdf", []byte("\x89PNG\r\n\x1a\n"), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := testUploadFile{bytes.NewReader(tt.content)}
+			typ, err := sniffUploadType(file, int64(len(tt.content)), tt.fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if typ != tt.typ {
+				t.Fatalf("type = %q, want %q", typ, tt.typ)
+			}
+
+			// The file is read again from the start when saved
+			if offset, _ := file.Seek(0, io.SeekCurrent); offset != 0 {
+				t.Fatalf("offset = %d, want 0", offset)
+			}
+		})
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := &HttpServer{config: &HttpServerConfig{UploadMaxBytes: 1024}}
+
+	router := gin.New()
+	router.Use(s.bodyLimitMiddleware())
+	handler := func(c *gin.Context) {
+		_, err := c.GetRawData()
+		if s.outputBodyTooLarge(c, err) {
+			return
+		}
+		s.output(c, codeSuccess, nil)
+	}
+	router.POST("/start", handler)
+	router.POST(uploadRoutePath, handler)
+
+	tests := []struct {
+		name   string
+		path   string
+		size   int
+		status int
+		code   string
+	}{
+		{"request", "/start", 1024, http.StatusOK, codeSuccess.code},
+		{"request too large", "/start", requestBodyMaxBytes + 1, http.StatusRequestEntityTooLarge, codeErrRequestTooLarge.code},
+		{"upload", uploadRoutePath, 1024 + uploadFormOverheadBytes, http.StatusOK, codeSuccess.code},
+		{"upload too large", uploadRoutePath, 1024 + uploadFormOverheadBytes + 1, http.StatusRequestEntityTooLarge, codeErrUploadTooLarge.code},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(strings.Repeat("a", tt.size))))
+
+			var resp struct {
+				Code string `json:"code"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if w.Code != tt.status || resp.Code != tt.code {
+				t.Fatalf("status = %d, code = %s, want %d, %s", w.Code, resp.Code, tt.status, tt.code)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -11,34 +12,89 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
-	"sync/atomic"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/gogf/gf/container/gmap"
 	"github.com/google/uuid"
+	"github.com/tidwall/gjson"
 )
 
 type Worker struct {
-	ChannelName        string
-	HttpServerPort     int32
-	LogFile            string
-	Log2Stdout         bool
-	PropertyJsonFile   string
-	Pid                int
-	QuitTimeoutSeconds int
-	CreateTs           int64
-	UpdateTs           int64
+	ChannelName         string `json:"channel_name"`
+	GraphName           string `json:"graph_name"`
+	Tenant              string `json:"tenant,omitempty"`
+	HttpServerPort      int32  `json:"http_server_port"`
+	LogFile             string `json:"log_file"`
+	Log2Stdout          bool   `json:"log2stdout"`
+	PropertyJsonFile    string `json:"property_json_file"`
+	MetricsSocket       string `json:"metrics_socket,omitempty"`
+	TracesFile          string `json:"traces_file,omitempty"`
+	TranscriptFile      string `json:"transcript_file,omitempty"`
+	SecretsResolved     bool   `json:"secrets_resolved,omitempty"` // the property file has secrets, deleted on exit
+	TokenExpireTs       int64  `json:"token_expire_ts,omitempty"`  // the token is refreshed before, zero if it doesn't expire
+	Pid                 int    `json:"pid"`
+	QuitTimeoutSeconds  int    `json:"quit_timeout_seconds"`
+	StartTimeoutSeconds int    `json:"start_timeout_seconds"`
+	StopDrainSeconds    int    `json:"stop_drain_seconds"`
+	StopTimeoutSeconds  int    `json:"stop_timeout_seconds"`
+	CreateTs            int64  `json:"create_ts"`
+	UpdateTs            int64  `json:"update_ts"`
+	ExitTs              int64  `json:"exit_ts,omitempty"`
+
+	RestartPolicy *WorkerRestartPolicy `json:"restart_policy,omitempty"`
+	RestartCount  int                  `json:"restart_count"`
+	Runtime       *WorkerRuntimeConfig `json:"runtime,omitempty"`
+
+	runtime  WorkerRuntime
+	cmd      *exec.Cmd     // only set for the workers started by this server
+	exited   chan struct{} // closed when the worker process exits
+	logRing  *logRing      // last log lines, only kept when logging to stdout
+	lock     sync.Mutex    // guards stopping against restarts
+	stopping bool
+}
+
+// WorkerInfo is the detailed view of a worker returned by /workers.
+type WorkerInfo struct {
+	ChannelName        string        `json:"channel_name"`
+	GraphName          string        `json:"graph_name"`
+	Tenant             string        `json:"tenant,omitempty"`
+	Pid                int           `json:"pid"`
+	HttpServerPort     int32         `json:"http_server_port"`
+	UptimeSeconds      int64         `json:"uptime_seconds"`
+	CreateTs           int64         `json:"create_ts"`
+	LastPingTs         int64         `json:"last_ping_ts"`
+	QuitTimeoutSeconds int           `json:"quit_timeout_seconds"`
+	RestartCount       int           `json:"restart_count"`
+	LogFile            string        `json:"log_file"`
+	PropertyJsonFile   string        `json:"property_json_file"`
+	TranscriptFile     string        `json:"transcript_file,omitempty"`
+	Stats              *ProcessStats `json:"stats"`
+}
+
+// WorkerStopStage is the result of one stage of the worker shutdown.
+type WorkerStopStage struct {
+	Stage  string `json:"stage"`
+	Ok     bool   `json:"ok"`
+	Err    string `json:"err,omitempty"`
+	Exited bool   `json:"exited"`
+	CostMs int64  `json:"cost_ms"`
 }
 
 type WorkerUpdateReq struct {
-	RequestId   string              `form:"request_id,omitempty" json:"request_id,omitempty"`
-	ChannelName string              `form:"channel_name,omitempty" json:"channel_name,omitempty"`
-	Collection  string              `form:"collection,omitempty" json:"collection"`
-	FileName    string              `form:"filename,omitempty" json:"filename"`
-	Path        string              `form:"path,omitempty" json:"path,omitempty"`
-	Ten         *WorkerUpdateReqTen `form:"_ten,omitempty" json:"_ten,omitempty"`
+	RequestId       string              `form:"request_id,omitempty" json:"request_id,omitempty"`
+	ChannelName     string              `form:"channel_name,omitempty" json:"channel_name,omitempty"`
+	Collection      string              `form:"collection,omitempty" json:"collection"`
+	FileName        string              `form:"filename,omitempty" json:"filename"`
+	Path            string              `form:"path,omitempty" json:"path,omitempty"`
+	RemoveOnChunked bool                `form:"remove_on_chunked,omitempty" json:"remove_on_chunked,omitempty"`
+	JobId           string              `form:"job_id,omitempty" json:"job_id,omitempty"`
+	CallbackUrl     string              `form:"callback_url,omitempty" json:"callback_url,omitempty"`
+	CallbackToken   string              `form:"callback_token,omitempty" json:"callback_token,omitempty"`
+	Token           string              `form:"token,omitempty" json:"token,omitempty"`
+	Ten             *WorkerUpdateReqTen `form:"_ten,omitempty" json:"_ten,omitempty"`
 }
 
 type WorkerUpdateReqTen struct {
@@ -48,36 +104,66 @@ type WorkerUpdateReqTen struct {
 
 const (
 	workerCleanSleepSeconds = 5
+	// Exited workers are kept for a while, so that their logs can still be read
+	workerExitedKeepSeconds = 3600
 	workerExec              = "/app/agents/bin/start"
 	workerHttpServerUrl     = "http://127.0.0.1"
+
+	// Cmd sent to the worker's http_server before it is terminated
+	workerCmdGoodbye = "goodbye"
+
+	// Shutdown stages
+	workerStopStageCmd     = "cmd"
+	workerStopStageSigterm = "sigterm"
+	workerStopStageSigkill = "sigkill"
 )
 
 var (
-	workers           = gmap.New(true)
-	httpServerPort    = httpServerPortMin
-	httpServerPortMin = int32(10000)
-	httpServerPortMax = int32(30000)
+	workers       = gmap.New(true)
+	exitedWorkers = gmap.New(true)
+
+	// Tenants of the channels of the workers being started, by channel name,
+	// guarded by the lock of workers
+	startingWorkers = make(map[string]string)
+
+	errWorkerChannelExisted = errors.New("channel existed")
+	errWorkersLimit         = errors.New("workers limit")
+	errWorkerCmdUnhandled   = errors.New("unhandled")
+	errWorkerCmdMissing     = errors.New("cmd missing")
 )
 
 func newWorker(channelName string, logFile string, log2Stdout bool, propertyJsonFile string) *Worker {
 	return &Worker{
-		ChannelName:        channelName,
-		LogFile:            logFile,
-		Log2Stdout:         log2Stdout,
-		PropertyJsonFile:   propertyJsonFile,
-		QuitTimeoutSeconds: 60,
-		CreateTs:           time.Now().Unix(),
-		UpdateTs:           time.Now().Unix(),
+		ChannelName:         channelName,
+		LogFile:             logFile,
+		Log2Stdout:          log2Stdout,
+		PropertyJsonFile:    propertyJsonFile,
+		QuitTimeoutSeconds:  60,
+		StartTimeoutSeconds: 30,
+		StopDrainSeconds:    2,
+		StopTimeoutSeconds:  5,
+		CreateTs:            time.Now().Unix(),
+		UpdateTs:            time.Now().Unix(),
 	}
 }
 
-func getHttpServerPort() int32 {
-	if atomic.LoadInt32(&httpServerPort) > httpServerPortMax {
-		atomic.StoreInt32(&httpServerPort, httpServerPortMin)
+func (w *Worker) info(stats *ProcessStats) *WorkerInfo {
+	return &WorkerInfo{
+		ChannelName:        w.ChannelName,
+		GraphName:          w.GraphName,
+		Tenant:             w.Tenant,
+		Pid:                w.Pid,
+		HttpServerPort:     w.HttpServerPort,
+		UptimeSeconds:      time.Now().Unix() - w.CreateTs,
+		CreateTs:           w.CreateTs,
+		LastPingTs:         w.UpdateTs,
+		QuitTimeoutSeconds: w.QuitTimeoutSeconds,
+		RestartCount:       w.RestartCount,
+		LogFile:            w.LogFile,
+		PropertyJsonFile:   w.PropertyJsonFile,
+		TranscriptFile:     w.TranscriptFile,
+		Stats:              stats,
 	}
-
-	atomic.AddInt32(&httpServerPort, 1)
-	return httpServerPort
 }
 
 // PrefixWriter is a custom writer that prefixes each line with a PID.
@@ -123,120 +209,248 @@ func isInProcessGroup(pid, pgid int) bool {
 }
 
 func (w *Worker) start(req *StartReq) (err error) {
-	shell := fmt.Sprintf("cd /app/agents && %s --property %s", workerExec, w.PropertyJsonFile)
-	slog.Info("Worker start", "requestId", req.RequestId, "shell", shell, logTag)
-	cmd := exec.Command("sh", "-c", shell)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid: true, // Start a new process group
-	}
+	slog.Info("Worker start", "requestId", req.RequestId, "runtime", w.Runtime, logTag)
 
-	var stdoutWriter, stderrWriter io.Writer
+	var stdout, stderr io.Writer
+	var stdoutPrefixWriter, stderrPrefixWriter *PrefixWriter
 	var logFile *os.File
 
 	if w.Log2Stdout {
-		// Write logs to stdout and stderr
-		stdoutWriter = os.Stdout
-		stderrWriter = os.Stderr
+		// Write logs to stdout and stderr, prefixed by the channel name
+		var stdoutWriter, stderrWriter io.Writer = os.Stdout, os.Stderr
+		if w.logRing != nil {
+			stdoutWriter = io.MultiWriter(os.Stdout, w.logRing)
+			stderrWriter = io.MultiWriter(os.Stderr, w.logRing)
+		}
+
+		stdoutPrefixWriter = &PrefixWriter{
+			prefix: "-", // Initial prefix, will update after process starts
+			writer: stdoutWriter,
+		}
+		stderrPrefixWriter = &PrefixWriter{
+			prefix: "-", // Initial prefix, will update after process starts
+			writer: stderrWriter,
+		}
+
+		stdout = stdoutPrefixWriter
+		stderr = stderrPrefixWriter
 	} else {
 		// Open the log file for writing
-		logFile, err := os.OpenFile(w.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		logFile, err = os.OpenFile(w.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
 			slog.Error("Failed to open log file", "err", err, "requestId", req.RequestId, logTag)
-			// return err
+			return
 		}
+		defer logFile.Close()
 
-		// Write logs to the log file
-		stdoutWriter = logFile
-		stderrWriter = logFile
+		// Hand the log file to the process directly instead of piping through
+		// the server, so the worker keeps logging after the server restarts
+		stdout = logFile
+		stderr = logFile
 	}
 
-	// Create PrefixWriter instances with appropriate writers
-	stdoutPrefixWriter := &PrefixWriter{
-		prefix: "-", // Initial prefix, will update after process starts
-		writer: stdoutWriter,
-	}
-	stderrPrefixWriter := &PrefixWriter{
-		prefix: "-", // Initial prefix, will update after process starts
-		writer: stderrWriter,
-	}
-
-	cmd.Stdout = stdoutPrefixWriter
-	cmd.Stderr = stderrPrefixWriter
-
-	if err = cmd.Start(); err != nil {
+	logPosition := w.logPosition()
+	pid, err := w.runtime.Start(w, stdout, stderr)
+	if err != nil {
 		slog.Error("Worker start failed", "err", err, "requestId", req.RequestId, logTag)
 		return
 	}
 
-	pid := cmd.Process.Pid
-
-	// Ensure the process has fully started
-	shell = fmt.Sprintf("pgrep -P %d", pid)
-	slog.Info("Worker get pid", "requestId", req.RequestId, "shell", shell, logTag)
-
-	var subprocessPid int
-	for i := 0; i < 10; i++ { // retry for 3 times
-		output, err := exec.Command("sh", "-c", shell).CombinedOutput()
-		if err == nil {
-			subprocessPid, err = strconv.Atoi(strings.TrimSpace(string(output)))
-			if err == nil && subprocessPid > 0 && isInProcessGroup(subprocessPid, cmd.Process.Pid) {
-				break // if pid is successfully obtained, exit loop
-			}
-		}
-		slog.Warn("Worker get pid failed, retrying...", "attempt", i+1, "pid", pid, "subpid", subprocessPid, "requestId", req.RequestId, logTag)
-		time.Sleep(1000 * time.Millisecond) // wait for 500ms
+	// Update the prefix with the actual PID
+	if w.Log2Stdout {
+		stdoutPrefixWriter.prefix = w.ChannelName
+		stderrPrefixWriter.prefix = w.ChannelName
 	}
 
-	// Update the prefix with the actual PID
-	stdoutPrefixWriter.prefix = w.ChannelName
-	stderrPrefixWriter.prefix = w.ChannelName
+	exited := make(chan struct{})
+	var waitErr error
+
 	w.Pid = pid
+	w.exited = exited
 
-	// Monitor the background process in a separate goroutine
 	go func() {
-		err := cmd.Wait() // Wait for the command to exit
-		if err != nil {
-			slog.Error("Worker process failed", "err", err, "requestId", req.RequestId, logTag)
+		state, err := w.runtime.Wait(w) // Wait for the command to exit
+		waitErr = err
+		if waitErr != nil {
+			slog.Error("Worker process failed", "err", waitErr, "requestId", req.RequestId, logTag)
 		} else {
 			slog.Info("Worker process completed successfully", "requestId", req.RequestId, logTag)
 		}
-		// Close the log file when the command finishes
-		if logFile != nil {
-			logFile.Close()
+		close(exited)
+
+		w.lock.Lock()
+		if waitErr != nil && !w.stopping {
+			metricWorkerCrashes.add(1, w.GraphName)
 		}
+		w.lock.Unlock()
+
+		exitData := map[string]any{"pid": pid}
+		if state != nil {
+			exitData["exit_code"] = state.ExitCode()
+			if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				exitData["signal"] = status.Signal().String()
+			}
+		}
+		workerEvents.publish(workerEventExited, w.ChannelName, exitData)
+	}()
+
+	// Ensure the agent has fully started
+	if err = w.waitReady(req.RequestId, exited, logPosition, time.Duration(w.StartTimeoutSeconds)*time.Second); err != nil {
+		slog.Error("Worker not ready, killing", "err", err, "pid", pid, "requestId", req.RequestId, logTag)
+		w.runtime.Stop(w)
+		<-exited
+		return
+	}
 
-		// Remove the worker from the map
-		workers.Remove(w.ChannelName)
+	// Monitor the background process in a separate goroutine
+	go func() {
+		<-exited
 
+		// Restart the crashed worker, or remove the worker from the map
+		if w.shouldRestart(waitErr) {
+			go w.restart(req)
+			return
+		}
+		removeWorker(w)
 	}()
 
 	return
 }
 
-func (w *Worker) stop(requestId string, channelName string) (err error) {
+// hasExited returns whether the worker process has exited.
+func (w *Worker) hasExited() bool {
+	select {
+	case <-w.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitExited waits for the worker process group to exit, returns false on timeout.
+func (w *Worker) waitExited(timeout time.Duration) bool {
+	deadline := time.After(timeout)
+
+	select {
+	case <-w.exited:
+	case <-deadline:
+		return false
+	}
+
+	// The group leader has exited, wait for the rest of the process group
+	for syscall.Kill(-w.Pid, 0) == nil {
+		select {
+		case <-deadline:
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	return true
+}
+
+// stop shuts the worker down in stages: a goodbye cmd is sent through the
+// worker's http_server first, so that the agent says goodbye and flushes, then
+// the process group receives SIGTERM, and SIGKILL is only sent if the worker
+// is still alive after the deadline. The goodbye stage is unhandled if the
+// graph of the worker doesn't route the cmd from its http_server.
+func (w *Worker) stop(requestId string, channelName string) (stages []*WorkerStopStage, err error) {
+	// No restart is allowed from now on
+	w.lock.Lock()
+	w.stopping = true
+	w.lock.Unlock()
+
 	slog.Info("Worker stop start", "channelName", channelName, "requestId", requestId, "pid", w.Pid, logTag)
 
-	// TODO: SIGTERM is somehow ignored by subprocess before agent is fully initialized
-	// use SIGKILL for now
-	err = syscall.Kill(-w.Pid, syscall.SIGKILL)
-	if err != nil {
-		slog.Error("Worker kill failed", "err", err, "channelName", channelName, "worker", w, "requestId", requestId, logTag)
-		return
+	runStage := func(name string, timeout time.Duration, fn func() error) *WorkerStopStage {
+		startTime := time.Now()
+		stage := &WorkerStopStage{Stage: name}
+		if err := fn(); err != nil {
+			// Nothing to wait for if the stage failed
+			stage.Err = err.Error()
+			timeout = 0
+		} else {
+			stage.Ok = true
+		}
+		stage.Exited = w.waitExited(timeout)
+		stage.CostMs = time.Since(startTime).Milliseconds()
+		stages = append(stages, stage)
+
+		slog.Info("Worker stop stage", "channelName", channelName, "stage", stage, "requestId", requestId, logTag)
+		return stage
+	}
+
+	stage := runStage(workerStopStageCmd, time.Duration(w.StopDrainSeconds)*time.Second, func() error {
+		if !w.routesCmd(workerCmdGoodbye) {
+			return errWorkerCmdUnhandled
+		}
+		return w.update(&WorkerUpdateReq{
+			RequestId:   requestId,
+			ChannelName: channelName,
+			Ten: &WorkerUpdateReqTen{
+				Name: workerCmdGoodbye,
+				Type: "cmd",
+			},
+		})
+	})
+
+	if !stage.Exited {
+		stage = runStage(workerStopStageSigterm, time.Duration(w.StopTimeoutSeconds)*time.Second, func() error {
+			return w.runtime.Signal(w, syscall.SIGTERM)
+		})
 	}
 
-	workers.Remove(channelName)
+	if !stage.Exited {
+		stage = runStage(workerStopStageSigkill, time.Duration(w.StopTimeoutSeconds)*time.Second, func() error {
+			return w.runtime.Stop(w)
+		})
+		if !stage.Ok {
+			err = fmt.Errorf("kill failed, err: %s", stage.Err)
+			slog.Error("Worker kill failed", "err", err, "channelName", channelName, "worker", w, "requestId", requestId, logTag)
+			return
+		}
+	}
+
+	removeWorker(w)
+	workerEvents.publish(workerEventStopped, channelName, map[string]any{"request_id": requestId, "stages": stages})
+	metricWorkerStops.add(1, w.GraphName)
 
 	slog.Info("Worker stop end", "channelName", channelName, "worker", w, "requestId", requestId, logTag)
 	return
 }
 
+// routesCmd checks whether the graph of the worker connects the cmd from its
+// http_server to an extension, as the http_server accepts any cmd.
+func (w *Worker) routesCmd(name string) bool {
+	if w.HttpServerPort == 0 {
+		return false
+	}
+
+	content, err := os.ReadFile(w.PropertyJsonFile)
+	if err != nil {
+		slog.Error("Worker read property file failed", "err", err, "channelName", w.ChannelName, logTag)
+		return false
+	}
+
+	return gjson.GetBytes(content, fmt.Sprintf(`_ten.predefined_graphs.0.connections.#(extension=="%s").cmd.#(name=="%s").dest.0`, extensionNameHttpServer, name)).Exists()
+}
+
 func (w *Worker) update(req *WorkerUpdateReq) (err error) {
 	slog.Info("Worker update start", "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
 
+	// The cmd names the metrics and events of the update
+	if req.Ten == nil || req.Ten.Name == "" {
+		slog.Error("Worker update error", "err", errWorkerCmdMissing, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
+		return errWorkerCmdMissing
+	}
+
 	var res *resty.Response
 
+	startTime := time.Now()
 	defer func() {
+		metricUpdateDuration.observe(time.Since(startTime).Seconds(), req.Ten.Name)
 		if err != nil {
+			metricUpdateErrors.add(1, req.Ten.Name)
 			slog.Error("Worker update error", "err", err, "channelName", req.ChannelName, "requestId", req.RequestId, logTag)
 		}
 	}()
@@ -254,10 +468,109 @@ func (w *Worker) update(req *WorkerUpdateReq) (err error) {
 		return fmt.Errorf("%s, status: %d", codeErrHttpStatusNotOk.msg, res.StatusCode())
 	}
 
+	workerEvents.publish(workerEventUpdateForwarded, req.ChannelName, map[string]any{"request_id": req.RequestId, "cmd": req.Ten.Name})
+
 	slog.Info("Worker update end", "channelName", req.ChannelName, "worker", w, "requestId", req.RequestId, logTag)
 	return
 }
 
+// reserveWorker reserves the channel for the worker the tenant is starting,
+// so that concurrent starts of the channel can't both start a worker. admit
+// is given the running workers and the tenants of the workers being started,
+// and is called under the lock of the workers, so that the limits count the
+// concurrent starts.
+func reserveWorker(channelName string, tenant string, admit func(running []*Worker, starting []string) error) (err error) {
+	workers.LockFunc(func(m map[interface{}]interface{}) {
+		_, runningOk := m[channelName]
+		_, startingOk := startingWorkers[channelName]
+		if runningOk || startingOk {
+			err = errWorkerChannelExisted
+			return
+		}
+
+		running := make([]*Worker, 0, len(m))
+		for _, v := range m {
+			running = append(running, v.(*Worker))
+		}
+		starting := make([]string, 0, len(startingWorkers))
+		for _, t := range startingWorkers {
+			starting = append(starting, t)
+		}
+		if err = admit(running, starting); err != nil {
+			return
+		}
+
+		startingWorkers[channelName] = tenant
+	})
+	return
+}
+
+// releaseWorker releases the channel reserved by reserveWorker, once its
+// worker is registered or failed to start.
+func releaseWorker(channelName string) {
+	workers.LockFunc(func(m map[interface{}]interface{}) {
+		delete(startingWorkers, channelName)
+	})
+}
+
+// registerWorker registers the started worker of the reserved channel.
+func registerWorker(w *Worker) {
+	workers.LockFunc(func(m map[interface{}]interface{}) {
+		m[w.ChannelName] = w
+		delete(startingWorkers, w.ChannelName)
+	})
+}
+
+// removeWorker removes the worker from the running workers if it has not been
+// replaced meanwhile, and keeps it as a recently exited worker.
+func removeWorker(w *Worker) {
+	removed := false
+	workers.LockFunc(func(m map[interface{}]interface{}) {
+		if v, ok := m[w.ChannelName]; ok && v.(*Worker) == w {
+			delete(m, w.ChannelName)
+			removed = true
+		}
+	})
+	if !removed {
+		return
+	}
+
+	workersStore.save()
+	httpServerPorts.release(w.HttpServerPort, w.ChannelName)
+	if w.MetricsSocket != "" {
+		os.Remove(w.MetricsSocket)
+	}
+	if w.SecretsResolved {
+		os.Remove(w.PropertyJsonFile)
+	}
+
+	w.ExitTs = time.Now().Unix()
+	exitedWorkers.Set(w.ChannelName, w)
+	quotas.recordExit(w)
+	failIngestionJobs(w.ChannelName, "worker exited")
+}
+
+// findWorker returns the running worker of the channel, or the recently exited one.
+func findWorker(channelName string) *Worker {
+	if v := workers.Get(channelName); v != nil {
+		return v.(*Worker)
+	}
+	if v := exitedWorkers.Get(channelName); v != nil {
+		return v.(*Worker)
+	}
+	return nil
+}
+
+func pruneExitedWorkers() {
+	nowTs := time.Now().Unix()
+	for _, v := range exitedWorkers.Values() {
+		worker := v.(*Worker)
+		if worker.ExitTs+workerExitedKeepSeconds < nowTs {
+			exitedWorkers.Remove(worker.ChannelName)
+		}
+	}
+}
+
 // Function to get the PIDs of running workers
 func getRunningWorkerPIDs() map[int]struct{} {
 	// Define the command to find processes
@@ -308,7 +621,10 @@ func timeoutWorkers() {
 
 			nowTs := time.Now().Unix()
 			if worker.UpdateTs+int64(worker.QuitTimeoutSeconds) < nowTs {
-				if err := worker.stop(uuid.New().String(), channelName.(string)); err != nil {
+				workerEvents.publish(workerEventTimedOut, channelName.(string), map[string]any{"update_ts": worker.UpdateTs, "quit_timeout_seconds": worker.QuitTimeoutSeconds})
+				metricWorkerTimeouts.add(1, worker.GraphName)
+
+				if _, err := worker.stop(uuid.New().String(), channelName.(string)); err != nil {
 					slog.Error("Timeout worker stop failed", "err", err, "channelName", channelName, logTag)
 					continue
 				}
@@ -317,22 +633,34 @@ func timeoutWorkers() {
 			}
 		}
 
+		workersStore.flush()
+		pruneExitedWorkers()
+		pruneIngestionJobs()
+
 		slog.Debug("Worker timeout check", "sleep", workerCleanSleepSeconds, logTag)
 		time.Sleep(workerCleanSleepSeconds * time.Second)
 	}
 }
 
 func CleanWorkers() {
-	// Stop all workers
+	// Stop all workers, in parallel as every worker may take up to its stop deadline
+	var wg sync.WaitGroup
 	for _, channelName := range workers.Keys() {
 		worker := workers.Get(channelName).(*Worker)
-		if err := worker.stop(uuid.New().String(), channelName.(string)); err != nil {
-			slog.Error("Worker cleanWorker failed", "err", err, "channelName", channelName, logTag)
-			continue
-		}
 
-		slog.Info("Worker cleanWorker success", "channelName", channelName, "worker", worker, logTag)
+		wg.Add(1)
+		go func(channelName string) {
+			defer wg.Done()
+
+			if _, err := worker.stop(uuid.New().String(), channelName); err != nil {
+				slog.Error("Worker cleanWorker failed", "err", err, "channelName", channelName, logTag)
+				return
+			}
+
+			slog.Info("Worker cleanWorker success", "channelName", channelName, "worker", worker, logTag)
+		}(channelName.(string))
 	}
+	wg.Wait()
 
 	// Get running processes with the specific command pattern
 	runningPIDs := getRunningWorkerPIDs()
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// logRing keeps the last lines written by a worker in memory, it's used to
+// serve the worker logs when they are written to stdout instead of a file.
+type logRing struct {
+	lock    sync.Mutex
+	lines   []string
+	size    int
+	next    int64 // sequence number of the next line
+	partial string
+}
+
+const (
+	logTailDefault    = 100
+	logTailMax        = 10000
+	logReadChunkBytes = 64 * 1024
+	logFollowSleepMs  = 500
+)
+
+func newLogRing(size int) *logRing {
+	return &logRing{
+		lines: make([]string, 0, size),
+		size:  size,
+	}
+}
+
+// Write implements the io.Writer interface.
+func (r *logRing) Write(p []byte) (n int, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	parts := strings.Split(r.partial+string(p), "\n")
+	r.partial = parts[len(parts)-1]
+
+	for _, line := range parts[:len(parts)-1] {
+		if len(r.lines) < r.size {
+			r.lines = append(r.lines, line)
+		} else {
+			r.lines[r.next%int64(r.size)] = line
+		}
+		r.next++
+	}
+
+	return len(p), nil
+}
+
+// since returns the lines from sequence number seq which are still kept in the
+// ring, and the sequence number to continue with.
+func (r *logRing) since(seq int64) ([]string, int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if first := r.next - int64(len(r.lines)); seq < first {
+		seq = first
+	}
+
+	lines := make([]string, 0, max(r.next-seq, 0))
+	for i := seq; i < r.next; i++ {
+		lines = append(lines, r.lines[i%int64(r.size)])
+	}
+
+	return lines, r.next
+}
+
+// tail returns the last n lines, and the sequence number to follow with.
+func (r *logRing) tail(n int) ([]string, int64) {
+	r.lock.Lock()
+	next := r.next
+	r.lock.Unlock()
+
+	return r.since(next - int64(n))
+}
+
+// tailLogFile returns the last n lines of the file, and the offset to follow with.
+func tailLogFile(file string, n int) (lines []string, offset int64, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	offset = info.Size()
+
+	// Read backwards by chunks until enough lines are found
+	var content []byte
+	pos := offset
+	for pos > 0 && bytes.Count(content, []byte("\n")) <= n {
+		chunkSize := min(pos, logReadChunkBytes)
+		pos -= chunkSize
+
+		chunk := make([]byte, chunkSize)
+		if _, err = f.ReadAt(chunk, pos); err != nil && err != io.EOF {
+			return
+		}
+		content = append(chunk, content...)
+	}
+	err = nil
+
+	lines = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(content) == 0 {
+		lines = nil
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return
+}
+
+// readLogFile reads the content appended to the file since offset.
+func readLogFile(file string, offset int64) (content []byte, next int64, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, offset, err
+	}
+	defer f.Close()
+
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+
+	content, err = io.ReadAll(f)
+	return content, offset + int64(len(content)), err
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// workerNotReadyError is returned when the worker fails to become ready, it
+// carries an excerpt of the worker log to help figuring out why.
+type workerNotReadyError struct {
+	reason string
+	log    []string
+}
+
+const (
+	// Readiness probes
+	workerReadyProbeHttpServer = "http_server" // the http_server extension accepts connections
+	workerReadyProbeLog        = "log"         // a log line matches the ready pattern
+	workerReadyProbeProcess    = "process"     // the agent process has been spawned
+
+	workerReadyCheckIntervalMs = 200
+	workerReadyLogExcerptLines = 50
+)
+
+var (
+	// Pattern of the log line printed once the graph is started, optional
+	workerReadyPattern *regexp.Regexp
+)
+
+func (e *workerNotReadyError) Error() string {
+	return fmt.Sprintf("worker not ready, %s", e.reason)
+}
+
+// readyProbe picks the readiness probe of the worker by its graph.
+func (w *Worker) readyProbe() string {
+	content, err := os.ReadFile(w.PropertyJsonFile)
+	if err == nil && gjson.GetBytes(content, fmt.Sprintf(`_ten.predefined_graphs.0.nodes.#(name=="%s")`, extensionNameHttpServer)).Exists() {
+		return workerReadyProbeHttpServer
+	}
+
+	if workerReadyPattern != nil {
+		return workerReadyProbeLog
+	}
+
+	return workerReadyProbeProcess
+}
+
+// logExcerpt returns the last lines of the worker log.
+func (w *Worker) logExcerpt(n int) []string {
+	if w.logRing != nil {
+		lines, _ := w.logRing.tail(n)
+		return lines
+	}
+
+	lines, _, _ := tailLogFile(w.LogFile, n)
+	return lines
+}
+
+// logPosition returns where the worker log currently ends, to look for the
+// ready pattern from there.
+func (w *Worker) logPosition() int64 {
+	if w.logRing != nil {
+		_, seq := w.logRing.tail(0)
+		return seq
+	}
+
+	if info, err := os.Stat(w.LogFile); err == nil {
+		return info.Size()
+	}
+	return 0
+}
+
+// waitReady waits until the probe reports the worker is ready, the worker
+// process exits, or the timeout expires.
+func (w *Worker) waitReady(requestId string, exited <-chan struct{}, logPosition int64, timeout time.Duration) error {
+	probe := w.readyProbe()
+	slog.Info("Worker wait ready", "channelName", w.ChannelName, "probe", probe, "timeout", timeout, "requestId", requestId, logTag)
+
+	var partialLine string
+	isReady := func() bool {
+		switch probe {
+		case workerReadyProbeHttpServer:
+			conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", w.HttpServerPort), workerReadyCheckIntervalMs*time.Millisecond)
+			if err != nil {
+				return false
+			}
+			conn.Close()
+			return true
+		case workerReadyProbeLog:
+			var lines []string
+			if w.logRing != nil {
+				lines, logPosition = w.logRing.since(logPosition)
+			} else {
+				content, next, err := readLogFile(w.LogFile, logPosition)
+				if err != nil {
+					return false
+				}
+				logPosition = next
+				lines = strings.Split(partialLine+string(content), "\n")
+				partialLine = lines[len(lines)-1]
+				lines = lines[:len(lines)-1]
+			}
+			for _, line := range lines {
+				if workerReadyPattern.MatchString(line) {
+					return true
+				}
+			}
+			return false
+		default:
+			stats, err := w.runtime.Stats(w)
+			return err == nil && stats.Processes > 1
+		}
+	}
+
+	startTime := time.Now()
+	deadline := time.After(timeout)
+	for !isReady() {
+		select {
+		case <-exited:
+			return &workerNotReadyError{reason: "exited before ready", log: w.logExcerpt(workerReadyLogExcerptLines)}
+		case <-deadline:
+			return &workerNotReadyError{reason: fmt.Sprintf("not ready in %s", timeout), log: w.logExcerpt(workerReadyLogExcerptLines)}
+		case <-time.After(workerReadyCheckIntervalMs * time.Millisecond):
+		}
+	}
+
+	slog.Info("Worker ready", "channelName", w.ChannelName, "probe", probe, "cost", time.Since(startTime), "requestId", requestId, logTag)
+	return nil
+}
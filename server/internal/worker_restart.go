@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// WorkerRestartPolicy decides whether a crashed worker is restarted.
+type WorkerRestartPolicy struct {
+	Policy            string `json:"policy,omitempty"`
+	MaxRetries        int    `json:"max_retries,omitempty"`
+	BackoffSeconds    int    `json:"backoff_seconds,omitempty"`
+	MaxBackoffSeconds int    `json:"max_backoff_seconds,omitempty"`
+}
+
+const (
+	// Restart policies
+	workerRestartNever     = "never"
+	workerRestartOnFailure = "on-failure"
+
+	workerRestartMaxRetriesDefault        = 3
+	workerRestartMaxRetriesMax            = 100
+	workerRestartBackoffSecondsDefault    = 1
+	workerRestartMaxBackoffSecondsDefault = 60
+)
+
+// validate checks the policy and fills the defaults.
+func (p *WorkerRestartPolicy) validate() error {
+	switch p.Policy {
+	case "", workerRestartNever:
+		p.Policy = workerRestartNever
+		return nil
+	case workerRestartOnFailure:
+	default:
+		return fmt.Errorf("unknown restart policy %s", p.Policy)
+	}
+
+	if p.MaxRetries < 0 || p.MaxRetries > workerRestartMaxRetriesMax || p.BackoffSeconds < 0 || p.MaxBackoffSeconds < 0 {
+		return fmt.Errorf("restart policy out of range")
+	}
+
+	if p.MaxRetries == 0 {
+		p.MaxRetries = workerRestartMaxRetriesDefault
+	}
+	if p.BackoffSeconds == 0 {
+		p.BackoffSeconds = workerRestartBackoffSecondsDefault
+	}
+	if p.MaxBackoffSeconds == 0 {
+		p.MaxBackoffSeconds = workerRestartMaxBackoffSecondsDefault
+	}
+
+	return nil
+}
+
+// backoff returns the delay before the next restart, doubled after every restart.
+func (p *WorkerRestartPolicy) backoff(restartCount int) time.Duration {
+	backoff := p.BackoffSeconds << min(restartCount, 16)
+	return time.Duration(min(backoff, p.MaxBackoffSeconds)) * time.Second
+}
+
+// shouldRestart returns whether the worker should be restarted after its
+// process exited with err.
+func (w *Worker) shouldRestart(err error) bool {
+	if err == nil || w.RestartPolicy == nil || w.RestartPolicy.Policy != workerRestartOnFailure {
+		return false
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return !w.stopping && w.RestartCount < w.RestartPolicy.MaxRetries
+}
+
+// restart starts the crashed worker again after the backoff, with the same
+// property file and port. The lock isn't held while starting, which waits for
+// the readiness of the worker, so the worker may be stopped meanwhile.
+func (w *Worker) restart(req *StartReq) {
+	// The jobs queued in the crashed process are lost, the new one won't report them
+	failIngestionJobs(w.ChannelName, "worker restarted")
+
+	backoff := w.RestartPolicy.backoff(w.RestartCount)
+	slog.Info("Worker restart scheduled", "channelName", w.ChannelName, "restartCount", w.RestartCount, "backoff", backoff, "requestId", req.RequestId, logTag)
+	time.Sleep(backoff)
+
+	w.lock.Lock()
+	// The worker has been stopped during the backoff
+	if w.stopping {
+		w.lock.Unlock()
+		removeWorker(w)
+		return
+	}
+	w.RestartCount++
+	w.lock.Unlock()
+
+	workerEvents.publish(workerEventRestarting, w.ChannelName, map[string]any{"request_id": req.RequestId, "restart_count": w.RestartCount})
+
+	if err := w.start(req); err != nil {
+		slog.Error("Worker restart failed", "err", err, "channelName", w.ChannelName, "restartCount", w.RestartCount, "requestId", req.RequestId, logTag)
+		removeWorker(w)
+		return
+	}
+
+	// The worker has been stopped while starting, before its new process was known
+	w.lock.Lock()
+	stopping := w.stopping
+	w.lock.Unlock()
+	if stopping {
+		slog.Info("Worker restart stopped", "channelName", w.ChannelName, "pid", w.Pid, "requestId", req.RequestId, logTag)
+		w.runtime.Stop(w)
+		return
+	}
+
+	workersStore.save()
+	slog.Info("Worker restart success", "channelName", w.ChannelName, "worker", w, "requestId", req.RequestId, logTag)
+}
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// WorkerRuntime runs the agent process of a worker.
+type WorkerRuntime interface {
+	// Start spawns the agent process of the worker and returns its pid.
+	Start(w *Worker, stdout io.Writer, stderr io.Writer) (pid int, err error)
+	// Signal sends the signal to all the processes of the worker.
+	Signal(w *Worker, sig syscall.Signal) error
+	// Stop kills all the processes of the worker.
+	Stop(w *Worker) error
+	// Wait waits for the agent process started by Start to exit.
+	Wait(w *Worker) (*os.ProcessState, error)
+	// Stats returns the resource usage of the worker.
+	Stats(w *Worker) (*ProcessStats, error)
+}
+
+// WorkerRuntimeConfig selects the runtime of the workers of a graph, and the
+// resource limits of the cgroup runtime.
+type WorkerRuntimeConfig struct {
+	Runtime        string  `json:"runtime"`
+	CgroupRoot     string  `json:"cgroup_root,omitempty"`
+	Cpus           float64 `json:"cpus,omitempty"`
+	MemoryMaxBytes int64   `json:"memory_max_bytes,omitempty"`
+	PidsMax        int64   `json:"pids_max,omitempty"`
+}
+
+// processRuntime runs the worker as a process group of the server host.
+type processRuntime struct{}
+
+const (
+	// Worker runtimes
+	workerRuntimeProcess = "process"
+	workerRuntimeCgroup  = "cgroup"
+
+	// Key of the runtime config used by graphs without their own config
+	workerRuntimeDefaultGraph = "default"
+)
+
+// newWorkerRuntime creates the runtime of the config, nil config means the
+// process runtime.
+func newWorkerRuntime(config *WorkerRuntimeConfig) (WorkerRuntime, error) {
+	if config == nil {
+		return &processRuntime{}, nil
+	}
+
+	switch config.Runtime {
+	case "", workerRuntimeProcess:
+		return &processRuntime{}, nil
+	case workerRuntimeCgroup:
+		return newCgroupRuntime(config)
+	default:
+		return nil, fmt.Errorf("unknown worker runtime %s", config.Runtime)
+	}
+}
+
+// newWorkerCmd creates the command running the agent with the worker's property file.
+func newWorkerCmd(w *Worker, stdout io.Writer, stderr io.Writer) *exec.Cmd {
+	shell := fmt.Sprintf("cd /app/agents && %s --property %s", workerExec, w.PropertyJsonFile)
+	slog.Info("Worker cmd", "channelName", w.ChannelName, "shell", shell, logTag)
+
+	cmd := exec.Command("sh", "-c", shell)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true, // Start a new process group
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = withoutEnvs(os.Environ(), serverEnvNames)
+	if w.SecretsResolved {
+		// The worker only gets the secrets of its property file
+		names, err := propertyJsonEnvNames()
+		if err != nil {
+			slog.Error("Worker read property.json env names failed", "err", err, "channelName", w.ChannelName, logTag)
+		}
+		cmd.Env = withoutEnvs(cmd.Env, names)
+	}
+	if w.MetricsSocket != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", agentMetricsSocketEnv, w.MetricsSocket))
+	}
+	if w.TracesFile != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", agentTracesFileEnv, w.TracesFile))
+	}
+	if w.TranscriptFile != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", agentTranscriptFileEnv, w.TranscriptFile))
+	}
+
+	return cmd
+}
+
+func (r *processRuntime) Start(w *Worker, stdout io.Writer, stderr io.Writer) (pid int, err error) {
+	cmd := newWorkerCmd(w, stdout, stderr)
+	if err = cmd.Start(); err != nil {
+		return
+	}
+
+	w.cmd = cmd
+	return cmd.Process.Pid, nil
+}
+
+func (r *processRuntime) Signal(w *Worker, sig syscall.Signal) error {
+	return syscall.Kill(-w.Pid, sig)
+}
+
+func (r *processRuntime) Stop(w *Worker) error {
+	return syscall.Kill(-w.Pid, syscall.SIGKILL)
+}
+
+func (r *processRuntime) Wait(w *Worker) (*os.ProcessState, error) {
+	if w.cmd == nil {
+		return nil, fmt.Errorf("worker process not started by this server")
+	}
+
+	err := w.cmd.Wait()
+	return w.cmd.ProcessState, err
+}
+
+func (r *processRuntime) Stats(w *Worker) (*ProcessStats, error) {
+	stats := getProcessGroupsStats()[w.Pid]
+	if stats == nil {
+		return nil, fmt.Errorf("process group %d not found", w.Pid)
+	}
+	return stats, nil
+}
+
+// stats returns the resource usage of the worker, or nil if unavailable. The
+// stats of all the process groups can be passed in when listing workers, to
+// scan /proc only once.
+func (w *Worker) stats(groups map[int]*ProcessStats) *ProcessStats {
+	if _, ok := w.runtime.(*processRuntime); ok && groups != nil {
+		return groups[w.Pid]
+	}
+
+	stats, err := w.runtime.Stats(w)
+	if err != nil {
+		return nil
+	}
+	return stats
+}
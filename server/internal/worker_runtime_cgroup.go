@@ -0,0 +1,185 @@
+//go:build linux
+
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cgroupRuntime runs every worker in its own cgroup v2, with limits on cpu,
+// memory and pids, so that a runaway worker can't starve the others.
+type cgroupRuntime struct {
+	config *WorkerRuntimeConfig
+	root   string
+}
+
+const (
+	workerCgroupRootDefault = "/sys/fs/cgroup/astra"
+	cgroupCpuPeriodUs       = 100000
+	cgroupCleanSleepSeconds = 1
+)
+
+func newCgroupRuntime(config *WorkerRuntimeConfig) (WorkerRuntime, error) {
+	root := config.CgroupRoot
+	if root == "" {
+		root = workerCgroupRootDefault
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("create cgroup %s failed, err: %v", root, err)
+	}
+
+	// Delegate the controllers to the cgroups of the workers
+	if err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("+cpu +memory +pids"), 0644); err != nil {
+		return nil, fmt.Errorf("enable controllers of cgroup %s failed, err: %v", root, err)
+	}
+
+	return &cgroupRuntime{
+		config: config,
+		root:   root,
+	}, nil
+}
+
+// path returns the cgroup of the worker, named after its property file which
+// is unique per worker.
+func (r *cgroupRuntime) path(w *Worker) string {
+	name := strings.TrimSuffix(filepath.Base(w.PropertyJsonFile), filepath.Ext(w.PropertyJsonFile))
+	return filepath.Join(r.root, name)
+}
+
+func (r *cgroupRuntime) Start(w *Worker, stdout io.Writer, stderr io.Writer) (pid int, err error) {
+	path := r.path(w)
+	if err = os.Mkdir(path, 0755); err != nil && !os.IsExist(err) {
+		return
+	}
+
+	limits := map[string]string{}
+	if r.config.Cpus > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d %d", int64(r.config.Cpus*cgroupCpuPeriodUs), cgroupCpuPeriodUs)
+	}
+	if r.config.MemoryMaxBytes > 0 {
+		limits["memory.max"] = strconv.FormatInt(r.config.MemoryMaxBytes, 10)
+	}
+	if r.config.PidsMax > 0 {
+		limits["pids.max"] = strconv.FormatInt(r.config.PidsMax, 10)
+	}
+	for file, limit := range limits {
+		if err = os.WriteFile(filepath.Join(path, file), []byte(limit), 0644); err != nil {
+			return
+		}
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	// Spawn the process into the cgroup directly, so no process escapes the limits
+	cmd := newWorkerCmd(w, stdout, stderr)
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	if err = cmd.Start(); err != nil {
+		return
+	}
+
+	slog.Info("Worker cgroup created", "channelName", w.ChannelName, "cgroup", path, "limits", limits, logTag)
+
+	w.cmd = cmd
+	return cmd.Process.Pid, nil
+}
+
+func (r *cgroupRuntime) Signal(w *Worker, sig syscall.Signal) error {
+	return syscall.Kill(-w.Pid, sig)
+}
+
+func (r *cgroupRuntime) Stop(w *Worker) error {
+	// cgroup.kill kills every process of the cgroup, it's available since linux 5.14
+	if err := os.WriteFile(filepath.Join(r.path(w), "cgroup.kill"), []byte("1"), 0644); err != nil {
+		return syscall.Kill(-w.Pid, syscall.SIGKILL)
+	}
+	return nil
+}
+
+func (r *cgroupRuntime) Wait(w *Worker) (*os.ProcessState, error) {
+	cmd := w.cmd
+	if cmd == nil {
+		return nil, fmt.Errorf("worker process not started by this server")
+	}
+
+	err := cmd.Wait()
+
+	// Remove the cgroup once the rest of its processes are gone, unless the
+	// worker has been restarted in it meanwhile
+	go func() {
+		path := r.path(w)
+		for r.populated(path) {
+			time.Sleep(cgroupCleanSleepSeconds * time.Second)
+		}
+		if w.cmd == cmd {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				slog.Warn("Worker cgroup remove failed", "err", err, "cgroup", path, logTag)
+			}
+		}
+	}()
+
+	return cmd.ProcessState, err
+}
+
+// populated returns whether the cgroup has any live process.
+func (r *cgroupRuntime) populated(path string) bool {
+	content, err := os.ReadFile(filepath.Join(path, "cgroup.events"))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(content), "populated 1")
+}
+
+func (r *cgroupRuntime) Stats(w *Worker) (*ProcessStats, error) {
+	path := r.path(w)
+	stats := &ProcessStats{}
+
+	// Memory charged to the cgroup, page cache included
+	content, err := os.ReadFile(filepath.Join(path, "memory.current"))
+	if err != nil {
+		return nil, err
+	}
+	stats.RssBytes, _ = strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+
+	f, err := os.Open(filepath.Join(path, "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 && fields[0] == "usage_usec" {
+			usage, _ := strconv.ParseInt(fields[1], 10, 64)
+			stats.CpuSeconds = float64(usage) / 1e6
+		}
+	}
+
+	content, err = os.ReadFile(filepath.Join(path, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Fields(string(content)) {
+		pid, _ := strconv.Atoi(line)
+		if _, processStats, err := readProcessStats(pid); err == nil {
+			stats.Processes++
+			stats.OpenFds += processStats.OpenFds
+		}
+	}
+
+	return stats, nil
+}
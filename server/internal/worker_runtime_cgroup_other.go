@@ -0,0 +1,11 @@
+//go:build !linux
+
+package internal
+
+import (
+	"fmt"
+)
+
+func newCgroupRuntime(config *WorkerRuntimeConfig) (WorkerRuntime, error) {
+	return nil, fmt.Errorf("worker runtime %s is only supported on linux", workerRuntimeCgroup)
+}
@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// workerStore persists the workers map to a json file, so that a restarted
+// server is able to find the workers started by the previous one.
+type workerStore struct {
+	file    string
+	lock    sync.Mutex
+	touched atomic.Bool // the workers changed without being saved, e.g. pinged
+}
+
+const (
+	workerStoreFile         = "workers.json"
+	workerWatchSleepSeconds = 1
+)
+
+var (
+	workersStore *workerStore
+
+	// The exit status of an adopted worker is unknown, its exit is taken as a
+	// crash since it wasn't stopped
+	errWorkerAdoptedExited = errors.New("adopted worker exited")
+)
+
+func newWorkerStore(file string) *workerStore {
+	return &workerStore{
+		file: file,
+	}
+}
+
+// save writes a snapshot of the running workers into the store file.
+func (s *workerStore) save() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.touched.Store(false)
+	list := []*Worker{}
+	for _, v := range workers.Values() {
+		list = append(list, v.(*Worker))
+	}
+
+	content, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		slog.Error("Worker store marshal failed", "err", err, logTag)
+		return
+	}
+
+	// Write to a temporary file first, so that a crash never leaves a truncated store
+	tmpFile := s.file + ".tmp"
+	if err := os.WriteFile(tmpFile, content, 0644); err != nil {
+		slog.Error("Worker store write failed", "err", err, "file", tmpFile, logTag)
+		return
+	}
+
+	if err := os.Rename(tmpFile, s.file); err != nil {
+		slog.Error("Worker store rename failed", "err", err, "file", s.file, logTag)
+	}
+}
+
+// touch marks the workers changed, they are saved by the next flush instead
+// of on every change.
+func (s *workerStore) touch() {
+	if s == nil {
+		return
+	}
+	s.touched.Store(true)
+}
+
+// flush saves the workers if they have been touched since the last save.
+func (s *workerStore) flush() {
+	if s == nil || !s.touched.Load() {
+		return
+	}
+	s.save()
+}
+
+func (s *workerStore) load() (list []*Worker, err error) {
+	content, err := os.ReadFile(s.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	err = json.Unmarshal(content, &list)
+	return
+}
+
+// isWorkerAlive checks whether the process group leader of the worker is still
+// the process we started, the pid could have been reused by another process.
+func isWorkerAlive(w *Worker) bool {
+	if w.Pid <= 0 || !isInProcessGroup(w.Pid, w.Pid) {
+		return false
+	}
+
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", w.Pid))
+	if err != nil {
+		return false
+	}
+
+	return strings.Contains(string(cmdline), w.PropertyJsonFile)
+}
+
+// watch monitors a worker adopted from the store. The adopted worker is not a
+// child of this server, so its exit can only be observed by polling.
+func (w *Worker) watch() {
+	for isWorkerAlive(w) {
+		time.Sleep(workerWatchSleepSeconds * time.Second)
+	}
+
+	slog.Info("Worker adopted process exited", "channelName", w.ChannelName, "pid", w.Pid, logTag)
+	close(w.exited)
+
+	// The exit status of a process which is not our child is unknown
+	workerEvents.publish(workerEventExited, w.ChannelName, map[string]any{"pid": w.Pid, "adopted": true})
+
+	// The restarted worker is a child of this server, watched as any other
+	if w.shouldRestart(errWorkerAdoptedExited) {
+		go w.restart(&StartReq{RequestId: uuid.New().String(), ChannelName: w.ChannelName, GraphName: w.GraphName})
+		return
+	}
+	removeWorker(w)
+}
+
+// adoptWorkers re-adopts the workers recorded in the store whose processes are
+// still alive, and reaps the ones that are gone.
+func adoptWorkers() {
+	list, err := workersStore.load()
+	if err != nil {
+		slog.Error("Worker store load failed", "err", err, "file", workersStore.file, logTag)
+		return
+	}
+
+	for _, w := range list {
+		if !isWorkerAlive(w) {
+			slog.Info("Worker reaped", "channelName", w.ChannelName, "pid", w.Pid, logTag)
+			continue
+		}
+
+		if w.runtime, err = newWorkerRuntime(w.Runtime); err != nil {
+			slog.Warn("Worker runtime create failed, fallback to process", "err", err, "channelName", w.ChannelName, logTag)
+			w.runtime = &processRuntime{}
+		}
+
+		// Give the client a full timeout to ping the new server
+		w.UpdateTs = time.Now().Unix()
+		w.exited = make(chan struct{})
+		workers.Set(w.ChannelName, w)
+		httpServerPorts.reserve(w.HttpServerPort, w.ChannelName)
+		go w.watch()
+
+		slog.Info("Worker adopted", "channelName", w.ChannelName, "worker", w, logTag)
+	}
+
+	workersStore.save()
+}
+
+// SaveWorkers persists the running workers, workers are kept alive so that
+// they can be adopted by the next server.
+func SaveWorkers() {
+	workersStore.save()
+}
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestWorkerRoutesCmd(t *testing.T) {
+	propertyJsonFile := filepath.Join(t.TempDir(), "property.json")
+	writeTestFile(t, propertyJsonFile, `{"_ten": {"predefined_graphs": [{"name": "test", "connections": [
+		{"extension_group": "http_server", "extension": "http_server", "cmd": [
+			{"name": "flush", "dest": [{"extension_group": "chatgpt", "extension": "openai_chatgpt"}]},
+			{"name": "file_chunk", "dest": []}
+		]}
+	]}]}}`)
+
+	tests := []struct {
+		name           string
+		cmd            string
+		httpServerPort int32
+		routed         bool
+	}{
+		{"routed", "flush", 10000, true},
+		{"no dest", "file_chunk", 10000, false},
+		{"not connected", workerCmdGoodbye, 10000, false},
+		{"no http_server", "flush", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &Worker{PropertyJsonFile: propertyJsonFile, HttpServerPort: tt.httpServerPort}
+			if routed := w.routesCmd(tt.cmd); routed != tt.routed {
+				t.Fatalf("routesCmd(%s) = %v, want %v", tt.cmd, routed, tt.routed)
+			}
+		})
+	}
+}
+
+func TestWorkerUpdateCmdMissing(t *testing.T) {
+	w := &Worker{HttpServerPort: 10000}
+	for _, ten := range []*WorkerUpdateReqTen{nil, {Type: "cmd"}} {
+		if err := w.update(&WorkerUpdateReq{ChannelName: "test", Ten: ten}); err != errWorkerCmdMissing {
+			t.Fatalf("update(%+v) err = %v, want %v", ten, err, errWorkerCmdMissing)
+		}
+	}
+}
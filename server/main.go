@@ -1,18 +1,81 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
 	"os"
 	"os/signal"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 
 	"app/internal"
 )
 
+const (
+	defaultWorkerStartTimeoutSeconds = 30
+	defaultWorkerStopDrainSeconds    = 2
+	defaultWorkerStopTimeoutSeconds  = 5
+	defaultWorkerLogBufferLines      = 1000
+	defaultWorkerHttpServerPortMin   = 10000
+	defaultWorkerHttpServerPortMax   = 30000
+	defaultNodeHeartbeatSeconds      = 5
+	defaultRetentionSweepMinutes     = 60
+	defaultUploadMaxBytes            = 20 * 1024 * 1024
+	defaultTokenExpireSeconds        = 86400
+	defaultTokenExpireSecondsMin     = 60
+	defaultTokenExpireSecondsMax     = 86400
+	defaultTokenRefreshBeforeSeconds = 600
+)
+
+// getEnvInt reads an optional integer environment, the default value is used
+// if it's not set or less than minValue.
+func getEnvInt(key string, defaultValue int, minValue int) int {
+	env := os.Getenv(key)
+	if env == "" {
+		return defaultValue
+	}
+
+	value, err := strconv.Atoi(env)
+	if err != nil || value < minValue {
+		slog.Warn(fmt.Sprintf("environment %s invalid, use default", key), "default", defaultValue)
+		return defaultValue
+	}
+
+	return value
+}
+
+// encryptSecrets encrypts the JSON secrets by tenant read from stdin with
+// SECRETS_KEY, and writes the secrets file to stdout.
+func encryptSecrets() {
+	plaintext, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		slog.Error("read secrets failed", "err", err)
+		os.Exit(1)
+	}
+
+	var secrets map[string]map[string]string
+	if err = json.Unmarshal(plaintext, &secrets); err != nil {
+		slog.Error("secrets invalid, expected the secrets by name by tenant", "err", err)
+		os.Exit(1)
+	}
+
+	content, err := internal.EncryptSecrets(os.Getenv("SECRETS_KEY"), plaintext)
+	if err != nil {
+		slog.Error("environment SECRETS_KEY invalid", "err", err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(content)
+}
+
 func main() {
 	// Load .env
 	err := godotenv.Load()
@@ -20,6 +83,12 @@ func main() {
 		slog.Warn("load .env file failed", "err", err)
 	}
 
+	// Encrypt the secrets file of the encrypted_file provider, from stdin to stdout
+	if len(os.Args) > 1 && os.Args[1] == "encrypt-secrets" {
+		encryptSecrets()
+		return
+	}
+
 	// Check if the directory exists
 	logPath := os.Getenv("LOG_PATH")
 	if _, err := os.Stat(logPath); os.IsNotExist(err) {
@@ -54,26 +123,251 @@ func main() {
 		os.Exit(1)
 	}
 
+	workerStartTimeoutSeconds := getEnvInt("WORKER_START_TIMEOUT_SECONDS", defaultWorkerStartTimeoutSeconds, 1)
+
+	var workerReadyPattern *regexp.Regexp
+	if pattern := os.Getenv("WORKER_READY_PATTERN"); pattern != "" {
+		workerReadyPattern, err = regexp.Compile(pattern)
+		if err != nil {
+			slog.Error("environment WORKER_READY_PATTERN invalid", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	workerStopDrainSeconds := getEnvInt("WORKER_STOP_DRAIN_SECONDS", defaultWorkerStopDrainSeconds, 0)
+	workerStopTimeoutSeconds := getEnvInt("WORKER_STOP_TIMEOUT_SECONDS", defaultWorkerStopTimeoutSeconds, 1)
+	workerLogBufferLines := getEnvInt("WORKER_LOG_BUFFER_LINES", defaultWorkerLogBufferLines, 1)
+
+	workerHttpServerPortMin := getEnvInt("WORKER_HTTP_SERVER_PORT_MIN", defaultWorkerHttpServerPortMin, 1)
+	workerHttpServerPortMax := getEnvInt("WORKER_HTTP_SERVER_PORT_MAX", defaultWorkerHttpServerPortMax, 1)
+	if workerHttpServerPortMin > workerHttpServerPortMax || workerHttpServerPortMax > 65535 {
+		slog.Error("environment WORKER_HTTP_SERVER_PORT_MIN/WORKER_HTTP_SERVER_PORT_MAX invalid", "min", workerHttpServerPortMin, "max", workerHttpServerPortMax)
+		os.Exit(1)
+	}
+
+	// Runtime of the workers by graph name, e.g. {"default":{"runtime":"cgroup","cpus":1}}
+	var workerRuntimes map[string]*internal.WorkerRuntimeConfig
+	if runtimes := os.Getenv("WORKER_RUNTIMES"); runtimes != "" {
+		if err = json.Unmarshal([]byte(runtimes), &workerRuntimes); err != nil {
+			slog.Error("environment WORKER_RUNTIMES invalid", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// Cluster
+	serverMode := os.Getenv("SERVER_MODE")
+	if serverMode == "" {
+		serverMode = internal.ServerModeStandalone
+	}
+	nodeHeartbeatSeconds := getEnvInt("NODE_HEARTBEAT_SECONDS", defaultNodeHeartbeatSeconds, 1)
+	coordinatorUrl := strings.TrimSuffix(os.Getenv("COORDINATOR_URL"), "/")
+	nodeId := os.Getenv("NODE_ID")
+	nodeUrl := os.Getenv("NODE_URL")
+	// The catalog is only shared by the servers of a cluster through a file they all can reach
+	catalogFile := os.Getenv("CATALOG_FILE")
+	switch serverMode {
+	case internal.ServerModeStandalone:
+	case internal.ServerModeCoordinator:
+		if catalogFile == "" {
+			slog.Error("environment CATALOG_FILE is mandatory in coordinator mode")
+			os.Exit(1)
+		}
+	case internal.ServerModeNode:
+		if coordinatorUrl == "" {
+			slog.Error("environment COORDINATOR_URL is mandatory in node mode")
+			os.Exit(1)
+		}
+		if catalogFile == "" {
+			slog.Error("environment CATALOG_FILE is mandatory in node mode")
+			os.Exit(1)
+		}
+		if nodeUrl == "" {
+			nodeUrl = fmt.Sprintf("http://127.0.0.1:%s", os.Getenv("SERVER_PORT"))
+		}
+		if nodeId == "" {
+			hostname, _ := os.Hostname()
+			nodeId = fmt.Sprintf("%s:%s", hostname, os.Getenv("SERVER_PORT"))
+		}
+	default:
+		slog.Error("environment SERVER_MODE invalid", "serverMode", serverMode)
+		os.Exit(1)
+	}
+
+	// Auth, keys by id, e.g. {"key1":{"tenant":"acme","secret":"...","admin":false}}
+	var authKeys map[string]*internal.AuthKey
+	if keys := os.Getenv("AUTH_KEYS"); keys != "" {
+		if err = json.Unmarshal([]byte(keys), &authKeys); err != nil {
+			slog.Error("environment AUTH_KEYS invalid", "err", err)
+			os.Exit(1)
+		}
+	}
+	authenticator, err := internal.NewAuthenticator(os.Getenv("AUTH_MODE"), authKeys)
+	if err != nil {
+		slog.Error("environment AUTH_MODE/AUTH_KEYS invalid", "err", err)
+		os.Exit(1)
+	}
+	nodeAuthKey := os.Getenv("NODE_AUTH_KEY")
+	if serverMode == internal.ServerModeNode && authenticator != nil {
+		if key, ok := authKeys[nodeAuthKey]; !ok || !key.Admin {
+			slog.Error("environment NODE_AUTH_KEY must be an admin key of AUTH_KEYS in node mode")
+			os.Exit(1)
+		}
+	}
+
+	// Quotas by tenant, e.g. {"default":{"workers_max":10,"starts_per_minute":30}}
+	var tenantQuotas map[string]*internal.TenantQuota
+	if tenantQuotasEnv := os.Getenv("TENANT_QUOTAS"); tenantQuotasEnv != "" {
+		if err = json.Unmarshal([]byte(tenantQuotasEnv), &tenantQuotas); err != nil {
+			slog.Error("environment TENANT_QUOTAS invalid", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// Secrets of the graphs, injected into the property files of the workers
+	secretsProvider, err := internal.NewSecretsProvider(&internal.SecretsConfig{
+		Provider:   os.Getenv("SECRETS_PROVIDER"),
+		EnvFileDir: os.Getenv("SECRETS_ENV_FILE_DIR"),
+		File:       os.Getenv("SECRETS_FILE"),
+		Key:        os.Getenv("SECRETS_KEY"),
+		HttpUrl:    os.Getenv("SECRETS_HTTP_URL"),
+		HttpToken:  os.Getenv("SECRETS_HTTP_TOKEN"),
+	})
+	if err != nil {
+		slog.Error("environment SECRETS_PROVIDER invalid", "err", err)
+		os.Exit(1)
+	}
+	var secretsEnvFallback []string
+	for _, name := range strings.Split(os.Getenv("SECRETS_ENV_FALLBACK"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			secretsEnvFallback = append(secretsEnvFallback, name)
+		}
+	}
+
+	// Retention of the files of the workers by artifact type, e.g. {"log":{"max_age_hours":168,"compress_after_hours":24}}
+	var retentionPolicies map[string]*internal.RetentionPolicy
+	if policies := os.Getenv("RETENTION_POLICIES"); policies != "" {
+		if err = json.Unmarshal([]byte(policies), &retentionPolicies); err != nil {
+			slog.Error("environment RETENTION_POLICIES invalid", "err", err)
+			os.Exit(1)
+		}
+	}
+	retentionSweepMinutes := getEnvInt("RETENTION_SWEEP_MINUTES", defaultRetentionSweepMinutes, 1)
+	retention, err := internal.NewRetention(logPath, retentionPolicies, time.Duration(retentionSweepMinutes)*time.Minute)
+	if err != nil {
+		slog.Error("environment RETENTION_POLICIES invalid", "err", err)
+		os.Exit(1)
+	}
+
+	// Collections of the catalog before any document is ingested, e.g. [{"name":"doc.pdf","collection":"a0f3..."}]
+	var catalogPresets []*internal.CatalogCollection
+	if presets := os.Getenv("VECTOR_DOCUMENT_PRESET_LIST"); presets != "" {
+		if err = json.Unmarshal([]byte(presets), &catalogPresets); err != nil {
+			slog.Error("environment VECTOR_DOCUMENT_PRESET_LIST invalid", "err", err)
+			os.Exit(1)
+		}
+		for _, preset := range catalogPresets {
+			if preset.Collection == "" {
+				slog.Error("environment VECTOR_DOCUMENT_PRESET_LIST invalid, collection missing", "name", preset.Name)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// Documents accepted by /vector/document/upload, by size and type sniffed from the content
+	uploadMaxBytes := getEnvInt("UPLOAD_MAX_BYTES", defaultUploadMaxBytes, 1)
+	uploadAllowedTypes := internal.UploadTypes
+	if types := os.Getenv("UPLOAD_ALLOWED_TYPES"); types != "" {
+		uploadAllowedTypes = nil
+		for _, uploadType := range strings.Split(types, ",") {
+			uploadType = strings.TrimSpace(uploadType)
+			if !slices.Contains(internal.UploadTypes, uploadType) {
+				slog.Error("environment UPLOAD_ALLOWED_TYPES invalid", "type", uploadType, "supported", internal.UploadTypes)
+				os.Exit(1)
+			}
+			uploadAllowedTypes = append(uploadAllowedTypes, uploadType)
+		}
+	}
+
+	// Expiry of the tokens, the ones of the requests must be within the bounds
+	tokenExpireSeconds := getEnvInt("TOKEN_EXPIRE_SECONDS", defaultTokenExpireSeconds, 1)
+	tokenExpireSecondsMin := getEnvInt("TOKEN_EXPIRE_SECONDS_MIN", defaultTokenExpireSecondsMin, 1)
+	tokenExpireSecondsMax := getEnvInt("TOKEN_EXPIRE_SECONDS_MAX", defaultTokenExpireSecondsMax, 1)
+	if tokenExpireSecondsMin > tokenExpireSeconds || tokenExpireSeconds > tokenExpireSecondsMax || tokenExpireSecondsMax > math.MaxUint32 {
+		slog.Error("environment TOKEN_EXPIRE_SECONDS/TOKEN_EXPIRE_SECONDS_MIN/TOKEN_EXPIRE_SECONDS_MAX invalid", "expire", tokenExpireSeconds, "min", tokenExpireSecondsMin, "max", tokenExpireSecondsMax)
+		os.Exit(1)
+	}
+	// The tokens of the workers are refreshed before they expire
+	tokenRefreshBeforeSeconds := getEnvInt("TOKEN_REFRESH_BEFORE_SECONDS", defaultTokenRefreshBeforeSeconds, 1)
+	if tokenRefreshBeforeSeconds >= tokenExpireSeconds {
+		slog.Error("environment TOKEN_REFRESH_BEFORE_SECONDS must be less than TOKEN_EXPIRE_SECONDS", "refreshBefore", tokenRefreshBeforeSeconds, "expire", tokenExpireSeconds)
+		os.Exit(1)
+	}
+
+	var corsAllowOrigins []string
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOW_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			corsAllowOrigins = append(corsAllowOrigins, origin)
+		}
+	}
+
+	workersKeepOnExit, err := strconv.ParseBool(os.Getenv("WORKERS_KEEP_ON_EXIT"))
+	if err != nil {
+		workersKeepOnExit = false
+	}
+
 	// Set up signal handler to clean up all workers on Ctrl+C
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		<-sigs
-		fmt.Println("Received interrupt signal, cleaning up workers...")
-		internal.CleanWorkers()
+		if workersKeepOnExit {
+			fmt.Println("Received interrupt signal, keeping workers for the next server...")
+			internal.SaveWorkers()
+		} else {
+			fmt.Println("Received interrupt signal, cleaning up workers...")
+			internal.CleanWorkers()
+		}
 		os.Exit(0)
 	}()
 
 	// Start server
 	httpServerConfig := &internal.HttpServerConfig{
-		AppId:                    agoraAppId,
-		AppCertificate:           os.Getenv("AGORA_APP_CERTIFICATE"),
-		LogPath:                  logPath,
-		Port:                     os.Getenv("SERVER_PORT"),
-		WorkersMax:               workersMax,
-		WorkerQuitTimeoutSeconds: workerQuitTimeoutSeconds,
-		Log2Stdout:               log2Stdout,
+		AppId:                     agoraAppId,
+		AppCertificate:            os.Getenv("AGORA_APP_CERTIFICATE"),
+		LogPath:                   logPath,
+		Port:                      os.Getenv("SERVER_PORT"),
+		WorkersMax:                workersMax,
+		WorkerQuitTimeoutSeconds:  workerQuitTimeoutSeconds,
+		WorkerStartTimeoutSeconds: workerStartTimeoutSeconds,
+		WorkerReadyPattern:        workerReadyPattern,
+		WorkerStopDrainSeconds:    workerStopDrainSeconds,
+		WorkerStopTimeoutSeconds:  workerStopTimeoutSeconds,
+		WorkerLogBufferLines:      workerLogBufferLines,
+		WorkerRuntimes:            workerRuntimes,
+		WorkerHttpServerPortMin:   workerHttpServerPortMin,
+		WorkerHttpServerPortMax:   workerHttpServerPortMax,
+		ServerMode:                serverMode,
+		CoordinatorUrl:            coordinatorUrl,
+		NodeId:                    nodeId,
+		NodeUrl:                   nodeUrl,
+		NodeHeartbeatSeconds:      nodeHeartbeatSeconds,
+		NodeAuthKey:               nodeAuthKey,
+		Authenticator:             authenticator,
+		CorsAllowOrigins:          corsAllowOrigins,
+		TenantQuotas:              tenantQuotas,
+		SecretsProvider:           secretsProvider,
+		SecretsEnvFallback:        secretsEnvFallback,
+		Retention:                 retention,
+		UploadMaxBytes:            int64(uploadMaxBytes),
+		UploadAllowedTypes:        uploadAllowedTypes,
+		CatalogFile:               catalogFile,
+		CatalogPresets:            catalogPresets,
+		TokenExpireSeconds:        uint32(tokenExpireSeconds),
+		TokenExpireSecondsMin:     uint32(tokenExpireSecondsMin),
+		TokenExpireSecondsMax:     uint32(tokenExpireSecondsMax),
+		TokenRefreshBeforeSeconds: uint32(tokenRefreshBeforeSeconds),
+		Log2Stdout:                log2Stdout,
 	}
 	httpServer := internal.NewHttpServer(httpServerConfig)
 	httpServer.Start()